@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	errMissingToken   = "missing bearer token"
+	errInvalidToken   = "invalid token"
+	errExpiredToken   = "token expired"
+	errSessionRevoked = "session ended, log in again"
+)
+
+// jwtHeader is the header of every access token.  Tokens with any other header, and so any other algorithm, are rejected
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// AuthConfig configures the tokens issued on login
+type AuthConfig struct {
+	// Secret signs access tokens.  Random if empty, which logs everyone out on restart
+	Secret []byte
+	// AccessTokenExpiry is how long an access token lasts.  Logging out takes effect immediately regardless
+	AccessTokenExpiry time.Duration
+	// RefreshTokenExpiry is how long a session lasts without being refreshed
+	RefreshTokenExpiry time.Duration
+}
+
+// Session is a login, kept until logout or until it goes `RefreshTokenExpiry` without a refresh
+type Session struct {
+	ID     string
+	UserID int64
+	// RefreshHash is the SHA-256 in hex of the session's current refresh token
+	RefreshHash string
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+	RevokedAt   *time.Time
+}
+
+// active reports whether the session may still be used at `now`
+func (s *Session) active(now time.Time) bool {
+	return s != nil && s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
+// Tokens are issued on login and refresh.  Send the access token as `Authorization: Bearer <access_token>`, and the
+// refresh token to /api/user/refresh for new tokens before the access token expires
+type Tokens struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type" example:"Bearer"`
+	// Seconds until the access token expires
+	ExpiresIn int64 `json:"expires_in" example:"900"`
+	// Single use.  Each refresh returns a new one
+	RefreshToken string `json:"refresh_token"`
+	User         User   `json:"user"`
+}
+
+// RefreshRequest is sent to exchange a refresh token for new tokens
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// tokenClaims are the claims of an access token
+type tokenClaims struct {
+	// the user's ID, a string as the JWT spec requires
+	Subject   string `json:"sub"`
+	Name      string `json:"name"`
+	SessionID string `json:"sid"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// userID is the ID of the user the token was issued to
+func (c *tokenClaims) userID() int64 {
+	id, _ := strconv.ParseInt(c.Subject, 10, 64)
+	return id
+}
+
+// randomToken returns `n` random bytes in hex
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return hex.EncodeToString(b), err
+}
+
+// signToken signs `claims` as an HS256 JWT
+func signToken(secret []byte, claims tokenClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(hmacSHA256(secret, unsigned)), nil
+}
+
+// parseToken verifies access token `token` and returns its claims, or a message for the client saying why it is invalid
+func parseToken(secret []byte, token string, now time.Time) (*tokenClaims, string) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return nil, errInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, hmacSHA256(secret, parts[0]+"."+parts[1])) {
+		return nil, errInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	claims := tokenClaims{}
+	if err = json.Unmarshal(payload, &claims); err != nil || claims.userID() <= 0 || len(claims.SessionID) == 0 {
+		return nil, errInvalidToken
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, errExpiredToken
+	}
+	return &claims, ""
+}
+
+// splitRefreshToken splits a refresh token into its session ID and the hash of the whole token
+func splitRefreshToken(token string) (string, string, bool) {
+	ii := strings.IndexByte(token, '.')
+	if ii <= 0 {
+		return "", "", false
+	}
+	return token[:ii], sha256Hex([]byte(token)), true
+}
+
+type claimsKey struct{}
+
+// requestClaims returns the claims of the access token `r` was authenticated with, or nil
+func requestClaims(r *http.Request) *tokenClaims {
+	claims, _ := r.Context().Value(claimsKey{}).(*tokenClaims)
+	return claims
+}
+
+// publicWrites are the mutating routes open to clients that are not logged in
+var publicWrites = map[string]bool{
+	"/api/user/create":  true,
+	"/api/user/auth":    true,
+	"/api/user/refresh": true,
+}
+
+// needsAuth reports whether `r` changes anything, and so must be made by a logged in user
+func needsAuth(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return strings.HasPrefix(r.URL.Path, "/api/") && !publicWrites[r.URL.Path]
+}
+
+// unauthorized writes a 401 asking for a bearer token
+func unauthorized(msg string, w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="debatabase"`)
+	writeError(msg, 401, w)
+}
+
+// authenticate checks that `r` carries an access token from a session that has not been logged out, returning `r` with
+// the token's claims in its context.  Writes a 401 and returns false if not
+func (api *API) authenticate(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		unauthorized(errMissingToken, w)
+		return r, false
+	}
+	claims, msg := parseToken(api.auth.Secret, strings.TrimSpace(auth[7:]), time.Now())
+	if claims == nil {
+		unauthorized(msg, w)
+		return r, false
+	}
+	// a replica may not have seen the logout yet
+	session, err := api.store.SessionByID(withPrimary(r.Context()), claims.SessionID)
+	if err != nil {
+		internalError("querying session", w, err)
+		return r, false
+	} else if !session.active(time.Now()) || session.UserID != claims.userID() {
+		unauthorized(errSessionRevoked, w)
+		return r, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)), true
+}
+
+// requireAuth rejects requests that change anything unless they are authenticated, so no write is left open to clients
+// that are not logged in.  Routes check the client's role themselves, see `API.require`
+func (api *API) requireAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if needsAuth(r) {
+			var ok bool
+			if r, ok = api.authenticate(w, r); !ok {
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// issueTokens signs an access token for `user` in session `sessionID`, returning it with `refreshToken`
+func (api *API) issueTokens(user User, sessionID, refreshToken string) (Tokens, error) {
+	now := time.Now()
+	access, err := signToken(api.auth.Secret, tokenClaims{
+		Subject:   strconv.FormatInt(user.ID, 10),
+		Name:      user.Name,
+		SessionID: sessionID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(api.auth.AccessTokenExpiry).Unix(),
+	})
+	return Tokens{
+		AccessToken:  access,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(api.auth.AccessTokenExpiry / time.Second),
+		RefreshToken: refreshToken,
+		User:         user,
+	}, err
+}
+
+// newRefreshToken returns a new refresh token for session `sessionID`, and its hash
+func newRefreshToken(sessionID string) (string, string, error) {
+	secret, err := randomToken(32)
+	token := sessionID + "." + secret
+	return token, sha256Hex([]byte(token)), err
+}
+
+// login starts a session for `user` and writes its tokens
+func (api *API) login(w http.ResponseWriter, r *http.Request, user User) {
+	id, err := randomToken(16)
+	if err != nil {
+		internalError("creating session", w, err)
+		return
+	}
+	refresh, hash, err := newRefreshToken(id)
+	if err != nil {
+		internalError("creating session", w, err)
+		return
+	}
+	now := time.Now().UTC()
+	err = api.store.InsertSession(r.Context(), Session{
+		ID:          id,
+		UserID:      user.ID,
+		RefreshHash: hash,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(api.auth.RefreshTokenExpiry),
+	})
+	if err != nil {
+		internalError("inserting session", w, err)
+		return
+	}
+	tokens, err := api.issueTokens(user, id, refresh)
+	if err != nil {
+		internalError("signing token", w, err)
+		return
+	}
+	resp, err := json.Marshal(tokens)
+	if err != nil {
+		internalError("marshalling response", w, err)
+		return
+	}
+	w.Write(resp)
+}
+
+// @Summary Refresh Tokens
+// @Description Exchanges a refresh token for a new access token and refresh token.  Each refresh token works once: reusing
+// @Description one logs its session out, in case it was stolen
+// @Accept  json
+// @Produce json
+// @Param refresh body main.RefreshRequest true "Refresh token"
+// @Success 200 {object} main.Tokens "New tokens"
+// @Failure 400 {object} main.ErrJSON "Bad request"
+// @Failure 401 {object} main.ErrJSON "Invalid, reused or expired refresh token"
+// @Failure 500 {object} main.ErrJSON "Internal error"
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
+// @Router /api/user/refresh [POST]
+func (api *API) refreshTokens(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		internalError("reading body", w, err)
+		return
+	}
+	req := RefreshRequest{}
+	if err = json.Unmarshal(body, &req); err != nil || len(req.RefreshToken) == 0 {
+		writeError("malformed request", 400, w)
+		return
+	}
+	id, hash, ok := splitRefreshToken(req.RefreshToken)
+	if !ok {
+		unauthorized(errInvalidToken, w)
+		return
+	}
+	ctx := withPrimary(r.Context())
+	session, err := api.store.SessionByID(ctx, id)
+	if err != nil {
+		internalError("querying session", w, err)
+		return
+	} else if !session.active(time.Now()) {
+		unauthorized(errSessionRevoked, w)
+		return
+	}
+	refresh, newHash, err := newRefreshToken(id)
+	if err != nil {
+		internalError("creating refresh token", w, err)
+		return
+	}
+	rotated, err := api.store.RotateSession(ctx, id, hash, newHash, time.Now().UTC().Add(api.auth.RefreshTokenExpiry))
+	if err != nil {
+		internalError("rotating session", w, err)
+		return
+	} else if !rotated {
+		// an old refresh token, so either it or the current one was stolen
+		log.Println("Refresh token reused, logging out session", id)
+		if err = api.store.RevokeSession(ctx, id); err != nil {
+			internalError("revoking session", w, err)
+			return
+		}
+		unauthorized(errSessionRevoked, w)
+		return
+	}
+	user, err := api.store.UserByID(ctx, session.UserID)
+	if err != nil {
+		internalError("querying user", w, err)
+		return
+	} else if user == nil {
+		unauthorized(errSessionRevoked, w)
+		return
+	}
+	tokens, err := api.issueTokens(*user, id, refresh)
+	if err != nil {
+		internalError("signing token", w, err)
+		return
+	}
+	resp, err := json.Marshal(tokens)
+	if err != nil {
+		internalError("marshalling response", w, err)
+		return
+	}
+	w.Write(resp)
+}
+
+// @Summary Log out
+// @Description Ends the session the access token belongs to.  Its access and refresh tokens stop working immediately
+// @Security Bearer
+// @Success 200 "Ok"
+// @Failure 401 {object} main.ErrJSON "Missing or invalid token"
+// @Failure 500 {object} main.ErrJSON "Internal error"
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
+// @Router /api/user/logout [POST]
+func (api *API) logout(w http.ResponseWriter, r *http.Request) {
+	err := api.store.RevokeSession(r.Context(), requestClaims(r).SessionID)
+	if err != nil {
+		internalError("revoking session", w, err)
+		return
+	}
+}
+
+// InsertSession records a new session, first removing sessions that have expired
+func (db *DB) InsertSession(ctx context.Context, s Session) error {
+	return db.run(ctx, func(ctx context.Context, c *DB) error {
+		_, err := c.Exec(ctx, "DELETE FROM sessions WHERE ExpiresAt < ?;", s.CreatedAt.UTC())
+		if err != nil {
+			return err
+		}
+		_, err = c.Exec(ctx, "INSERT INTO sessions (ID, UserID, RefreshHash, CreatedAt, ExpiresAt) VALUES (?, ?, ?, ?, ?);",
+			s.ID, s.UserID, s.RefreshHash, s.CreatedAt.UTC(), s.ExpiresAt.UTC())
+		return err
+	})
+}
+
+// SessionByID returns session `id`, or nil
+func (db *DB) SessionByID(ctx context.Context, id string) (*Session, error) {
+	var session *Session
+	err := db.read(ctx, func(ctx context.Context, c *DB) error {
+		s := Session{}
+		err := c.QueryRow(ctx, "SELECT ID, UserID, RefreshHash, CreatedAt, ExpiresAt, RevokedAt FROM sessions WHERE ID=?;", id).
+			Scan(&s.ID, &s.UserID, &s.RefreshHash, &s.CreatedAt, &s.ExpiresAt, &s.RevokedAt)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		session = &s
+		return nil
+	})
+	return session, err
+}
+
+// RotateSession replaces the refresh token of session `id` and extends it to `expiresAt`, if its current refresh token
+// hashes to `oldHash` and it is active.  Reports whether it was replaced
+func (db *DB) RotateSession(ctx context.Context, id, oldHash, newHash string, expiresAt time.Time) (bool, error) {
+	res, err := db.exec(ctx, "UPDATE sessions SET RefreshHash=?, ExpiresAt=? WHERE ID=? AND RefreshHash=? AND RevokedAt IS NULL AND ExpiresAt > ?;",
+		newHash, expiresAt.UTC(), id, oldHash, time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// RevokeSession logs session `id` out
+func (db *DB) RevokeSession(ctx context.Context, id string) error {
+	_, err := db.exec(ctx, "UPDATE sessions SET RevokedAt=? WHERE ID=? AND RevokedAt IS NULL;", time.Now().UTC(), id)
+	return err
+}
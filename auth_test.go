@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseToken(t *testing.T) {
+	secret := []byte("test secret")
+	now := time.Now()
+	claims := tokenClaims{Subject: "7", Name: "alice", SessionID: "abc", IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Minute).Unix()}
+	token, err := signToken(secret, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, msg := parseToken(secret, token, now)
+	if got == nil || *got != claims || got.userID() != 7 {
+		t.Fatalf("parsed %+v, %q, want %+v", got, msg, claims)
+	}
+
+	// sign modified claims, as an attacker could without the secret
+	forge := func(header string, modify func(*tokenClaims)) string {
+		c := claims
+		modify(&c)
+		signed, err := signToken(secret, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts := strings.Split(signed, ".")
+		if len(header) > 0 {
+			parts[0] = base64.RawURLEncoding.EncodeToString([]byte(header))
+		}
+		return strings.Join(parts, ".")
+	}
+	parts := strings.Split(token, ".")
+	otherKey, err := signToken([]byte("other secret"), claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// another user's claims under this token's signature
+	tampered := strings.Split(forge("", func(c *tokenClaims) { c.Subject = "1" }), ".")
+	for name, c := range map[string]struct {
+		token string
+		msg   string
+	}{
+		"another key":      {otherKey, errInvalidToken},
+		"tampered payload": {parts[0] + "." + tampered[1] + "." + parts[2], errInvalidToken},
+		"bad signature":    {parts[0] + "." + parts[1] + "." + strings.Repeat("A", len(parts[2])), errInvalidToken},
+		"alg none":         {forge(`{"alg":"none","typ":"JWT"}`, func(*tokenClaims) {}), errInvalidToken},
+		"unsigned":         {parts[0] + "." + parts[1] + ".", errInvalidToken},
+		"not a JWT":        {"token", errInvalidToken},
+		"no user":          {forge("", func(c *tokenClaims) { c.Subject = "alice" }), errInvalidToken},
+		"no session":       {forge("", func(c *tokenClaims) { c.SessionID = "" }), errInvalidToken},
+		"expired":          {forge("", func(c *tokenClaims) { c.ExpiresAt = now.Unix() }), errExpiredToken},
+	} {
+		if got, msg := parseToken(secret, c.token, now); got != nil || msg != c.msg {
+			t.Errorf("%s: parsed %+v, %q, want %q", name, got, msg, c.msg)
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, store := range testStores(t, dir) {
+		t.Run(name, func(t *testing.T) {
+			defer store.Close()
+			ctx := context.Background()
+			userID, err := store.InsertUser(ctx, User{Name: "alice", PasswordHash: "hash", Role: RoleContributor})
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now().UTC()
+			for id, expires := range map[string]time.Time{"current": now.Add(time.Hour), "expired": now.Add(-time.Second)} {
+				err = store.InsertSession(ctx, Session{ID: id, UserID: userID, RefreshHash: "first", CreatedAt: now, ExpiresAt: expires})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			active := func(id string) bool {
+				t.Helper()
+				s, err := store.SessionByID(ctx, id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return s.active(time.Now())
+			}
+			if !active("current") || active("expired") || active("missing") {
+				t.Error("sessions active after login:", active("current"), active("expired"), active("missing"))
+			}
+
+			// each refresh token rotates once
+			rotate := func(id, oldHash, newHash string) bool {
+				t.Helper()
+				rotated, err := store.RotateSession(ctx, id, oldHash, newHash, time.Now().UTC().Add(time.Hour))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return rotated
+			}
+			if !rotate("current", "first", "second") {
+				t.Error("current refresh token not rotated")
+			}
+			if rotate("current", "first", "third") {
+				t.Error("reused refresh token rotated")
+			}
+			if rotate("expired", "first", "second") {
+				t.Error("expired session rotated")
+			}
+
+			if err = store.RevokeSession(ctx, "current"); err != nil {
+				t.Fatal(err)
+			}
+			if active("current") || rotate("current", "second", "third") {
+				t.Error("revoked session still in use")
+			}
+		})
+	}
+}
+
+func TestRouterRefresh(t *testing.T) {
+	rt := newRouterTest(t)
+	login := func() Tokens {
+		t.Helper()
+		tokens := Tokens{}
+		w := rt.expect("POST", "/api/user/auth", "", `{"name":"contributor","password":"password"}`, 200)
+		if err := json.Unmarshal(w.Body.Bytes(), &tokens); err != nil {
+			t.Fatal(err)
+		}
+		return tokens
+	}
+	// writes as the session of `tokens`, returning the status
+	write := func(tokens Tokens, tag string) int {
+		rt.tokens["session"] = tokens.AccessToken
+		return rt.do("POST", "/api/upload/tag", "session", `{"name":"`+tag+`"}`).Code
+	}
+	refresh := func(tokens Tokens, code int) Tokens {
+		t.Helper()
+		refreshed := Tokens{}
+		w := rt.expect("POST", "/api/user/refresh", "", `{"refresh_token":"`+tokens.RefreshToken+`"}`, code)
+		if code == 200 {
+			if err := json.Unmarshal(w.Body.Bytes(), &refreshed); err != nil {
+				t.Fatal(err)
+			}
+		} else if w.Header().Get("WWW-Authenticate") == "" {
+			t.Error("refused refresh has no WWW-Authenticate")
+		}
+		return refreshed
+	}
+
+	first := login()
+	if first.TokenType != "Bearer" || first.ExpiresIn <= 0 || first.User.Name != "contributor" || len(first.RefreshToken) == 0 {
+		t.Fatalf("logged in with %+v", first)
+	}
+	second := refresh(first, 200)
+	if second.RefreshToken == first.RefreshToken || second.User.Name != "contributor" {
+		t.Fatalf("refreshed to %+v", second)
+	}
+	if code := write(second, "engine"); code != 200 {
+		t.Errorf("write with refreshed token: %d", code)
+	}
+	rt.expect("POST", "/api/user/refresh", "", `{}`, 400)
+	rt.expect("POST", "/api/user/refresh", "", `{"refresh_token":"garbage"}`, 401)
+
+	// reusing a refresh token, which may have been stolen, logs the session out
+	other := login()
+	refresh(first, 401)
+	if code := write(second, "motor"); code != 401 {
+		t.Errorf("write after refresh token reuse: %d", code)
+	}
+	refresh(second, 401)
+	// but not the user's other sessions
+	if code := write(other, "motor"); code != 200 {
+		t.Errorf("write in another session: %d", code)
+	}
+
+	rt.expect("POST", "/api/user/logout", "", "", 401)
+	rt.tokens["session"] = other.AccessToken
+	rt.expect("POST", "/api/user/logout", "session", "", 200)
+	if code := write(other, "train"); code != 401 {
+		t.Errorf("write after logout: %d", code)
+	}
+	refresh(other, 401)
+}
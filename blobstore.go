@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// errBlobNotFound is returned by BlobStore.Get when no blob has the name
+var errBlobNotFound = errors.New("blob not found")
+
+// BlobStore keeps named blobs of bytes, such as uploaded images, outside the database
+type BlobStore interface {
+	// Put stores `data` as `name`, replacing any blob with that name
+	Put(ctx context.Context, name string, data []byte) error
+	// Get returns the blob named `name`, or `errBlobNotFound`
+	Get(ctx context.Context, name string) ([]byte, error)
+	// Exists checks whether a blob is named `name`
+	Exists(ctx context.Context, name string) (bool, error)
+	// Delete removes the blob named `name`.  Deleting a missing blob is not an error
+	Delete(ctx context.Context, name string) error
+}
+
+// URLSigner is implemented by blob stores that can hand out URLs to blobs which work without credentials until `expiry`
+// has passed
+type URLSigner interface {
+	SignedURL(ctx context.Context, name string, expiry time.Duration) (string, error)
+}
+
+// FSBlobStore is a BlobStore keeping each blob as a file in one directory
+type FSBlobStore struct {
+	dir string
+}
+
+// NewFSBlobStore stores blobs in `dir`, creating it if needed
+func NewFSBlobStore(dir string) (*FSBlobStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &FSBlobStore{dir: dir}, nil
+}
+
+// path is where blob `name` is kept.  Names are never paths, so cannot escape `dir`
+func (s *FSBlobStore) path(name string) string {
+	return filepath.Join(s.dir, filepath.Base(name))
+}
+
+// Put writes `data` to a temporary file and renames it over `name` so readers never see a partial blob
+func (s *FSBlobStore) Put(ctx context.Context, name string, data []byte) error {
+	f, err := ioutil.TempFile(s.dir, ".upload-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path(name))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Get reads blob `name`
+func (s *FSBlobStore) Get(ctx context.Context, name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.path(name))
+	if os.IsNotExist(err) {
+		return nil, errBlobNotFound
+	}
+	return data, err
+}
+
+// Exists checks for blob `name`
+func (s *FSBlobStore) Exists(ctx context.Context, name string) (bool, error) {
+	_, err := os.Stat(s.path(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Delete removes blob `name`
+func (s *FSBlobStore) Delete(ctx context.Context, name string) error {
+	err := os.Remove(s.path(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
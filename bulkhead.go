@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// errBulkheadFull is returned when a request waited its full queue timeout without getting a slot
+var errBulkheadFull = errors.New("too many concurrent requests")
+
+// BulkheadConfig caps how many requests of each operation class may use the database at once.
+// A cap of zero leaves the class unlimited
+type BulkheadConfig struct {
+	Search int
+	Write  int
+	Import int
+	// Login caps registrations and logins, which spend most of their time hashing passwords
+	Login int
+	// QueueTimeout is how long a request waits for a slot before it is shed
+	QueueTimeout time.Duration
+}
+
+// Bulkhead caps the concurrent requests of one operation class so a flood of them cannot starve the others
+type Bulkhead struct {
+	name string
+	// slots holds a value for every request inside the bulkhead.  nil for an unlimited bulkhead
+	slots chan struct{}
+	wait  time.Duration
+}
+
+// newBulkhead returns a bulkhead admitting `size` requests at once, queueing others for up to `wait`
+func newBulkhead(name string, size int, wait time.Duration) *Bulkhead {
+	b := &Bulkhead{name: name, wait: wait}
+	if size > 0 {
+		b.slots = make(chan struct{}, size)
+	}
+	return b
+}
+
+// acquire waits for a slot, returning a function giving it back.  Returns `errBulkheadFull` if none frees up in time,
+// or the error of `ctx` if it ends first
+func (b *Bulkhead) acquire(ctx context.Context) (func(), error) {
+	if b.slots == nil {
+		return func() {}, nil
+	}
+	release := func() { <-b.slots }
+	select {
+	case b.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	t := time.NewTimer(b.wait)
+	defer t.Stop()
+	select {
+	case b.slots <- struct{}{}:
+		return release, nil
+	case <-t.C:
+		return nil, errBulkheadFull
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// retryAfter is the `Retry-After` header sent with shed requests, in whole seconds
+func (b *Bulkhead) retryAfter() string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(b.wait.Seconds()))))
+}
+
+// limit runs `h` inside bulkhead `b`, shedding the request with a 503 and `Retry-After` if it cannot get in
+func limit(b *Bulkhead, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		release, err := b.acquire(r.Context())
+		if err == errBulkheadFull {
+			w.Header().Set("Retry-After", b.retryAfter())
+			writeError("too many concurrent "+b.name+" requests, try again later", 503, w)
+			return
+		} else if err != nil {
+			internalError("waiting for "+b.name+" slot", w, err)
+			return
+		}
+		defer release()
+		h(w, r)
+	}
+}
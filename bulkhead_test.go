@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBulkheadAcquire(t *testing.T) {
+	ctx := context.Background()
+	b := newBulkhead("search", 2, 20*time.Millisecond)
+	first, err := b.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := b.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a full bulkhead sheds requests once they have queued for the timeout
+	start := time.Now()
+	if _, err := b.acquire(ctx); err != errBulkheadFull {
+		t.Errorf("full bulkhead returned %v", err)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("shed after %v, want the queue timeout", waited)
+	}
+
+	// a queued request gets the next free slot
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		first()
+	}()
+	third, err := b.acquire(ctx)
+	if err != nil {
+		t.Fatal("queued request:", err)
+	}
+
+	// or gives up with its context
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := b.acquire(cancelled); err != context.Canceled {
+		t.Errorf("cancelled request returned %v", err)
+	}
+	second()
+	third()
+
+	// a zero cap never waits
+	unlimited := newBulkhead("import", 0, time.Hour)
+	for ii := 0; ii < 100; ii++ {
+		if _, err := unlimited.acquire(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBulkheadRetryAfter(t *testing.T) {
+	for wait, want := range map[time.Duration]string{
+		0:                       "1",
+		10 * time.Millisecond:   "1",
+		2 * time.Second:         "2",
+		2500 * time.Millisecond: "3",
+	} {
+		if got := newBulkhead("write", 1, wait).retryAfter(); got != want {
+			t.Errorf("queue timeout %v: Retry-After %s, want %s", wait, got, want)
+		}
+	}
+}
+
+func TestLimit(t *testing.T) {
+	b := newBulkhead("search", 1, 10*time.Millisecond)
+	h := limit(b, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	serve := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/api/search/article", nil))
+		return w
+	}
+	if w := serve(); w.Code != 200 || w.Body.String() != "ok" {
+		t.Errorf("free bulkhead: got %d %s", w.Code, w.Body.String())
+	}
+
+	release, err := b.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := serve()
+	if w.Code != 503 || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("full bulkhead: got %d with Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if body := w.Body.String(); body != `{"code":503,"message":"too many concurrent search requests, try again later"}` {
+		t.Errorf("full bulkhead: body %s", body)
+	}
+	release()
+	if w := serve(); w.Code != 200 {
+		t.Errorf("released bulkhead: got %d", w.Code)
+	}
+}
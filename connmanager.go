@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+)
+
+// Connection states reported by ConnState.Status
+const (
+	connConnecting = "connecting"
+	connUp         = "up"
+	connDown       = "down"
+)
+
+// Backoff between attempts at the first connection
+const (
+	connectMinBackoff = 500 * time.Millisecond
+	connectMaxBackoff = 30 * time.Second
+)
+
+// PoolConfig sizes a connection pool.  Zero values keep database/sql's defaults
+type PoolConfig struct {
+	// MaxOpen caps open connections, in use or idle.  Zero is unlimited
+	MaxOpen int
+	// MaxIdle caps idle connections kept for reuse
+	MaxIdle int
+	// MaxLifetime closes connections this old, before the server (e.g. MySQL's `wait_timeout`) does
+	MaxLifetime time.Duration
+	// ConnectTimeout is how long to keep retrying the first connection
+	ConnectTimeout time.Duration
+	// CheckPeriod is how often Watch pings the database
+	CheckPeriod time.Duration
+}
+
+// ConnState is a snapshot of a store's connection for health checks
+type ConnState struct {
+	// Which connection this is, if there are several
+	Name string `json:"name,omitempty" example:"replica 1"`
+	// One of "connecting", "up" or "down"
+	Status string `json:"status" example:"up"`
+	// When Status last changed
+	Since time.Time `json:"since"`
+	// When the connection was last checked
+	CheckedAt time.Time `json:"checked_at"`
+	// Error from the last check, if it failed
+	Error              string `json:"error,omitempty"`
+	OpenConnections    int    `json:"open_connections" example:"4"`
+	InUse              int    `json:"in_use" example:"1"`
+	Idle               int    `json:"idle" example:"3"`
+	MaxOpenConnections int    `json:"max_open_connections" example:"25"`
+	// States of the read replicas, if any.  Status only reflects the primary
+	Replicas []ConnState `json:"replicas,omitempty"`
+}
+
+// ConnManager owns a connection pool: it sizes the pool, retries the first connection and watches the connection's health.
+// database/sql replaces broken connections by itself, so the pool is never swapped out from under its users
+type ConnManager struct {
+	db     *sql.DB
+	config PoolConfig
+
+	mu        sync.RWMutex
+	status    string
+	since     time.Time
+	checkedAt time.Time
+	lastErr   error
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+// newConnManager sizes `db` by `config`.  It starts out connecting
+func newConnManager(db *sql.DB, config PoolConfig) *ConnManager {
+	db.SetMaxOpenConns(config.MaxOpen)
+	if config.MaxIdle > 0 {
+		db.SetMaxIdleConns(config.MaxIdle)
+	}
+	db.SetConnMaxLifetime(config.MaxLifetime)
+	return &ConnManager{
+		db:     db,
+		config: config,
+		status: connConnecting,
+		since:  time.Now(),
+		stop:   make(chan struct{}),
+	}
+}
+
+// connect runs `open` until it succeeds, waiting exponentially longer between attempts, and gives up after `ConnectTimeout`.
+// A zero `ConnectTimeout` tries once
+func (m *ConnManager) connect(open func(context.Context) error) error {
+	deadline := time.Now().Add(m.config.ConnectTimeout)
+	ctx := context.Background()
+	if m.config.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	backoff := connectMinBackoff
+	for attempt := 1; ; attempt++ {
+		err := open(ctx)
+		m.record(err)
+		if err == nil {
+			return nil
+		} else if time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		log.Printf("Error connecting to DB (attempt %d): %v.  Retrying in %v", attempt, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > connectMaxBackoff {
+			backoff = connectMaxBackoff
+		}
+	}
+}
+
+// record updates the connection state after a check that returned `err`, logging changes
+func (m *ConnManager) record(err error) {
+	status := connUp
+	if err != nil {
+		status = connDown
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if status != m.status {
+		if m.status == connUp {
+			log.Println("Lost connection to DB:", err)
+		} else if m.status == connDown {
+			log.Println("Reconnected to DB")
+		}
+		m.status, m.since = status, time.Now()
+	}
+	m.checkedAt, m.lastErr = time.Now(), err
+}
+
+// Watch pings the database every `CheckPeriod` until Stop is called.  A zero `CheckPeriod` disables it
+func (m *ConnManager) Watch() {
+	if m.config.CheckPeriod <= 0 {
+		return
+	}
+	t := time.NewTicker(m.config.CheckPeriod)
+	defer t.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-t.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), m.config.CheckPeriod)
+		m.record(m.db.PingContext(ctx))
+		cancel()
+	}
+}
+
+// Stop ends Watch
+func (m *ConnManager) Stop() {
+	m.stopOnce.Do(func() { close(m.stop) })
+}
+
+// up reports whether the last check succeeded
+func (m *ConnManager) up() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.status == connUp
+}
+
+// State returns the connection's current state
+func (m *ConnManager) State() ConnState {
+	stats := m.db.Stats()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s := ConnState{
+		Status:             m.status,
+		Since:              m.since,
+		CheckedAt:          m.checkedAt,
+		OpenConnections:    stats.OpenConnections,
+		InUse:              stats.InUse,
+		Idle:               stats.Idle,
+		MaxOpenConnections: stats.MaxOpenConnections,
+	}
+	if m.lastErr != nil {
+		s.Error = m.lastErr.Error()
+	}
+	return s
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// sqliteManaged opens a SQLite pool in `dir` managed by a ConnManager with `config`, without connecting
+func sqliteManaged(t *testing.T, dir string, config PoolConfig) (*sql.DB, *ConnManager) {
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, newConnManager(db, config)
+}
+
+func TestConnManagerConnect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, m := sqliteManaged(t, dir, PoolConfig{MaxOpen: 3, ConnectTimeout: time.Minute})
+	defer db.Close()
+	if s := m.State(); s.Status != connConnecting || s.MaxOpenConnections != 3 {
+		t.Errorf("new manager is %q with %d connections at most", s.Status, s.MaxOpenConnections)
+	}
+
+	// retried after a backoff until the database answers
+	refused := errors.New("connection refused")
+	attempts := 0
+	start := time.Now()
+	err = m.connect(func(ctx context.Context) error {
+		attempts++
+		if attempts == 1 {
+			return refused
+		}
+		return db.PingContext(ctx)
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf("connected after %d attempts: %v", attempts, err)
+	}
+	if waited := time.Since(start); waited < connectMinBackoff {
+		t.Errorf("retried after %v, want at least %v", waited, connectMinBackoff)
+	}
+	if s := m.State(); s.Status != connUp || len(s.Error) > 0 || !m.up() {
+		t.Errorf("connected manager is %q with error %q", s.Status, s.Error)
+	}
+
+	// without a timeout it tries once
+	onceDB, once := sqliteManaged(t, dir, PoolConfig{})
+	defer onceDB.Close()
+	attempts = 0
+	err = once.connect(func(ctx context.Context) error {
+		attempts++
+		return refused
+	})
+	if err != refused || attempts != 1 {
+		t.Errorf("tried %d times, returning %v", attempts, err)
+	}
+	if s := once.State(); s.Status != connDown || s.Error != refused.Error() || once.up() {
+		t.Errorf("failed manager is %q with error %q", s.Status, s.Error)
+	}
+}
+
+func TestConnManagerWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, m := sqliteManaged(t, dir, PoolConfig{CheckPeriod: 5 * time.Millisecond})
+	m.record(db.Ping())
+	since := m.State().Since
+	watching := make(chan struct{})
+	go func() {
+		defer close(watching)
+		m.Watch()
+	}()
+	// waits up to a second for the manager to be `status`
+	waitFor := func(status string) ConnState {
+		t.Helper()
+		for ii := 0; ii < 200; ii++ {
+			if s := m.State(); s.Status == status {
+				return s
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("manager still %q, want %q", m.State().Status, status)
+		return ConnState{}
+	}
+
+	s := waitFor(connUp)
+	time.Sleep(20 * time.Millisecond)
+	if s = m.State(); !s.Since.Equal(since) || !s.CheckedAt.After(since) {
+		t.Errorf("checks passing moved since from %v to %v, last checked %v", since, s.Since, s.CheckedAt)
+	}
+
+	db.Close()
+	if s = waitFor(connDown); len(s.Error) == 0 || s.Since.Equal(since) {
+		t.Errorf("down manager has error %q since %v", s.Error, s.Since)
+	}
+
+	m.Stop()
+	m.Stop()
+	select {
+	case <-watching:
+	case <-time.After(time.Second):
+		t.Fatal("Watch did not return after Stop")
+	}
+}
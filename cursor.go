@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Page sizes of search endpoints.  Requests without `limit` get `defaultPageSize` results and larger limits are capped at `maxPageSize`
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// searchCursor is the position just past the last result of a page.  Clients only see it as an opaque token
+type searchCursor struct {
+	// Orderby is the `searchOrder` of the search the page came from
+	Orderby string `json:"o"`
+	Reverse bool   `json:"r,omitempty"`
+	// ID and Value are the last result's ID and `Orderby` field.  Value is nil for an ID order or an empty (NULL) description
+	ID    int64   `json:"i,omitempty"`
+	Value *string `json:"v,omitempty"`
+	// Offset is the number of results before the cursor.  Ranked searches resume from it because scores change whenever
+	// articles do, leaving no stable position.  Other searches resume after ID and Value and only report it
+	Offset int `json:"n,omitempty"`
+}
+
+// String encodes the cursor as a URL-safe token
+func (c searchCursor) String() string {
+	b, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+var errInvalidCursor = errors.New("invalid `cursor`")
+
+// parseCursor decodes a token made by searchCursor.String
+func parseCursor(s string) (*searchCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	c := &searchCursor{}
+	err = json.Unmarshal(b, c)
+	if err != nil || c.Offset < 0 {
+		return nil, errInvalidCursor
+	}
+	switch c.Orderby {
+	case "id", "name", "description", "relevance":
+	default:
+		return nil, errInvalidCursor
+	}
+	return c, nil
+}
+
+// searchOrder normalizes `orderby` to the order a search actually uses: one of id, name or description,
+// or relevance for ranked (full-text and `q`) searches without another order
+func searchOrder(orderby string, ranked bool) string {
+	col := findOrderby(orderby)
+	if col == "Relevance" || (ranked && len(orderby) == 0) {
+		if ranked {
+			return "relevance"
+		}
+		col = "ID"
+	}
+	return strings.ToLower(col)
+}
+
+// readLimit reads the `limit` and `offset` URL params, defaulting and capping `limit`
+func readLimit(parts map[string]string) (int, int) {
+	limit, _ := strconv.Atoi(parts["limit"])
+	offset, _ := strconv.Atoi(parts["offset"])
+	if limit <= 0 {
+		limit = defaultPageSize
+	} else if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	return limit, offset
+}
+
+// readPage returns the page size and position requested by `limit`, `offset` and `cursor` for a search ordered by
+// `order` (see searchOrder).  Cursors resume ranked searches at an offset and other searches after a position
+func readPage(parts map[string]string, order string, reverse bool) (int, int, *searchCursor, error) {
+	limit, offset := readLimit(parts)
+	if len(parts["cursor"]) == 0 {
+		return limit, offset, nil, nil
+	}
+
+	if offset > 0 {
+		return 0, 0, nil, errors.New("`cursor` and `offset` cannot be combined")
+	}
+	c, err := parseCursor(parts["cursor"])
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if c.Orderby != order || c.Reverse != reverse {
+		return 0, 0, nil, errors.New("`cursor` was issued for a different `orderby` or `reverse`")
+	}
+	if order == "relevance" {
+		return limit, c.Offset, nil, nil
+	}
+	return limit, 0, c, nil
+}
+
+// nextCursor returns the token continuing a search ordered by `order` after a page of `n` results starting at `offset`
+// whose last result has `id`, `name` and `description`
+func nextCursor(order string, reverse bool, offset, n int, id int64, name, description string) string {
+	c := searchCursor{Orderby: order, Reverse: reverse, Offset: offset + n}
+	switch order {
+	case "relevance":
+		// resumes from Offset
+	case "name":
+		c.ID, c.Value = id, &name
+	case "description":
+		c.ID = id
+		if len(description) > 0 {
+			c.Value = &description
+		}
+	default:
+		c.ID = id
+	}
+	return c.String()
+}
+
+// after returns a condition selecting rows of the table aliased by `prefix` that sort after `c`,
+// appending its parameters to `params`.  It mirrors `orderBy`, including NULLs sorting first
+func (db *DB) after(prefix string, c *searchCursor, params *[]interface{}) string {
+	cmp := " > "
+	if c.Reverse {
+		cmp = " < "
+	}
+	id := prefix + "ID"
+	col := findOrderby(c.Orderby)
+	if col == "ID" || col == "Relevance" {
+		*params = append(*params, c.ID)
+		return id + cmp + "?"
+	}
+
+	col = prefix + col
+	if c.Value == nil {
+		// after a NULL come the remaining NULLs, then every value unless reversed
+		*params = append(*params, c.ID)
+		s := "(" + col + " IS NULL AND " + id + cmp + "?)"
+		if !c.Reverse {
+			s = "(" + s + " OR " + col + " IS NOT NULL)"
+		}
+		return s
+	}
+	*params = append(*params, *c.Value, *c.Value, c.ID)
+	folded, ph := db.foldCase(col), db.foldCase("?")
+	s := "(" + folded + cmp + ph + " OR (" + folded + " = " + ph + " AND " + id + cmp + "?))"
+	if c.Reverse {
+		// NULLs sort last when reversed
+		s = "(" + s + " OR " + col + " IS NULL)"
+	}
+	return s
+}
+
+// afterCursor reports whether a row sorts after `c`.  It is `after` for the in-memory stores, where an empty description is NULL
+func afterCursor(c *searchCursor, id int64, name, description string) bool {
+	v := ""
+	if c.Value != nil {
+		v = *c.Value
+	}
+	if c.Reverse {
+		return lessBy(c.Orderby, id, name, description, c.ID, v, v)
+	}
+	return lessBy(c.Orderby, c.ID, v, v, id, name, description)
+}
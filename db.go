@@ -1,143 +1,493 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+)
+
+const (
+	dialectMySQL    = "mysql"
+	dialectSQLite   = "sqlite3"
+	dialectPostgres = "postgres"
+)
+
+var (
+	// errTagsNotExist is returned when linking an article to a tag name that does not exist
+	errTagsNotExist = errors.New(errNotAllTagsExist)
+	// errTagInTrash is returned when inserting a tag whose name is held by a tag in the trash
+	errTagInTrash = errors.New(errTagNameInTrash)
 )
 
 // DB internal database struct
 type DB struct {
 	*sql.DB
+	// SQL dialect spoken by the underlying connection (`dialectMySQL`, `dialectSQLite` or `dialectPostgres`)
+	dialect string
+	// when set, all queries run inside this transaction.  See WithTx
+	tx *sql.Tx
+	// when set, all queries outside a transaction run on this connection.  See search
+	conn *sql.Conn
+	// MySQL connection ID of `conn`, used to kill its queries
+	connID int64
+	// MySQL connection IDs of the connections search has pinned, shared by every copy of the DB
+	connIDs *connIDCache
+	// small MySQL pool of its own for KILL QUERY, which must not wait behind the queries it kills.  See killQuery
+	killer *sql.DB
+	// queryTimeout bounds each database call.  Zero waits forever
+	queryTimeout time.Duration
+	// conns sizes and watches the pool
+	conns *ConnManager
+	// read-only copies of the database taking searches off the primary.  See read
+	replicas []*replica
+	// round robin position in `replicas`, shared by every copy of the DB
+	nextReplica *uint32
 }
 
-func makeConnStr(uname, password, hostname, dbname string) string {
+// makeConnStr builds a DSN for `dialect` (`dialectMySQL` or `dialectPostgres`)
+func makeConnStr(dialect, uname, password, hostname, dbname string) string {
+	if dialect == dialectPostgres {
+		u := url.URL{
+			Scheme: "postgres",
+			User:   url.UserPassword(uname, password),
+			Host:   hostname,
+			Path:   "/" + dbname,
+		}
+		if sslmode := os.Getenv("POSTGRES_SSLMODE"); len(sslmode) > 0 {
+			u.RawQuery = url.Values{"sslmode": {sslmode}}.Encode()
+		}
+		return u.String()
+	}
 	connStr := fmt.Sprintf("%s:%s@", uname, password)
 	if len(hostname) > 0 {
 		connStr += fmt.Sprintf("tcp(%s)", hostname)
 	}
-	connStr += "/"
+	// scan DATETIME columns into time.Time
+	connStr += "/" + dbname + "?parseTime=true"
 	return connStr
 }
 
-// DBConnect creates connection to database (through hostname if it exists) with credentials
-func DBConnect(uname, password, hostname, dbname string) (*DB, error) {
-	connStr := makeConnStr(uname, password, hostname, dbname)
-	db, err := sql.Open("mysql", connStr)
+// DBConnect creates connection to a `dialect` database (through hostname if it exists) with credentials, sizing its pool by `pool`.
+// The first connection is retried for `pool.ConnectTimeout` in case the database is still starting.
+// MySQL databases are created if missing, Postgres databases must already exist
+func DBConnect(dialect, uname, password, hostname, dbname string, pool PoolConfig) (*DB, error) {
+	// name the database in the DSN rather than `USE` so every pooled connection (and transaction) uses it
+	connStr := makeConnStr(dialect, uname, password, hostname, dbname)
+	db, err := sql.Open(dialect, connStr)
 	if err != nil {
 		return nil, err
 	}
-	err = db.Ping()
+	conns := newConnManager(db, pool)
+	err = conns.connect(func(ctx context.Context) error {
+		if dialect == dialectMySQL {
+			err := mysqlCreateDatabase(ctx, uname, password, hostname, dbname)
+			if err != nil {
+				return err
+			}
+		}
+		return db.PingContext(ctx)
+	})
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
-	// create && use database
-	s := "CREATE DATABASE IF NOT EXISTS " + dbname + ";"
-	_, err = db.Exec(s)
+	d := &DB{DB: db, dialect: dialect, conns: conns}
+	if dialect == dialectMySQL {
+		d.connIDs = &connIDCache{ids: make(map[interface{}]cachedConnID)}
+		d.killer, err = openKiller(connStr)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// mysqlCreateDatabase creates `dbname` if it does not exist yet
+func mysqlCreateDatabase(ctx context.Context, uname, password, hostname, dbname string) error {
+	db, err := sql.Open(dialectMySQL, makeConnStr(dialectMySQL, uname, password, hostname, ""))
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defer db.Close()
+	_, err = db.ExecContext(ctx, "CREATE DATABASE IF NOT EXISTS "+dbname+";")
+	return err
+}
+
+// Close stops watching the connections and closes the pools, including the replicas'
+func (db *DB) Close() error {
+	for _, r := range db.replicas {
+		r.conns.Stop()
+		r.db.Close()
+		if r.killer != nil {
+			r.killer.Close()
+		}
 	}
-	_, err = db.Exec("USE " + dbname + ";")
-	return &DB{db}, err
+	db.conns.Stop()
+	if db.killer != nil {
+		db.killer.Close()
+	}
+	return db.DB.Close()
 }
 
-// DBMaintainConnection checks connection to DB every `period` seconds and attempts to recreate DB on failure
-func DBMaintainConnection(uname, password, hostname, dbname string, period int) {
-	t := time.NewTicker(time.Duration(period) * time.Second)
+// ConnState reports the state of the connection pool and of any replicas
+func (db *DB) ConnState() ConnState {
+	s := db.conns.State()
+	if len(db.replicas) > 0 {
+		s.Replicas = db.replicaStates()
+	}
+	return s
+}
 
-	for {
-		_ = <-t.C
-		_, err := db.Exec("SELECT ID FROM articles LIMIT 0;")
-		if err == nil {
-			continue
+// WithTx runs `fn` with a Store whose queries all run in one transaction, committing if `fn` returns nil and rolling back otherwise.
+// Calling WithTx on a Store already inside a transaction joins that transaction.  The transaction is rolled back if `ctx` ends first
+func (db *DB) WithTx(ctx context.Context, fn func(Store) error) error {
+	return db.withTx(ctx, func(tx *DB) error {
+		return fn(tx)
+	})
+}
+
+// withTx is WithTx for use inside the DB layer
+func (db *DB) withTx(ctx context.Context, fn func(*DB) error) error {
+	if db.tx != nil {
+		return fn(db)
+	}
+	var tx *sql.Tx
+	var err error
+	if db.conn != nil {
+		tx, err = db.conn.BeginTx(ctx, nil)
+	} else {
+		tx, err = db.DB.BeginTx(ctx, nil)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
 		}
-		log.Println("Error pinging DB:", err)
-		newDB, err := DBConnect(uname, password, hostname, dbname)
-		if err != nil {
-			log.Println("Error reconnecting to DB:", err)
-			if newDB != nil {
-				newDB.Close()
-			}
-			continue
+	}()
+	c := *db
+	c.tx = tx
+	err = fn(&c)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+			log.Println("Error rolling back transaction:", rbErr)
 		}
-		log.Println("Successfully reconnected to DB")
-		db.Close()
-		db = newDB
+		return err
 	}
+	return tx.Commit()
 }
 
-// Init things
-func (db *DB) Init() {
-	// make sure `articles` exists
-	fmt.Println("Initializing database...")
-	if !db.tableExists("articles") {
-		fmt.Println("DB creating table `articles`...")
-		_, err := db.Exec("CREATE TABLE articles( ID INT AUTO_INCREMENT, Name VARCHAR(512) NOT NULL, URL VARCHAR(512), Description VARCHAR(1024), PRIMARY KEY (ID) );")
+// pin runs `fn` with a DB whose queries all run on one connection, recording its MySQL connection ID
+func (db *DB) pin(ctx context.Context, fn func(*DB) error) error {
+	conn, err := db.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// the driver's connection outlives `conn`, so identifies it across pins
+	var driverConn interface{}
+	conn.Raw(func(dc interface{}) error {
+		driverConn = dc
+		return nil
+	})
+	id, ok := db.connIDs.get(driverConn)
+	if !ok {
+		err = conn.QueryRowContext(ctx, "SELECT CONNECTION_ID();").Scan(&id)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
+		db.connIDs.put(driverConn, id)
 	}
-	// make sure `tags` exists
-	if !db.tableExists("tags") {
-		fmt.Println("DB creating table `tags`...")
-		_, err := db.Exec("CREATE TABLE tags( ID INT AUTO_INCREMENT, Name VARCHAR(16) UNIQUE, Description VARCHAR(256), PRIMARY KEY (ID, Name) );")
-		if err != nil {
-			log.Fatal(err)
+	c := *db
+	c.conn, c.connID = conn, id
+	return fn(&c)
+}
+
+// connIDCache maps driver connections to their MySQL connection IDs.  The pool closes connections without saying so,
+// so entries are forgotten after `connIDExpiry` rather than kept for connections long gone
+type connIDCache struct {
+	mu  sync.Mutex
+	ids map[interface{}]cachedConnID
+}
+
+type cachedConnID struct {
+	id      int64
+	expires time.Time
+}
+
+// connIDExpiry is how long a connection's ID is cached before it is asked for again
+const connIDExpiry = time.Minute
+
+// get returns the cached ID of driver connection `dc`
+func (c *connIDCache) get(dc interface{}) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.ids[dc]
+	if !ok || time.Now().After(cached.expires) {
+		return 0, false
+	}
+	return cached.id, true
+}
+
+// put caches `id` as the ID of driver connection `dc`, dropping expired entries
+func (c *connIDCache) put(dc interface{}, id int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for key, cached := range c.ids {
+		if now.After(cached.expires) {
+			delete(c.ids, key)
 		}
 	}
-	// make sure `article_to_tag` exists
-	if !db.tableExists("article_to_tag") {
-		fmt.Println("DB creating table `article_to_tag`...")
-		_, err := db.Exec("CREATE TABLE article_to_tag( ArticleID INT, TagID INT, PRIMARY KEY (ArticleID, TagID) );")
-		if err != nil {
-			log.Fatal(err)
+	c.ids[dc] = cachedConnID{id: id, expires: now.Add(connIDExpiry)}
+}
+
+// run runs `fn`, one database call, with `ctx` cut short by the query timeout.  If `ctx` ends first the call's error
+// is `context.DeadlineExceeded` or `context.Canceled`
+func (db *DB) run(ctx context.Context, fn func(context.Context, *DB) error) error {
+	if db.queryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, db.queryTimeout)
+		defer cancel()
+	}
+	return contextError(ctx, fn(ctx, db))
+}
+
+// search is read for searches, which may scan whole tables.  MySQL keeps running queries whose client hung up, so on
+// MySQL `fn` runs on a pinned connection and its query is killed when `ctx` ends
+func (db *DB) search(ctx context.Context, fn func(context.Context, *DB) error) error {
+	return db.read(ctx, func(ctx context.Context, c *DB) error {
+		if c.dialect != dialectMySQL || c.tx != nil || c.conn != nil {
+			return fn(ctx, c)
 		}
+		return c.pin(ctx, func(c *DB) error {
+			done := make(chan struct{})
+			killed := make(chan struct{})
+			go func() {
+				defer close(killed)
+				select {
+				case <-ctx.Done():
+					c.killQuery(c.connID)
+				case <-done:
+				}
+			}()
+			// the connection must not go back to the pool while it may still be killed
+			defer func() {
+				close(done)
+				<-killed
+			}()
+			return contextError(ctx, fn(ctx, c))
+		})
+	})
+}
+
+// openKiller opens the pool killQuery uses for the MySQL database at `dsn`.  It does not connect until a query is killed
+func openKiller(dsn string) (*sql.DB, error) {
+	killer, err := sql.Open(dialectMySQL, dsn)
+	if err != nil {
+		return nil, err
 	}
-	// // make sure `users` exists
-	// if !db.tableExists("users") {
-	// 	fmt.Println("DB creating table `users`...")
-	// 	_, err := db.Exec("CREATE TABLE users( ID INT AUTO_INCREMENT, Name VARCHAR(64) UNIQUE, Password VARCHAR(256), PRIMARY KEY (ID) );")
-	// 	if err != nil {
-	// 		log.Fatal(err)
-	// 	}
-	// }
+	killer.SetMaxOpenConns(killerConns)
+	killer.SetMaxIdleConns(1)
+	return killer, nil
 }
 
-func (db *DB) populate() {
-	db.Exec(`INSERT INTO articles (URL) VALUES ("google.com/");`)
-	db.Exec(`INSERT INTO tags (Name, Description) VALUES ("google", "it's google my duderino");`)
-	db.Exec(`INSERT INTO tags (Name) VALUES ("search_engine");`)
-	db.Exec(`INSERT INTO tags (Name) VALUES ("frogs");`)
-	db.Exec(`INSERT INTO article_to_tag (ArticleID, TagID) VALUES (1,1);`)
-	db.Exec(`INSERT INTO article_to_tag (ArticleID, TagID) VALUES (1,2);`)
+// killerConns caps the connections killing queries may use
+const killerConns = 2
+
+// killQuery stops whatever MySQL connection `id` is running, leaving the connection open
+func (db *DB) killQuery(id int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), killTimeout)
+	defer cancel()
+	_, err := db.killer.ExecContext(ctx, "KILL QUERY "+strconv.FormatInt(id, 10)+";")
+	if err != nil {
+		log.Println("Error killing query on connection", id, ":", err)
+	}
 }
 
-// TagNameExists checks if a tag named `s` exists in a database, returning the tag ID && true/false
-func (db *DB) TagNameExists(s string) (int64, bool) {
-	rows, err := db.Query("SELECT ID FROM tags WHERE Name=? LIMIT 1;", s)
+// killTimeout bounds how long killQuery waits for a free connection
+const killTimeout = 5 * time.Second
+
+// contextError returns the error of `ctx` in place of `err` once `ctx` has ended, since drivers report aborted
+// queries in their own ways
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Query executes a query written with `?` placeholders, rewriting them for the connection's dialect
+func (db *DB) Query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	switch {
+	case db.tx != nil:
+		return db.tx.QueryContext(ctx, db.rebind(query), args...)
+	case db.conn != nil:
+		return db.conn.QueryContext(ctx, db.rebind(query), args...)
+	}
+	return db.DB.QueryContext(ctx, db.rebind(query), args...)
+}
+
+// QueryRow is Query for at most one row
+func (db *DB) QueryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	switch {
+	case db.tx != nil:
+		return db.tx.QueryRowContext(ctx, db.rebind(query), args...)
+	case db.conn != nil:
+		return db.conn.QueryRowContext(ctx, db.rebind(query), args...)
+	}
+	return db.DB.QueryRowContext(ctx, db.rebind(query), args...)
+}
+
+// Exec executes a statement written with `?` placeholders, rewriting them for the connection's dialect
+func (db *DB) Exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	switch {
+	case db.tx != nil:
+		return db.tx.ExecContext(ctx, db.rebind(query), args...)
+	case db.conn != nil:
+		return db.conn.ExecContext(ctx, db.rebind(query), args...)
+	}
+	return db.DB.ExecContext(ctx, db.rebind(query), args...)
+}
+
+// exec is Exec as one database call.  See run
+func (db *DB) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	var res sql.Result
+	err := db.run(ctx, func(ctx context.Context, c *DB) error {
+		var err error
+		res, err = c.Exec(ctx, query, args...)
+		return err
+	})
+	return res, err
+}
+
+// rebind replaces `?` placeholders outside of string literals with `$1`, `$2`... for Postgres
+func (db *DB) rebind(query string) string {
+	if db.dialect != dialectPostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	quoted := false
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// insertID runs an INSERT into a table with an auto incrementing `ID`, returning the new row's ID
+func (db *DB) insertID(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	if db.dialect == dialectPostgres {
+		// lib/pq does not support LastInsertId
+		var id int64
+		err := db.QueryRow(ctx, strings.TrimSuffix(query, ";")+" RETURNING ID;", args...).Scan(&id)
+		return id, err
+	}
+	res, err := db.Exec(ctx, query, args...)
 	if err != nil {
-		return 0, false
+		return 0, err
 	}
-	exists := rows.Next()
-	var id int64
-	id = 0
-	if exists {
-		rows.Scan(&id)
+	return res.LastInsertId()
+}
+
+// Init migrates the database to the latest known schema, refusing to continue if it is newer than that
+func (db *DB) Init() {
+	fmt.Println("Initializing database...")
+	err := db.Migrate(LatestSchemaVersion())
+	if errors.Is(err, errSchemaTooNew) {
+		log.Fatal("Refusing to serve: ", err)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// likeContains returns a condition matching rows whose `col` contains the next placeholder
+func (db *DB) likeContains(col string) string {
+	switch db.dialect {
+	case dialectSQLite:
+		// SQLite has no CONCAT and no default LIKE escape character
+		return col + " LIKE '%' || ? || '%' ESCAPE '\\'"
+	case dialectPostgres:
+		// ILIKE to match MySQL's case-insensitive collation.  CONCAT cannot infer the placeholder's type
+		return col + " ILIKE '%' || CAST(? AS TEXT) || '%'"
+	default:
+		return col + " LIKE CONCAT('%',?,'%')"
+	}
+}
+
+// foldCase wraps `expr` so comparisons and ordering ignore case on Postgres, whose collations are case-sensitive
+func (db *DB) foldCase(expr string) string {
+	if db.dialect == dialectPostgres {
+		return "LOWER(" + expr + ")"
 	}
-	rows.Close()
+	return expr
+}
+
+// forUpdate locks the rows a SELECT in a transaction reads until it ends.  SQLite has no row locks, and needs none as
+// its transactions take the write lock up front
+func (db *DB) forUpdate() string {
+	if db.dialect == dialectSQLite {
+		return ""
+	}
+	return " FOR UPDATE"
+}
+
+func (db *DB) populate() {
+	ctx := context.Background()
+	db.Exec(ctx, `INSERT INTO articles (URL) VALUES ("google.com/");`)
+	db.Exec(ctx, `INSERT INTO tags (Name, Description) VALUES ("google", "it's google my duderino");`)
+	db.Exec(ctx, `INSERT INTO tags (Name) VALUES ("search_engine");`)
+	db.Exec(ctx, `INSERT INTO tags (Name) VALUES ("frogs");`)
+	db.Exec(ctx, `INSERT INTO article_to_tag (ArticleID, TagID) VALUES (1,1);`)
+	db.Exec(ctx, `INSERT INTO article_to_tag (ArticleID, TagID) VALUES (1,2);`)
+}
+
+// TagNameExists checks if a tag named `s` exists in a database and is not in the trash, returning the tag ID && true/false
+func (db *DB) TagNameExists(ctx context.Context, s string) (int64, bool) {
+	var id int64
+	exists := false
+	db.run(ctx, func(ctx context.Context, c *DB) error {
+		rows, err := c.Query(ctx, "SELECT ID FROM tags WHERE "+c.foldCase("Name")+"="+c.foldCase("?")+" AND DeletedAt IS NULL LIMIT 1;", s)
+		if err != nil {
+			return err
+		}
+		exists = rows.Next()
+		if exists {
+			rows.Scan(&id)
+		}
+		rows.Close()
+		return nil
+	})
 	return id, exists
 }
 
 // TagNamesExist is TagNameExists in a loop
-func (db *DB) TagNamesExist(s ...string) ([]int64, bool) {
+func (db *DB) TagNamesExist(ctx context.Context, s ...string) ([]int64, bool) {
 	res := []int64{}
 	for _, t := range s {
-		id, exists := db.TagNameExists(t)
+		id, exists := db.TagNameExists(ctx, t)
 		if !exists {
 			return []int64{}, false
 		}
@@ -153,6 +503,14 @@ func stringOrNil(i string) interface{} {
 	return nil
 }
 
+// idOrNil returns `id`, or nil for NULL if it is 0
+func idOrNil(id int64) interface{} {
+	if id != 0 {
+		return id
+	}
+	return nil
+}
+
 func nullStringToString(s sql.NullString) string {
 	if s.Valid {
 		return s.String
@@ -160,37 +518,130 @@ func nullStringToString(s sql.NullString) string {
 	return ""
 }
 
-// ArticleTags finds all tags associated with an article ID
-func (db *DB) ArticleTags(id int64) ([]DBTag, error) {
-	s := "SELECT t.*" +
+// ArticleTags finds all tags associated with an article ID, except those in the trash
+func (db *DB) ArticleTags(ctx context.Context, id int64) ([]DBTag, error) {
+	s := "SELECT t.ID, t.Name, t.Description" +
 		" FROM tags t INNER JOIN article_to_tag at ON t.ID = at.TagID" +
 		" WHERE at.ArticleID = ?" +
-		" AND at.TagID = t.ID;"
-	rows, err := db.Query(s, id)
+		" AND at.TagID = t.ID AND t.DeletedAt IS NULL;"
+	var tags []DBTag
+	err := db.read(ctx, func(ctx context.Context, c *DB) error {
+		rows, err := c.Query(ctx, s, id)
+		if err != nil {
+			return err
+		}
+		tags = UnmarshalTags(rows)
+		rows.Close()
+		return rows.Err()
+	})
 	if err != nil {
 		return []DBTag{}, err
 	}
-
-	tags := UnmarshalTags(rows)
-	rows.Close()
 	return tags, nil
 }
 
-// PopulateArticleTags adds tags to existing article struct based on article.ID
-func (db *DB) PopulateArticleTags(article DBArticle) DBArticle {
-	tags, err := db.ArticleTags(article.ID)
+// tagBatchSize caps the article IDs per query in PopulateArticlesTags, keeping well under placeholder limits
+const tagBatchSize = 500
+
+// PopulateArticlesTags fills in the tags and images of every article in `articles` with two queries per `tagBatchSize`
+// articles.  Tags in the trash are left out
+func (db *DB) PopulateArticlesTags(ctx context.Context, articles []DBArticle) error {
+	for start := 0; start < len(articles); start += tagBatchSize {
+		end := start + tagBatchSize
+		if end > len(articles) {
+			end = len(articles)
+		}
+		err := db.run(ctx, func(ctx context.Context, c *DB) error {
+			err := c.populateArticlesTags(ctx, articles[start:end])
+			if err != nil {
+				return err
+			}
+			return c.populateArticlesImages(ctx, articles[start:end])
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// populateArticlesTags fills in the tag names of up to `tagBatchSize` articles in one query, leaving out tags in the trash
+func (db *DB) populateArticlesTags(ctx context.Context, articles []DBArticle) error {
+	s := "SELECT at.ArticleID, t.Name" +
+		" FROM tags t INNER JOIN article_to_tag at ON t.ID = at.TagID" +
+		" WHERE at.ArticleID IN (%s) AND t.DeletedAt IS NULL" +
+		" ORDER BY at.ArticleID, t.ID;"
+	return db.populateArticles(ctx, articles, s, func(a *DBArticle, name string) {
+		a.Tags = append(a.Tags, name)
+	})
+}
+
+// populateArticlesImages fills in the image filenames of up to `tagBatchSize` articles in one query
+func (db *DB) populateArticlesImages(ctx context.Context, articles []DBArticle) error {
+	s := "SELECT ArticleID, Filename FROM article_images" +
+		" WHERE ArticleID IN (%s)" +
+		" ORDER BY ArticleID, Position;"
+	return db.populateArticles(ctx, articles, s, func(a *DBArticle, filename string) {
+		a.Images = append(a.Images, filename)
+	})
+}
+
+// populateArticles runs query `s`, whose `%s` is replaced by a placeholder for each ID in `articles`, and passes the
+// string of every (article ID, string) row it returns to `add` with each article having that ID
+func (db *DB) populateArticles(ctx context.Context, articles []DBArticle, s string, add func(*DBArticle, string)) error {
+	if len(articles) == 0 {
+		return nil
+	}
+	byID := make(map[int64][]int)
+	params := make([]interface{}, 0, len(articles))
+	for ii, a := range articles {
+		if _, ok := byID[a.ID]; !ok {
+			params = append(params, a.ID)
+		}
+		byID[a.ID] = append(byID[a.ID], ii)
+	}
+	rows, err := db.Query(ctx, fmt.Sprintf(s, "?"+strings.Repeat(",?", len(params)-1)), params...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var value string
+		err = rows.Scan(&id, &value)
+		if err != nil {
+			return err
+		}
+		for _, ii := range byID[id] {
+			add(&articles[ii], value)
+		}
+	}
+	return rows.Err()
+}
+
+// insertArticleImages links stored `images` to article `id` in order, registering those not yet registered
+func (db *DB) insertArticleImages(ctx context.Context, id int64, images []Image) error {
+	if len(images) < 1 {
+		return nil
+	}
+	err := db.registerImages(ctx, images)
 	if err != nil {
-		return article
+		return err
 	}
-	for _, t := range tags {
-		article.Tags = append(article.Tags, t.Name)
+	s := "INSERT INTO article_images (ArticleID,Position,Filename) VALUES (?,?,?)" +
+		strings.Repeat(",(?,?,?)", len(images)-1) + ";"
+	var params []interface{}
+	for ii, img := range images {
+		params = append(params, id, ii, img.Filename)
 	}
-	return article
+	_, err = db.Exec(ctx, s, params...)
+	return err
 }
 
-// UnmarshalArticles takes sql.Rows from the `article` table and parses it into an array of DBArticle structs
-// NOTE: does NOT populate `tags` field.  To populate tags call `db.PopulateArticleTags()`
-func UnmarshalArticles(rows *sql.Rows) []DBArticle {
+// UnmarshalArticles takes sql.Rows from the `article` table and parses it into an array of DBArticle structs.
+// Any columns after the article's are scanned into `extra`, row after row
+// NOTE: does NOT populate `tags` field.  To populate tags call `db.PopulateArticlesTags()`
+func UnmarshalArticles(rows *sql.Rows, extra ...interface{}) []DBArticle {
 	articles := []DBArticle{}
 	if rows == nil {
 		return articles
@@ -201,7 +652,7 @@ func UnmarshalArticles(rows *sql.Rows) []DBArticle {
 		var url sql.NullString
 		var desc sql.NullString
 
-		err := rows.Scan(&id, &name, &url, &desc)
+		err := rows.Scan(append([]interface{}{&id, &name, &url, &desc}, extra...)...)
 		if err != nil {
 			log.Println("Error unmarshalling article:", err)
 		}
@@ -215,8 +666,9 @@ func UnmarshalArticles(rows *sql.Rows) []DBArticle {
 	return articles
 }
 
-// UnmarshalTags takes sql.Rows from the `tags` table and parses it into an array of DBTag structs
-func UnmarshalTags(rows *sql.Rows) []DBTag {
+// UnmarshalTags takes sql.Rows from the `tags` table and parses it into an array of DBTag structs.
+// Any columns after the tag's are scanned into `extra`, row after row
+func UnmarshalTags(rows *sql.Rows, extra ...interface{}) []DBTag {
 	tags := []DBTag{}
 	if rows == nil {
 		return tags
@@ -226,7 +678,7 @@ func UnmarshalTags(rows *sql.Rows) []DBTag {
 		name := ""
 		var description sql.NullString
 
-		err := rows.Scan(&id, &name, &description)
+		err := rows.Scan(append([]interface{}{&id, &name, &description}, extra...)...)
 		if err != nil {
 			log.Println("Error unmarshalling article:", err)
 		}
@@ -247,128 +699,223 @@ func findOrderby(s string) string {
 		return "Description"
 	case "id":
 		return "ID"
+	case "relevance":
+		return "Relevance"
 	default:
 		return "ID"
 	}
 }
 
-// ArticlesWithTagsSearch returns `limit` articles whose tags match all supplied tags, offset by `offset`, whose names OR description match `lookslike`
-func (db *DB) ArticlesWithTagsSearch(tags []string, lookslike, orderby string, reverse bool, limit, offset int) ([]DBArticle, error) {
+// placeholders returns `n` comma separated placeholders for an IN list of tag names
+func (db *DB) placeholders(n int) string {
+	ph := db.foldCase("?")
+	return ph + strings.Repeat(","+ph, n-1)
+}
+
+// orderBy returns an ORDER BY clause for the `findOrderby` column of the table aliased by `prefix`, then ID so
+// the order is total.  Text sorts case-insensitively with NULLs first like MySQL
+func (db *DB) orderBy(prefix, orderby string, reverse bool) string {
+	col := findOrderby(orderby)
+	dir := " ASC"
+	if reverse {
+		dir = " DESC"
+	}
+	if col == "ID" || col == "Relevance" {
+		// only full-text searches have a relevance
+		return " ORDER BY " + prefix + "ID" + dir
+	}
+	s := " ORDER BY " + db.foldCase(prefix+col) + dir
+	if db.dialect == dialectPostgres {
+		if reverse {
+			s += " NULLS LAST"
+		} else {
+			s += " NULLS FIRST"
+		}
+	}
+	return s + ", " + prefix + "ID" + dir
+}
+
+// ArticlesWithTagsSearch returns `limit` articles whose tags match all supplied tags and `tq` if it is not nil, offset by `offset`, whose names OR description match `lookslike`.
+// Results start after `after` if it is not nil.  If `withTotal` is set the total counts every match, ignoring `after`,
+// `limit` and `offset`, otherwise it is 0
+func (db *DB) ArticlesWithTagsSearch(ctx context.Context, tags []string, tq tagQuery, lookslike, orderby string, reverse bool, after *searchCursor, limit, offset int, withTotal bool) ([]DBArticle, int, error) {
+	return db.articleSearch(ctx, tags, tq, nil, lookslike, orderby, reverse, after, limit, offset, withTotal)
+}
+
+// articleSearch is ArticlesWithTagsSearch, additionally matching the full-text query `ft` if it is not nil
+func (db *DB) articleSearch(ctx context.Context, tags []string, tq tagQuery, ft *fullTextQuery, lookslike, orderby string, reverse bool, after *searchCursor, limit, offset int, withTotal bool) ([]DBArticle, int, error) {
 	var itags []interface{}
-	s := "SELECT a.*"
+	s := "SELECT a.ID, a.Name, a.URL, a.Description"
 
+	if len(tags) > 0 {
+		s += " FROM article_to_tag at INNER JOIN tags t ON at.TagID = t.ID INNER JOIN articles a ON at.ArticleID = a.ID"
+	} else {
+		s += " FROM articles a"
+	}
+	if ft != nil {
+		src, params := db.fullTextSource(*ft)
+		itags = append(itags, params...)
+		s += " INNER JOIN (" + src + ") ft ON ft.ID = a.ID"
+	}
 	if len(tags) > 0 {
 		for _, t := range tags {
 			itags = append(itags, t)
 		}
-		s += " FROM article_to_tag at INNER JOIN tags t ON at.TagID = t.ID INNER JOIN articles a ON at.ArticleID = a.ID" +
-			" WHERE t.Name IN (?" + strings.Repeat(",?", len(tags)-1) + ")"
+		s += " WHERE " + db.foldCase("t.Name") + " IN (" + db.placeholders(len(tags)) + ") AND t.DeletedAt IS NULL"
 	} else {
-		s += " FROM articles a WHERE TRUE"
+		s += " WHERE TRUE"
+	}
+	s += " AND a.DeletedAt IS NULL"
+	if tq != nil {
+		s += " AND " + tq.sql(db, &itags)
 	}
 	if len(lookslike) > 0 {
 		itags = append(itags, lookslike, lookslike)
-		s += " AND (a.Name LIKE CONCAT('%',?,'%') OR a.Description LIKE CONCAT('%',?,'%'))"
+		s += " AND (" + db.likeContains("a.Name") + " OR " + db.likeContains("a.Description") + ")"
+	}
+	group := " GROUP BY a.ID"
+	if ft != nil {
+		group += ", ft.Relevance"
 	}
-	s += " GROUP BY a.ID"
 	if len(tags) > 0 {
-		s += " HAVING COUNT(a.ID)=" + strconv.Itoa(len(tags))
+		group += " HAVING COUNT(a.ID)=" + strconv.Itoa(len(tags))
+	}
+	// the total counts every match, not just those after the cursor
+	filtered, filterParams := s+group, append([]interface{}{}, itags...)
+	if after != nil {
+		s += " AND " + db.after("a.", after, &itags)
 	}
-	if len(orderby) > 0 || reverse {
-		s += " ORDER BY a." + findOrderby(orderby)
+	s += group
+	if ft != nil && (len(orderby) == 0 || findOrderby(orderby) == "Relevance") {
+		// most relevant first unless reversed
 		if reverse {
-			s += " DESC"
+			s += " ORDER BY ft.Relevance ASC, a.ID ASC"
 		} else {
-			s += " ASC"
-		}
-	}
-	if limit > 0 {
-		itags = append(itags, limit)
-		s += " LIMIT ?"
-		if offset > 0 {
-			itags = append(itags, offset)
-			s += " OFFSET ?"
+			s += " ORDER BY ft.Relevance DESC, a.ID ASC"
 		}
+	} else {
+		s += db.orderBy("a.", orderby, reverse)
 	}
+	s += db.limit(limit, offset, &itags)
 	s += ";"
 
-	rows, err := db.Query(s, itags...)
+	var articles []DBArticle
+	total := 0
+	err := db.search(ctx, func(ctx context.Context, c *DB) error {
+		rows, err := c.Query(ctx, s, itags...)
+		if err != nil {
+			return err
+		}
+		articles = UnmarshalArticles(rows)
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		if withTotal {
+			total, err = c.count(ctx, filtered, filterParams)
+			if err != nil {
+				return err
+			}
+		}
+		return c.PopulateArticlesTags(ctx, articles)
+	})
 	if err != nil {
-		return []DBArticle{}, err
+		return []DBArticle{}, 0, err
 	}
 
-	articles := UnmarshalArticles(rows)
-	rows.Close()
+	return articles, total, nil
+}
 
-	for ii := range articles {
-		articles[ii] = db.PopulateArticleTags(articles[ii])
+// limit returns a LIMIT/OFFSET clause, appending its parameters to `params`.  `offset` does nothing unless `limit` is specified
+func (db *DB) limit(limit, offset int, params *[]interface{}) string {
+	if limit <= 0 {
+		return ""
 	}
+	*params = append(*params, limit)
+	if offset <= 0 {
+		return " LIMIT ?"
+	}
+	*params = append(*params, offset)
+	return " LIMIT ? OFFSET ?"
+}
 
-	return articles, nil
+// count returns the number of rows returned by query `s`
+func (db *DB) count(ctx context.Context, s string, params []interface{}) (int, error) {
+	n := 0
+	err := db.QueryRow(ctx, "SELECT COUNT(*) FROM ("+s+") c;", params...).Scan(&n)
+	return n, err
 }
 
-// TagSearch returns `limit` tags whose names are in `tags`, offset by `offset`, whose names match `lookslike`
-// TagSearch returns a list of DBTag structs given an array of tag names
-func (db *DB) TagSearch(tags []string, lookslike, orderby string, reverse bool, limit int, offset int) ([]DBTag, error) {
-	s := "SELECT * FROM tags WHERE"
+// TagSearch returns `limit` tags whose names are in `tags`, offset by `offset`, whose names match `lookslike`, and how many
+// match in all if `withTotal` is set
+func (db *DB) TagSearch(ctx context.Context, tags []string, lookslike, orderby string, reverse bool, after *searchCursor, limit int, offset int, withTotal bool) ([]DBTag, int, error) {
+	s := "SELECT ID, Name, Description FROM tags WHERE DeletedAt IS NULL AND"
 
 	var itags []interface{}
 	if len(tags) > 0 {
 		for _, t := range tags {
 			itags = append(itags, t)
 		}
-		s += " Name IN (?" + strings.Repeat(",?", len(tags)-1) + ")"
+		s += " " + db.foldCase("Name") + " IN (" + db.placeholders(len(tags)) + ")"
 	} else {
 		s += " TRUE"
 	}
 	if len(lookslike) > 0 {
 		itags = append(itags, lookslike, lookslike)
-		s += " AND (Name LIKE CONCAT('%',?,'%') OR Description LIKE CONCAT('%',?,'%'))"
-	}
-	s += " GROUP BY ID"
-	if len(orderby) > 0 || reverse {
-		s += " ORDER BY " + findOrderby(orderby)
-		if reverse {
-			s += " DESC"
-		} else {
-			s += " ASC"
-		}
+		s += " AND (" + db.likeContains("Name") + " OR " + db.likeContains("Description") + ")"
 	}
-	if limit > 0 {
-		itags = append(itags, limit)
-		s += " LIMIT ?"
-		if offset > 0 {
-			itags = append(itags, offset)
-			s += " OFFSET ?"
-		}
+	filtered, filterParams := s, append([]interface{}{}, itags...)
+	if after != nil {
+		s += " AND " + db.after("", after, &itags)
 	}
+	s += db.orderBy("", orderby, reverse)
+	s += db.limit(limit, offset, &itags)
 	s += ";"
 
-	rows, err := db.Query(s, itags...)
+	var rtags []DBTag
+	total := 0
+	err := db.search(ctx, func(ctx context.Context, c *DB) error {
+		rows, err := c.Query(ctx, s, itags...)
+		if err != nil {
+			return err
+		}
+		rtags = UnmarshalTags(rows)
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		if withTotal {
+			total, err = c.count(ctx, filtered, filterParams)
+		}
+		return err
+	})
 	if err != nil {
-		return []DBTag{}, err
+		return []DBTag{}, 0, err
 	}
 
-	rtags := UnmarshalTags(rows)
-	rows.Close()
-
-	return rtags, nil
+	return rtags, total, nil
 }
 
-// ArticleByID searches for an articles with an ID, returning `nil` if not found
-func (db *DB) ArticleByID(id int64) (*DBArticle, error) {
+// ArticleByID searches for an articles with an ID, returning `nil` if not found or in the trash
+func (db *DB) ArticleByID(ctx context.Context, id int64) (*DBArticle, error) {
 	// TODO: make this return single article
-	s := "SELECT * FROM articles WHERE ID=?;"
-	rows, err := db.Query(s, id)
+	s := "SELECT ID, Name, URL, Description FROM articles WHERE ID=? AND DeletedAt IS NULL;"
+	var articles []DBArticle
+	err := db.read(ctx, func(ctx context.Context, c *DB) error {
+		rows, err := c.Query(ctx, s, id)
+		if err != nil {
+			return err
+		}
+		articles = UnmarshalArticles(rows)
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		return c.PopulateArticlesTags(ctx, articles)
+	})
 	if err != nil {
 		return nil, err
 	}
-	articles := UnmarshalArticles(rows)
-	rows.Close()
-
-	for ii := range articles {
-		articles[ii] = db.PopulateArticleTags(articles[ii])
-	}
 
 	if len(articles) >= 1 {
 		return &articles[0], nil
@@ -376,16 +923,23 @@ func (db *DB) ArticleByID(id int64) (*DBArticle, error) {
 	return nil, nil
 }
 
-// TagByID searches for all tags with an ID, returning `nil` if not found
-func (db *DB) TagByID(id int64) (*DBTag, error) {
+// TagByID searches for all tags with an ID, returning `nil` if not found or in the trash
+func (db *DB) TagByID(ctx context.Context, id int64) (*DBTag, error) {
 	// TODO: make this return single tag
-	s := "SELECT * FROM tags WHERE ID=?;"
-	rows, err := db.Query(s, id)
+	s := "SELECT ID, Name, Description FROM tags WHERE ID=? AND DeletedAt IS NULL;"
+	var tags []DBTag
+	err := db.read(ctx, func(ctx context.Context, c *DB) error {
+		rows, err := c.Query(ctx, s, id)
+		if err != nil {
+			return err
+		}
+		tags = UnmarshalTags(rows)
+		rows.Close()
+		return rows.Err()
+	})
 	if err != nil {
 		return nil, err
 	}
-	tags := UnmarshalTags(rows)
-	rows.Close()
 
 	if len(tags) >= 1 {
 		return &tags[0], nil
@@ -394,11 +948,15 @@ func (db *DB) TagByID(id int64) (*DBTag, error) {
 }
 
 // InsertArticleTag links an article to a tag, returning ID of inserted element
-func (db *DB) InsertArticleTag(articleID int64, tagID int64) (int64, error) {
-	res, err := db.Exec("INSERT INTO article_to_tag (ArticleID, TagID) VALUES (?, ?);", articleID, tagID)
+func (db *DB) InsertArticleTag(ctx context.Context, articleID int64, tagID int64) (int64, error) {
+	res, err := db.exec(ctx, "INSERT INTO article_to_tag (ArticleID, TagID) VALUES (?, ?);", articleID, tagID)
 	if err != nil {
 		return 0, err
 	}
+	if db.dialect == dialectPostgres {
+		// no auto increment column to report
+		return 0, nil
+	}
 	id, err := res.LastInsertId()
 	if err != nil {
 		return 0, err
@@ -407,7 +965,7 @@ func (db *DB) InsertArticleTag(articleID int64, tagID int64) (int64, error) {
 }
 
 // InsertArticleTags updates an article's tags
-func (db *DB) InsertArticleTags(id int64, tagIDs []int64) error {
+func (db *DB) InsertArticleTags(ctx context.Context, id int64, tagIDs []int64) error {
 	if len(tagIDs) < 1 {
 		return nil
 	}
@@ -417,147 +975,226 @@ func (db *DB) InsertArticleTags(id int64, tagIDs []int64) error {
 	for _, tagID := range tagIDs {
 		params = append(params, id, tagID)
 	}
-	_, err := db.Exec(s, params...)
+	_, err := db.exec(ctx, s, params...)
 	return err
 }
 
-// InsertArticle inserts an article into a DB, linking tags if they exist and returning the article's ID, returning ID of inserted element
-func (db *DB) InsertArticle(a UploadArticle) (int64, error) {
-	res, err := db.Exec("INSERT INTO articles (Name, URL, Description) VALUES (?, ?, ?);", stringOrNil(a.Name), stringOrNil(a.URL), stringOrNil(a.Description))
-
+// InsertArticle inserts an article into a DB, linking its tags and stored images and returning the article's ID.
+// Returns `errTagsNotExist` without inserting anything if any tag does not exist
+func (db *DB) InsertArticle(ctx context.Context, a UploadArticle) (int64, error) {
+	var id int64
+	err := db.run(ctx, func(ctx context.Context, c *DB) error {
+		return c.withTx(ctx, func(tx *DB) error {
+			tagIDs, ok := tx.TagNamesExist(ctx, a.Tags...)
+			if !ok {
+				if ctx.Err() != nil {
+					// the lookup was cut short, not refused
+					return ctx.Err()
+				}
+				return errTagsNotExist
+			}
+			var err error
+			id, err = tx.insertID(ctx, "INSERT INTO articles (Name, URL, Description) VALUES (?, ?, ?);", stringOrNil(a.Name), stringOrNil(a.URL), stringOrNil(a.Description))
+			if err != nil {
+				return err
+			}
+			err = tx.InsertArticleTags(ctx, id, uniqueIDs(tagIDs))
+			if err != nil {
+				return err
+			}
+			return tx.insertArticleImages(ctx, id, a.Images)
+		})
+	})
 	if err != nil {
 		return 0, err
 	}
+	return id, nil
+}
 
-	id, err := res.LastInsertId()
-	if err != nil {
-		return id, err
-	}
-	for _, t := range a.Tags {
-		if tagID, ok := db.TagNameExists(t); ok {
-			db.InsertArticleTag(id, tagID)
+// InsertTag inserts a tag into a DB, returning ID of inserted element.
+// Returns `errTagInTrash` if a tag in the trash has the same name
+func (db *DB) InsertTag(ctx context.Context, t UploadTag) (int64, error) {
+	var id int64
+	err := db.run(ctx, func(ctx context.Context, c *DB) error {
+		trashed := 0
+		err := c.QueryRow(ctx, "SELECT COUNT(*) FROM tags WHERE "+c.foldCase("Name")+"="+c.foldCase("?")+" AND DeletedAt IS NOT NULL;", t.Name).Scan(&trashed)
+		if err != nil {
+			return err
+		} else if trashed > 0 {
+			return errTagInTrash
 		}
-	}
-	return id, nil
+		id, err = c.insertID(ctx, "INSERT INTO tags (Name, Description) VALUES (?, ?);", stringOrNil(t.Name), stringOrNil(t.Description))
+		return err
+	})
+	return id, err
+}
+
+// RemoveArticleTags removes all article-tag links by articleID, except links to tags in the trash which are kept for
+// when the tag is restored
+func (db *DB) RemoveArticleTags(ctx context.Context, articleID int64) error {
+	s := "DELETE FROM article_to_tag WHERE ArticleID=? AND TagID IN (SELECT ID FROM tags WHERE DeletedAt IS NULL);"
+	_, err := db.exec(ctx, s, articleID)
+	return err
+}
+
+// RemoveTagsFromArticles removes all article-tag links by tagID.  Not needed before RemoveTag, which keeps them for RestoreTag
+func (db *DB) RemoveTagsFromArticles(ctx context.Context, tagID int64) error {
+	s := "DELETE FROM article_to_tag WHERE TagID=?;"
+	_, err := db.exec(ctx, s, tagID)
+	return err
+}
+
+// RemoveArticle moves an article to the trash.  Its article-tag links are kept until it is purged
+func (db *DB) RemoveArticle(ctx context.Context, id int64) error {
+	s := "UPDATE articles SET DeletedAt=? WHERE ID=? AND DeletedAt IS NULL;"
+	_, err := db.exec(ctx, s, time.Now().UTC(), id)
+	return err
 }
 
-// InsertTag inserts a tag into a DB, returning ID of inserted element
-func (db *DB) InsertTag(t UploadTag) (int64, error) {
-	res, err := db.Exec("INSERT INTO tags (Name, Description) VALUES (?, ?);", stringOrNil(t.Name), stringOrNil(t.Description))
+// RemoveTag moves a tag to the trash.  Its article-tag links are kept until it is purged
+func (db *DB) RemoveTag(ctx context.Context, id int64) error {
+	s := "UPDATE tags SET DeletedAt=? WHERE ID=? AND DeletedAt IS NULL;"
+	_, err := db.exec(ctx, s, time.Now().UTC(), id)
+	return err
+}
 
+// TrashedArticles returns `limit` articles in the trash, most recently deleted first, offset by `offset`
+func (db *DB) TrashedArticles(ctx context.Context, limit, offset int) ([]DBArticle, error) {
+	var params []interface{}
+	s := "SELECT ID, Name, URL, Description, DeletedAt FROM articles WHERE DeletedAt IS NOT NULL ORDER BY DeletedAt DESC, ID DESC" +
+		db.limit(limit, offset, &params) + ";"
+	articles := []DBArticle{}
+	err := db.read(ctx, func(ctx context.Context, c *DB) error {
+		rows, err := c.Query(ctx, s, params...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var url, desc sql.NullString
+			var deleted time.Time
+			a := DBArticle{}
+			err = rows.Scan(&a.ID, &a.Name, &url, &desc, &deleted)
+			if err != nil {
+				return err
+			}
+			a.URL, a.Description, a.DeletedAt = nullStringToString(url), nullStringToString(desc), &deleted
+			articles = append(articles, a)
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		return c.PopulateArticlesTags(ctx, articles)
+	})
 	if err != nil {
-		return 0, err
+		return []DBArticle{}, err
 	}
+	return articles, nil
+}
 
-	id, err := res.LastInsertId()
+// TrashedTags returns `limit` tags in the trash, most recently deleted first, offset by `offset`
+func (db *DB) TrashedTags(ctx context.Context, limit, offset int) ([]DBTag, error) {
+	var params []interface{}
+	s := "SELECT ID, Name, Description, DeletedAt FROM tags WHERE DeletedAt IS NOT NULL ORDER BY DeletedAt DESC, ID DESC" +
+		db.limit(limit, offset, &params) + ";"
+	tags := []DBTag{}
+	err := db.read(ctx, func(ctx context.Context, c *DB) error {
+		rows, err := c.Query(ctx, s, params...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var desc sql.NullString
+			var deleted time.Time
+			t := DBTag{}
+			err = rows.Scan(&t.ID, &t.Name, &desc, &deleted)
+			if err != nil {
+				return err
+			}
+			t.Description, t.DeletedAt = nullStringToString(desc), &deleted
+			tags = append(tags, t)
+		}
+		return rows.Err()
+	})
 	if err != nil {
-		return id, err
+		return []DBTag{}, err
 	}
-	return id, nil
+	return tags, nil
 }
 
-// RemoveArticleTags removes all article-tag links by articleID
-func (db *DB) RemoveArticleTags(articleID int64) error {
-	s := "DELETE FROM article_to_tag WHERE ArticleID=?;"
-	_, err := db.Exec(s, articleID)
-	return err
+// restore takes row `id` of `table` out of the trash, reporting whether it was in the trash
+func (db *DB) restore(ctx context.Context, table string, id int64) (bool, error) {
+	res, err := db.exec(ctx, "UPDATE "+table+" SET DeletedAt=NULL WHERE ID=? AND DeletedAt IS NOT NULL;", id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
 }
 
-// RemoveTagsFromArticles removes all article-tag links by tagID
-func (db *DB) RemoveTagsFromArticles(tagID int64) error {
-	s := "DELETE FROM article_to_tag WHERE TagID=?;"
-	_, err := db.Exec(s, tagID)
-	return err
+// RestoreArticle takes an article out of the trash along with its article-tag links, reporting whether it was in the trash
+func (db *DB) RestoreArticle(ctx context.Context, id int64) (bool, error) {
+	return db.restore(ctx, "articles", id)
 }
 
-// RemoveArticle removes an article without touching article-tag links
-func (db *DB) RemoveArticle(id int64) error {
-	s := "DELETE FROM articles WHERE ID=?;"
-	_, err := db.Exec(s, id)
-	return err
+// RestoreTag takes a tag out of the trash along with its article-tag links, reporting whether it was in the trash
+func (db *DB) RestoreTag(ctx context.Context, id int64) (bool, error) {
+	return db.restore(ctx, "tags", id)
 }
 
-// RemoveTag removes a tag without touching article-tag links
-func (db *DB) RemoveTag(id int64) error {
-	s := "DELETE FROM tags WHERE ID=?;"
-	_, err := db.Exec(s, id)
-	return err
+// PurgeTrash permanently removes articles and tags moved to the trash before `before`, returning how many were removed.
+// Their article-tag links are removed by ON DELETE CASCADE, their revisions are kept
+func (db *DB) PurgeTrash(ctx context.Context, before time.Time) (int64, error) {
+	var purged int64
+	err := db.run(ctx, func(ctx context.Context, c *DB) error {
+		return c.withTx(ctx, func(tx *DB) error {
+			for _, table := range []string{"articles", "tags"} {
+				res, err := tx.Exec(ctx, "DELETE FROM "+table+" WHERE DeletedAt < ?;", before.UTC())
+				if err != nil {
+					return err
+				}
+				n, err := res.RowsAffected()
+				if err != nil {
+					return err
+				}
+				purged += n
+			}
+			return nil
+		})
+	})
+	return purged, err
 }
 
-// UpdateArticle updates an article's information, BUT NOT TAGS
-func (db *DB) UpdateArticle(id int64, article UploadArticle) error {
+// UpdateArticle updates an article's information, BUT NOT TAGS.  Its images are replaced unless `article.Images` is nil
+func (db *DB) UpdateArticle(ctx context.Context, id int64, article UploadArticle) error {
 	s := "UPDATE articles SET Name=?, URL=?, Description=? WHERE ID=?;"
-	_, err := db.Exec(s, stringOrNil(article.Name), stringOrNil(article.URL), stringOrNil(article.Description), id)
-	return err
+	if article.Images == nil {
+		_, err := db.exec(ctx, s, stringOrNil(article.Name), stringOrNil(article.URL), stringOrNil(article.Description), id)
+		return err
+	}
+	return db.run(ctx, func(ctx context.Context, c *DB) error {
+		return c.withTx(ctx, func(tx *DB) error {
+			_, err := tx.Exec(ctx, s, stringOrNil(article.Name), stringOrNil(article.URL), stringOrNil(article.Description), id)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(ctx, "DELETE FROM article_images WHERE ArticleID=?;", id)
+			if err != nil {
+				return err
+			}
+			return tx.insertArticleImages(ctx, id, article.Images)
+		})
+	})
 }
 
 // UpdateTag updates a tag's information
-func (db *DB) UpdateTag(id int64, tag UploadTag) error {
+func (db *DB) UpdateTag(ctx context.Context, id int64, tag UploadTag) error {
 	s := "UPDATE tags SET Name=?, Description=? WHERE ID=?;"
-	_, err := db.Exec(s, stringOrNil(tag.Name), stringOrNil(tag.Description), id)
+	_, err := db.exec(ctx, s, stringOrNil(tag.Name), stringOrNil(tag.Description), id)
 	return err
 }
 
-// // UnmarshalUsers unmarshalls users
-// func UnmarshalUsers(rows *sql.Rows) []User {
-// 	users := []User{}
-// 	if rows == nil {
-// 		return users
-// 	}
-// 	for rows.Next() {
-// 		var id int64
-// 		name := ""
-// 		passwd := ""
-
-// 		err := rows.Scan(&id, &name, &passwd)
-// 		if err != nil {
-// 			log.Println("Error unmarshalling article:", err)
-// 		}
-// 		users = append(users, User{
-// 			ID:     id,
-// 			Name:   name,
-// 			Passwd: passwd,
-// 		})
-// 	}
-// 	return users
-// }
-
-// // UserByName returns a user with a name, or nil
-// func (db *DB) UserByName(name string) (*User, error) {
-// 	s := "SELECT * FROM users WHERE Name=?;"
-// 	rows, err := db.Query(s, name)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-// 	users := UnmarshalUsers(rows)
-// 	if len(users) < 1 {
-// 		return nil, nil
-// 	} else if len(users) > 1 {
-// 		log.Println("WARNING: multiple users with name", users)
-// 	}
-// 	return &users[0], nil
-// }
-
-// // InsertUser inserts a user
-// func (db *DB) InsertUser(user User) (int64, error) {
-// 	s := `INSERT INTO users (Name, Password) VALUES (?, ?);`
-// 	res, err := db.Exec(s, user.Name, user.Passwd)
-// 	if err != nil {
-// 		return 0, err
-// 	}
-// 	id, _ := res.LastInsertId()
-// 	return id, nil
-// }
-
-// WARNING: vulnerable to SQL injection via `name` parameter
-func (db *DB) tableExists(name string) bool {
-	rows, err := db.Query("SELECT 1 FROM " + name + " LIMIT 1;")
-	if rows != nil {
-		rows.Close()
-	}
-	return err == nil
-}
-
 func printRows(rows *sql.Rows) {
 	for rows.Next() {
 		var line string
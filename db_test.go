@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// countingDriver is the SQLite driver counting the statements it runs.  Its connections only offer Prepare, so
+// database/sql sends every query and exec through it
+type countingDriver struct {
+	sqlite3.SQLiteDriver
+	queries int64
+}
+
+func (d *countingDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := d.SQLiteDriver.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{conn, d}, nil
+}
+
+type countingConn struct {
+	conn driver.Conn
+	d    *countingDriver
+}
+
+func (c *countingConn) Prepare(query string) (driver.Stmt, error) {
+	atomic.AddInt64(&c.d.queries, 1)
+	return c.conn.Prepare(query)
+}
+
+func (c *countingConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *countingConn) Begin() (driver.Tx, error) {
+	return c.conn.Begin()
+}
+
+var queryCounter = &countingDriver{}
+
+func init() {
+	sql.Register("sqlite3-counting", queryCounter)
+}
+
+// countingDB opens a fresh SQLite DB in `dir` through queryCounter
+func countingDB(t *testing.T, dir string) *DB {
+	db, err := sql.Open("sqlite3-counting", "file:"+filepath.Join(dir, "test.db")+"?_foreign_keys=1&_txlock=immediate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &DB{DB: db, dialect: dialectSQLite, conns: newConnManager(db, PoolConfig{})}
+	d.Init()
+	return d
+}
+
+func TestPopulateArticlesTagsQueries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db := countingDB(t, dir)
+	defer db.Close()
+	ctx := context.Background()
+	for _, name := range []string{"engine", "search"} {
+		if _, err := db.InsertTag(ctx, UploadTag{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for ii := 0; ii < tagBatchSize+1; ii++ {
+		_, err := db.InsertArticle(ctx, UploadArticle{Name: fmt.Sprint("article ", ii), Tags: []string{"engine", "search"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	search := func(limit int) int64 {
+		t.Helper()
+		before := atomic.LoadInt64(&queryCounter.queries)
+		articles, _, err := db.ArticlesWithTagsSearch(ctx, nil, nil, "", "", false, nil, limit, 0, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(articles) != limit {
+			t.Fatalf("limit %d found %d articles", limit, len(articles))
+		}
+		for _, a := range articles {
+			if len(a.Tags) != 2 {
+				t.Fatalf("article %d has tags %v", a.ID, a.Tags)
+			}
+		}
+		return atomic.LoadInt64(&queryCounter.queries) - before
+	}
+	// the search, then the tags and images of its articles
+	want := search(1)
+	if want != 3 {
+		t.Errorf("limit 1 ran %d queries, want 3", want)
+	}
+	for _, limit := range []int{10, 100, tagBatchSize} {
+		if got := search(limit); got != want {
+			t.Errorf("limit %d ran %d queries, limit 1 ran %d", limit, got, want)
+		}
+	}
+	// the next batch takes one query for tags and one for images
+	if got := search(tagBatchSize + 1); got != want+2 {
+		t.Errorf("limit %d ran %d queries, want %d", tagBatchSize+1, got, want+2)
+	}
+}
+
+// connIDCounter is queryCounter's driver with MySQL's CONNECTION_ID(), numbering connections as they open
+var connIDCounter = &countingDriver{SQLiteDriver: sqlite3.SQLiteDriver{
+	ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+		id := atomic.AddInt64(&lastConnID, 1)
+		return conn.RegisterFunc("CONNECTION_ID", func() int64 { return id }, true)
+	},
+}}
+
+var lastConnID int64
+
+func init() {
+	sql.Register("sqlite3-connid", connIDCounter)
+}
+
+func TestPinCachesConnID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sqlDB, err := sql.Open("sqlite3-connid", "file:"+filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlDB.Close()
+	db := &DB{DB: sqlDB, dialect: dialectSQLite, connIDs: &connIDCache{ids: make(map[interface{}]cachedConnID)}}
+	pinned := func() (id, queries int64) {
+		t.Helper()
+		before := atomic.LoadInt64(&connIDCounter.queries)
+		err := db.pin(context.Background(), func(c *DB) error {
+			id = c.connID
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id, atomic.LoadInt64(&connIDCounter.queries) - before
+	}
+
+	first, queries := pinned()
+	if first == 0 || queries != 1 {
+		t.Fatalf("first pin: ID %d after %d queries", first, queries)
+	}
+	// the pool hands back its one idle connection, whose ID is known
+	if id, queries := pinned(); id != first || queries != 0 {
+		t.Errorf("second pin: ID %d after %d queries, want %d after none", id, queries, first)
+	}
+
+	// a new connection is asked for its own
+	sqlDB.SetMaxIdleConns(0)
+	if id, queries := pinned(); id == first || queries != 1 {
+		t.Errorf("new connection: ID %d after %d queries", id, queries)
+	}
+}
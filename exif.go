@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
+)
+
+// exifOrientationTag is the EXIF tag saying how a JPEG must be rotated or flipped to display upright
+const exifOrientationTag = 0x0112
+
+// jpegOrientation returns the EXIF orientation of JPEG `data`, 1 (upright) to 8, or 1 if it has none.  Cameras save
+// photos as the sensor read them and record the rotation here, which is lost when the image is re-encoded
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		if marker == 0xD8 || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			// markers without a length
+			i += 2
+			continue
+		} else if marker == 0xDA {
+			// image data follows, and EXIF comes before it
+			return 1
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) {
+			return 1
+		}
+		if segment := data[i+4 : end]; marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i = end
+	}
+	return 1
+}
+
+// tiffOrientation reads the orientation from the first IFD of the TIFF structure EXIF data is kept in, returning 1 if
+// it is missing or invalid
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	n := int(order.Uint16(tiff[ifd:]))
+	for entry := ifd + 2; entry+12 <= len(tiff) && n > 0; entry, n = entry+12, n-1 {
+		// tag, type, count and value.  The orientation is a single SHORT, stored in the value
+		if order.Uint16(tiff[entry:]) != exifOrientationTag {
+			continue
+		}
+		if o := int(order.Uint16(tiff[entry+8:])); order.Uint16(tiff[entry+2:]) == 3 && o >= 1 && o <= 8 {
+			return o
+		}
+		return 1
+	}
+	return 1
+}
+
+// toRGBA returns `m` as an `*image.RGBA` whose bounds start at 0,0, converting it if it is not one
+func toRGBA(m image.Image) *image.RGBA {
+	b := m.Bounds()
+	if rgba, ok := m.(*image.RGBA); ok && b.Min == (image.Point{}) {
+		return rgba
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), m, b.Min, draw.Src)
+	return rgba
+}
+
+// orient rotates and flips `src` so that an image with EXIF orientation `o` is upright
+func orient(src *image.RGBA, o int) *image.RGBA {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if o < 2 || o > 8 {
+		return src
+	}
+	dw, dh := w, h
+	if o >= 5 {
+		// rotated a quarter turn
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch o {
+			case 2: // flipped horizontally
+				sx, sy = w-1-x, y
+			case 3: // rotated 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // flipped vertically
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // needs a quarter turn clockwise
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // needs a quarter turn anticlockwise
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):])
+		}
+	}
+	return dst
+}
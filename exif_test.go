@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// exifJPEG encodes a 40x20 JPEG, red on the left and blue on the right, with EXIF orientation `o` written in `order`
+func exifJPEG(t *testing.T, o uint16, order binary.ByteOrder) []byte {
+	m := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			if x < 20 {
+				m.Set(x, y, color.RGBA{255, 0, 0, 255})
+			} else {
+				m.Set(x, y, color.RGBA{0, 0, 255, 255})
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, m, nil); err != nil {
+		t.Fatal(err)
+	}
+	// a TIFF header and an IFD holding only the orientation
+	tiff := make([]byte, 26)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], exifOrientationTag)
+	order.PutUint16(tiff[12:], 3)
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], o)
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(segment)+2))
+	data := buf.Bytes()
+	return append(append(append([]byte{0xFF, 0xD8}, app1...), segment...), data[2:]...)
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	for _, c := range []struct {
+		o          uint16
+		order      binary.ByteOrder
+		w, h       int
+		redX, redY int
+	}{
+		{1, binary.LittleEndian, 40, 20, 5, 10},
+		{2, binary.LittleEndian, 40, 20, 35, 10},
+		{3, binary.BigEndian, 40, 20, 35, 10},
+		{6, binary.LittleEndian, 20, 40, 10, 5},
+		{8, binary.BigEndian, 20, 40, 10, 35},
+	} {
+		data := exifJPEG(t, c.o, c.order)
+		if got := jpegOrientation(data); got != int(c.o) {
+			t.Errorf("orientation %d read as %d", c.o, got)
+		}
+		_, full, _, err := processImage(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := jpeg.Decode(bytes.NewReader(full))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := m.Bounds(); b.Dx() != c.w || b.Dy() != c.h {
+			t.Errorf("orientation %d turned upright is %dx%d, want %dx%d", c.o, b.Dx(), b.Dy(), c.w, c.h)
+			continue
+		}
+		if r, _, b, _ := m.At(c.redX, c.redY).RGBA(); r < 0xC000 || b > 0x4000 {
+			t.Errorf("orientation %d turned upright is not red at %d,%d", c.o, c.redX, c.redY)
+		}
+		// the pixels are turned instead, so the EXIF must go
+		if got := jpegOrientation(full); got != 1 {
+			t.Errorf("orientation %d kept as %d", c.o, got)
+		}
+	}
+
+	bad := exifJPEG(t, 6, binary.BigEndian)
+	for name, data := range map[string][]byte{
+		"not a JPEG":          []byte("\x89PNG\r\n\x1a\n"),
+		"truncated":           bad[:12],
+		"out of range":        exifJPEG(t, 9, binary.LittleEndian),
+		"not TIFF":            bytes.Replace(bad, []byte("MM\x00\x2a"), []byte("XX\x00\x2a"), 1),
+		"segment too long":    append(append([]byte{}, bad[:4]...), 0xFF, 0xFF),
+		"without orientation": bytes.Replace(bad, []byte{0x01, 0x12}, []byte{0x01, 0x13}, 1),
+	} {
+		if got := jpegOrientation(data); got != 1 {
+			t.Errorf("%s: orientation %d, want 1", name, got)
+		}
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// 2x1, red then blue
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	copy(src.Pix, []uint8{255, 0, 0, 255, 0, 0, 255, 255})
+	for o, want := range map[int][]uint8{
+		1: {255, 0, 0, 255, 0, 0, 255, 255},
+		2: {0, 0, 255, 255, 255, 0, 0, 255},
+		5: {255, 0, 0, 255, 0, 0, 255, 255},
+		6: {255, 0, 0, 255, 0, 0, 255, 255},
+		8: {0, 0, 255, 255, 255, 0, 0, 255},
+	} {
+		dst := orient(src, o)
+		if o >= 5 && dst.Bounds().Dx() != 1 {
+			t.Errorf("orientation %d not turned a quarter", o)
+		}
+		if !bytes.Equal(dst.Pix, want) {
+			t.Errorf("orientation %d gave %v, want %v", o, dst.Pix, want)
+		}
+	}
+}
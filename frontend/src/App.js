@@ -13,7 +13,10 @@ import Upload from "./components/Upload";
 import ArticlePage from "./components/ArticlePage";
 import PostArticle from "./components/PostArticle";
 import PostTag from "./components/PostTag";
+import Login from "./components/Login";
 import "./App.css";
+import "./Auth";
+import "./Primary";
 
 const cookies = new Cookies();
 
@@ -90,6 +93,7 @@ function App() {
           <Route exact path="/upload/tag" component={PostTag} />
           <Route exact path="/upload" component={Upload} />
           <Route path="/article" component={ArticlePage} />
+          <Route exact path="/login" component={Login} />
         </body>
       </Router>
     </div>
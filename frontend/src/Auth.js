@@ -0,0 +1,79 @@
+import axios from "axios";
+import { SERVER_URL } from "./Const";
+
+// tokens from /api/user/auth, kept across reloads
+const TOKENS_KEY = "tokens";
+
+export const loadTokens = () => {
+  try {
+    return JSON.parse(localStorage.getItem(TOKENS_KEY));
+  } catch (e) {
+    return null;
+  }
+};
+
+const saveTokens = (tokens) => {
+  if (tokens) {
+    localStorage.setItem(TOKENS_KEY, JSON.stringify(tokens));
+  } else {
+    localStorage.removeItem(TOKENS_KEY);
+  }
+};
+
+export const login = (name, password) =>
+  axios
+    .post(`${SERVER_URL}/api/user/auth`, JSON.stringify({ name, password }))
+    .then((res) => {
+      saveTokens(res.data);
+      return res.data.user;
+    });
+
+export const register = (name, password) =>
+  axios
+    .post(`${SERVER_URL}/api/user/create`, JSON.stringify({ name, password }))
+    .then(() => login(name, password));
+
+export const logout = () =>
+  axios
+    .post(`${SERVER_URL}/api/user/logout`)
+    .catch((err) => console.log(err))
+    .then(() => saveTokens(null));
+
+// send the access token with every request to the server
+axios.interceptors.request.use((config) => {
+  const tokens = loadTokens();
+  if (tokens && config.url.startsWith(SERVER_URL)) {
+    config.headers.Authorization = `Bearer ${tokens.access_token}`;
+  }
+  return config;
+});
+
+// access tokens expire after a few minutes, so swap the refresh token for new ones and retry once
+axios.interceptors.response.use(undefined, (err) => {
+  const tokens = loadTokens();
+  const config = err.config;
+  if (
+    !tokens ||
+    !err.response ||
+    err.response.status !== 401 ||
+    config.retried ||
+    config.url === `${SERVER_URL}/api/user/refresh`
+  ) {
+    return Promise.reject(err);
+  }
+  config.retried = true;
+  return axios
+    .post(
+      `${SERVER_URL}/api/user/refresh`,
+      JSON.stringify({ refresh_token: tokens.refresh_token })
+    )
+    .then((res) => {
+      saveTokens(res.data);
+      return axios(config);
+    })
+    .catch(() => {
+      // the session was logged out or expired
+      saveTokens(null);
+      return Promise.reject(err);
+    });
+});
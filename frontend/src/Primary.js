@@ -0,0 +1,33 @@
+import axios from "axios";
+import { SERVER_URL } from "./Const";
+
+// writes answer with the time until which reads must go to the primary database to see them, since the replicas lag.
+// Sent back with every request, the server ignores it once it passes
+const PRIMARY_HEADER = "x-read-primary-until";
+const PRIMARY_KEY = "readPrimaryUntil";
+
+const remember = (res) => {
+  const until = res && res.headers[PRIMARY_HEADER];
+  if (until) {
+    sessionStorage.setItem(PRIMARY_KEY, until);
+  }
+};
+
+axios.interceptors.request.use((config) => {
+  const until = sessionStorage.getItem(PRIMARY_KEY);
+  if (until && config.url.startsWith(SERVER_URL)) {
+    config.headers[PRIMARY_HEADER] = until;
+  }
+  return config;
+});
+
+axios.interceptors.response.use(
+  (res) => {
+    remember(res);
+    return res;
+  },
+  (err) => {
+    remember(err.response);
+    return Promise.reject(err);
+  }
+);
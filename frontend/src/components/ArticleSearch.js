@@ -59,11 +59,22 @@ const ArticleSearch = () => {
   const [tags, setTags] = useState([]);
 
   useEffect(() => {
-    axios
-      .get(`${SERVER_URL}/api/search/tag?orderby=name`)
-      .then((res) => {
+    // tags arrive a page at a time, follow the cursor until there are no more
+    const getTags = (tags, cursor) =>
+      axios
+        .get(
+          `${SERVER_URL}/api/search/tag?orderby=name&limit=500` +
+            (cursor ? `&cursor=${cursor}` : "")
+        )
+        .then((res) => {
+          const next = res.headers["x-next-cursor"];
+          tags = tags.concat(res.data);
+          return next ? getTags(tags, next) : tags;
+        });
+    getTags([])
+      .then((tags) => {
         console.log("retrieved tags");
-        setTags(res.data);
+        setTags(tags);
       })
       .catch((e) => {
         console.log("error retrieving tags: ", e);
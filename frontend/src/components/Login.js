@@ -0,0 +1,74 @@
+import React, { useState } from "react";
+import { loadTokens, login, logout, register } from "../Auth";
+
+const Login = () => {
+  const tokens = loadTokens();
+  const [user, setUser] = useState(tokens ? tokens.user : null);
+  const [name, setName] = useState("");
+  const [password, setPassword] = useState("");
+  const [error, setError] = useState("");
+
+  const submit = (f) => {
+    f(name, password)
+      .then((u) => {
+        setUser(u);
+        setError("");
+        setPassword("");
+      })
+      .catch((err) =>
+        setError(
+          err.response && err.response.data.message
+            ? err.response.data.message
+            : `${err}`
+        )
+      );
+  };
+
+  if (user) {
+    return (
+      <div className="Post">
+        Logged in as {user.name} ({user.role})
+        <br />
+        <button onClick={() => logout().then(() => setUser(null))}>
+          Log out
+        </button>
+      </div>
+    );
+  }
+
+  return (
+    <div className="Post">
+      <form
+        onSubmit={(e) => {
+          e.preventDefault();
+          submit(login);
+        }}
+      >
+        <input
+          placeholder="name"
+          value={name}
+          onChange={(e) => setName(e.target.value)}
+          maxLength={30}
+          required
+        />
+        <br />
+        <input
+          type="password"
+          placeholder="password"
+          value={password}
+          onChange={(e) => setPassword(e.target.value)}
+          maxLength={50}
+          required
+        />
+        <br />
+        <button type="submit">Log in</button>
+        <button type="button" onClick={() => submit(register)}>
+          Register
+        </button>
+      </form>
+      {error}
+    </div>
+  );
+};
+
+export default Login;
@@ -15,6 +15,7 @@ const TopBar = () => {
     ["/upload", "upload"],
     ["/upload/tag", "upload tag"],
     ["/upload/article", "upload article"],
+    ["/login", "login"],
   ];
 
   return (
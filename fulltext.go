@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// innoDBStopwords are the words InnoDB's full-text indexes leave out by default, so a query requiring one matches nothing
+var innoDBStopwords = map[string]bool{
+	"a": true, "about": true, "an": true, "are": true, "as": true, "at": true, "be": true, "by": true, "com": true,
+	"de": true, "en": true, "for": true, "from": true, "how": true, "i": true, "in": true, "is": true, "it": true,
+	"la": true, "of": true, "on": true, "or": true, "that": true, "the": true, "this": true, "to": true, "was": true,
+	"what": true, "when": true, "where": true, "who": true, "will": true, "with": true, "und": true, "www": true,
+}
+
+// innoDBMinTokenSize is InnoDB's default `innodb_ft_min_token_size`.  Shorter words are not indexed
+const innoDBMinTokenSize = 3
+
+// innoDBIndexes reports whether InnoDB's full-text index keeps word `w`
+func innoDBIndexes(w string) bool {
+	return !innoDBStopwords[w] && utf8.RuneCountInString(w) >= innoDBMinTokenSize
+}
+
+// fullTextQuery is a parsed full-text search.  Matching articles contain every term and every phrase in their name or description
+type fullTextQuery struct {
+	// lowercase words matched individually
+	terms []string
+	// lowercase words matched as consecutive runs
+	phrases [][]string
+}
+
+// empty reports whether the query has nothing to match, e.g. it was only punctuation
+func (q fullTextQuery) empty() bool {
+	return len(q.terms) == 0 && len(q.phrases) == 0
+}
+
+// words splits `s` into lowercase runs of letters and digits, dropping everything else (including search operators)
+func words(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+}
+
+// parseFullText splits `s` into terms and "quoted phrases".  An unterminated quote runs to the end of `s`
+func parseFullText(s string) fullTextQuery {
+	q := fullTextQuery{}
+	for ii, part := range strings.Split(s, `"`) {
+		w := words(part)
+		if ii%2 == 0 {
+			q.terms = append(q.terms, w...)
+		} else if len(w) == 1 {
+			q.terms = append(q.terms, w[0])
+		} else if len(w) > 1 {
+			q.phrases = append(q.phrases, w)
+		}
+	}
+	return q
+}
+
+// fullTextSource returns a subquery of (ID, Relevance) for every article matching `q`, and its parameters
+func (db *DB) fullTextSource(q fullTextQuery) (string, []interface{}) {
+	switch db.dialect {
+	case dialectSQLite:
+		// FTS4 has no ranking function, so relevance is the number of matched tokens counted from offsets().
+		// LIMIT -1 stops SQLite flattening this into the grouped outer query, where offsets() is not allowed
+		match := []string{}
+		for _, t := range q.terms {
+			match = append(match, `"`+t+`"`)
+		}
+		for _, p := range q.phrases {
+			match = append(match, `"`+strings.Join(p, " ")+`"`)
+		}
+		src := "SELECT docid AS ID," +
+			" (length(offsets(articles_fts)) - length(replace(offsets(articles_fts), ' ', '')) + 1) / 4 AS Relevance" +
+			" FROM articles_fts WHERE articles_fts MATCH ? LIMIT -1"
+		return src, []interface{}{strings.Join(match, " ")}
+	case dialectPostgres:
+		parts := []string{}
+		params := []interface{}{}
+		if len(q.terms) > 0 {
+			parts = append(parts, "plainto_tsquery('simple', ?)")
+			params = append(params, strings.Join(q.terms, " "))
+		}
+		for _, p := range q.phrases {
+			parts = append(parts, "phraseto_tsquery('simple', ?)")
+			params = append(params, strings.Join(p, " "))
+		}
+		return "SELECT ID, ts_rank(" + postgresArticleVector + ", q) AS Relevance" +
+			" FROM articles, (SELECT " + strings.Join(parts, " && ") + " AS q) ftq" +
+			" WHERE " + postgresArticleVector + " @@ q", params
+	default:
+		// words the index leaves out are optional, which InnoDB ignores, as requiring them would match nothing
+		match := []string{}
+		for _, t := range q.terms {
+			if innoDBIndexes(t) {
+				t = "+" + t
+			}
+			match = append(match, t)
+		}
+		for _, p := range q.phrases {
+			match = append(match, `+"`+strings.Join(p, " ")+`"`)
+		}
+		against := strings.Join(match, " ")
+		return "SELECT ID, MATCH(Name, Description) AGAINST (? IN BOOLEAN MODE) AS Relevance" +
+			" FROM articles WHERE MATCH(Name, Description) AGAINST (? IN BOOLEAN MODE)", []interface{}{against, against}
+	}
+}
+
+// postgresArticleVector must match the expression indexed by the full-text migration or the index is not used
+const postgresArticleVector = "to_tsvector('simple', COALESCE(Name, '') || ' ' || COALESCE(Description, ''))"
+
+// ArticlesFullTextSearch is ArticlesWithTagsSearch restricted to articles matching the full-text `query`.
+// Results are ordered by relevance unless `orderby` says otherwise
+func (db *DB) ArticlesFullTextSearch(ctx context.Context, tags []string, tq tagQuery, query, lookslike, orderby string, reverse bool, after *searchCursor, limit, offset int, withTotal bool) ([]DBArticle, int, error) {
+	q := parseFullText(query)
+	if q.empty() {
+		return []DBArticle{}, 0, nil
+	}
+	return db.articleSearch(ctx, tags, tq, &q, lookslike, orderby, reverse, after, limit, offset, withTotal)
+}
+
+// fullTextScore returns how many times `q` matches `name` and `description`, or 0 unless every term and phrase matches
+func fullTextScore(q fullTextQuery, name, description string) int {
+	w := append(words(name), words(description)...)
+	score := 0
+	for _, t := range q.terms {
+		n := 0
+		for _, x := range w {
+			if x == t {
+				n++
+			}
+		}
+		if n == 0 {
+			return 0
+		}
+		score += n
+	}
+	for _, p := range q.phrases {
+		n := 0
+		for ii := 0; ii+len(p) <= len(w); ii++ {
+			match := true
+			for jj := range p {
+				if w[ii+jj] != p[jj] {
+					match = false
+					break
+				}
+			}
+			if match {
+				n++
+			}
+		}
+		if n == 0 {
+			return 0
+		}
+		score += n
+	}
+	return score
+}
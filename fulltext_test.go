@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseFullText(t *testing.T) {
+	for s, want := range map[string]fullTextQuery{
+		"":                          {},
+		"+-*()":                     {},
+		"Search  ENGINE":            {terms: []string{"search", "engine"}},
+		`"search engine" web`:       {terms: []string{"web"}, phrases: [][]string{{"search", "engine"}}},
+		`"web" "search, engine`:     {terms: []string{"web"}, phrases: [][]string{{"search", "engine"}}},
+		`+required -excluded "" a*`: {terms: []string{"required", "excluded", "a"}},
+		"café 2021":                 {terms: []string{"café", "2021"}},
+	} {
+		if got := parseFullText(s); !reflect.DeepEqual(got, want) {
+			t.Errorf("parseFullText(%q) = %+v, want %+v", s, got, want)
+		}
+	}
+}
+
+func TestFullTextScore(t *testing.T) {
+	for _, c := range []struct {
+		query, name, description string
+		score                    int
+	}{
+		{"search", "google", "a search engine for searching", 1},
+		{"search engine", "search", "a search engine", 3},
+		{"search frogs", "google", "a search engine", 0},
+		{`"search engine"`, "search", "a search engine, the search engine", 2},
+		{`"engine search"`, "google", "a search engine", 0},
+		{`"search engine" web`, "google", "a search engine", 0},
+	} {
+		if got := fullTextScore(parseFullText(c.query), c.name, c.description); got != c.score {
+			t.Errorf("%q scores %q %q %d, want %d", c.query, c.name, c.description, got, c.score)
+		}
+	}
+}
+
+func TestMySQLFullTextSource(t *testing.T) {
+	db := &DB{dialect: dialectMySQL}
+	_, params := db.fullTextSource(parseFullText(`the search "of mice" is on go engines`))
+	// stopwords and short words are not indexed, so must not be required
+	want := `the +search is on go +engines +"of mice"`
+	if len(params) != 2 || params[0] != want || params[1] != want {
+		t.Errorf("MySQL full-text query %v, want %q twice", params, want)
+	}
+}
+
+func TestArticlesFullTextSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, store := range testStores(t, dir) {
+		t.Run(name, func(t *testing.T) {
+			defer store.Close()
+			ctx := context.Background()
+			for _, a := range []UploadArticle{
+				{Name: "google search", Description: "a big search engine that searches the web"},
+				{Name: "bing", Description: "another engine for web search"},
+				{Name: "frogs", Description: "search frogs"},
+			} {
+				if _, err := store.InsertArticle(ctx, a); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for query, want := range map[string][]string{
+				"frogs":            {"frogs"},
+				"web engine":       {"google search", "bing"},
+				`"search engine"`:  {"google search"},
+				`"engine search"`:  {},
+				"toads":            {},
+				"search":           {"google search", "bing", "frogs"},
+				`"search" "frogs"`: {"frogs"},
+				"SEARCH Frogs":     {"frogs"},
+				`web "search frog`: {},
+				`bing "for web"`:   {"bing"},
+				"google -search":   {"google search"},
+				"searches":         {"google search"},
+			} {
+				articles, _, err := store.ArticlesFullTextSearch(ctx, nil, nil, query, "", "name", false, nil, 0, 0, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := []string{}
+				for _, a := range articles {
+					got = append(got, a.Name)
+				}
+				if !sameStrings(got, want) {
+					t.Errorf("%q found %v, want %v", query, got, want)
+				}
+			}
+		})
+	}
+}
+
+// sameStrings reports whether `a` and `b` hold the same strings in any order
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[string]int)
+	for _, s := range a {
+		counts[s]++
+	}
+	for _, s := range b {
+		counts[s]--
+		if counts[s] < 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -6,4 +6,8 @@ require (
 	github.com/go-sql-driver/mysql v1.5.0
 	github.com/gorilla/mux v1.7.4
 	github.com/joho/godotenv v1.3.0
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.16
+	github.com/swaggo/http-swagger v1.3.4
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
 )
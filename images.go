@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxArticleImages is how many images an article may have
+	maxArticleImages = 4
+	// maxImageSize is the largest decoded image accepted, in bytes
+	maxImageSize = 8 << 20
+	// maxImageDimension is the widest and tallest image accepted, in pixels
+	maxImageDimension = 4096
+	// jpegQuality is the quality JPEGs are re-encoded at
+	jpegQuality = 90
+	// imageMaxAge is how long clients may cache images.  Stored images never change
+	imageMaxAge = 365 * 24 * 60 * 60
+)
+
+// imageGracePeriod is how long after an image is stored it is kept even if no article uses it, long enough for the upload
+// storing it to save its article
+var imageGracePeriod = 15 * time.Minute
+
+// maxArticleBody is the largest article body accepted, in bytes: as many base64 encoded images as an article may have,
+// plus room for the rest of the article
+var maxArticleBody = int64(maxArticleImages*base64.StdEncoding.EncodedLen(maxImageSize) + 1<<20)
+
+// thumbnailWidths are the widths, in ascending order, images are scaled down to.  Images no wider are not scaled
+var thumbnailWidths = []int{160, 480, 1024}
+
+// imageTypes maps the extension images are stored under to their content type
+var imageTypes = map[string]string{
+	".png": "image/png",
+	".jpg": "image/jpeg",
+	".gif": "image/gif",
+}
+
+// imageExtensions maps each format detected by `image.DecodeConfig` to the extension it is stored under
+var imageExtensions = map[string]string{
+	"png":  ".png",
+	"jpeg": ".jpg",
+	"gif":  ".gif",
+}
+
+// imageFilenameRe matches the filenames given to stored images: a SHA-256, or a random ID for older images
+var imageFilenameRe = regexp.MustCompile(`^([0-9a-f]{64}|[0-9a-f]{32})\.(png|jpg|gif)$`)
+
+// imageFilenames lists the filenames of `images`
+func imageFilenames(images []Image) []string {
+	names := make([]string, len(images))
+	for ii, img := range images {
+		names[ii] = img.Filename
+	}
+	return names
+}
+
+// thumbnailName is the name of image `name`'s thumbnail `width` pixels wide
+func thumbnailName(name string, width int) string {
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "-" + strconv.Itoa(width) + ext
+}
+
+// imageFilename names image `data` by its SHA-256, so the same image is stored once however often it is uploaded
+func imageFilename(data []byte, ext string) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]) + ext
+}
+
+// decodeImage decodes the base64 data of `img`, checking its size.  Errors are `*requestError`s
+func decodeImage(img Image) ([]byte, error) {
+	if base64.StdEncoding.DecodedLen(len(img.Data)) > maxImageSize+2 {
+		return nil, &requestError{413, fmt.Sprintf("images must be at most %d bytes", maxImageSize)}
+	}
+	data, err := base64.StdEncoding.DecodeString(img.Data)
+	if err != nil {
+		return nil, &requestError{400, "image data is not valid base64"}
+	} else if len(data) == 0 {
+		return nil, &requestError{400, "image is empty"}
+	} else if len(data) > maxImageSize {
+		return nil, &requestError{413, fmt.Sprintf("images must be at most %d bytes", maxImageSize)}
+	}
+	return data, nil
+}
+
+// encodeImage encodes `m` in `format`, one of the keys of `imageExtensions`
+func encodeImage(m image.Image, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, m)
+	case "jpeg":
+		err = jpeg.Encode(&buf, m, &jpeg.Options{Quality: jpegQuality})
+	case "gif":
+		err = gif.Encode(&buf, m, nil)
+	default:
+		err = fmt.Errorf("cannot encode %s images", format)
+	}
+	return buf.Bytes(), err
+}
+
+// scaleImage shrinks `src` to `width` pixels wide, keeping its aspect ratio, by averaging the pixels each new pixel
+// covers.  Reads `src.Pix` directly, as `At` allocates a color for every pixel
+func scaleImage(src *image.RGBA, width int) *image.RGBA {
+	b := src.Bounds()
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/height, b.Min.Y+(y+1)*b.Dy()/height
+		for x := 0; x < width; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/width, b.Min.X+(x+1)*b.Dx()/width
+			var r, g, bl, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[src.PixOffset(x0, sy):src.PixOffset(x1, sy)]
+				for i := 0; i < len(row); i += 4 {
+					r, g, bl, a, n = r+uint32(row[i]), g+uint32(row[i+1]), bl+uint32(row[i+2]), a+uint32(row[i+3]), n+1
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = uint8(r/n), uint8(g/n), uint8(bl/n), uint8(a/n)
+		}
+	}
+	return dst
+}
+
+// processImage detects the format of `data` from its content, checks its dimensions and re-encodes it, dropping EXIF
+// and other metadata after turning it upright.  Returns the extension to store it under, the re-encoded image and its
+// thumbnails keyed by width.  Animated GIFs keep only their first frame.  Errors are `*requestError`s
+func processImage(data []byte) (string, []byte, map[int][]byte, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	ext, ok := imageExtensions[format]
+	if err != nil || !ok {
+		return "", nil, nil, &requestError{400, "images must be png, jpeg or gif"}
+	} else if config.Width < 1 || config.Height < 1 || config.Width > maxImageDimension || config.Height > maxImageDimension {
+		return "", nil, nil, &requestError{400, fmt.Sprintf("images must be at most %dx%d pixels", maxImageDimension, maxImageDimension)}
+	}
+	m, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, nil, &requestError{400, "image is corrupt: " + err.Error()}
+	}
+	var rgba *image.RGBA
+	if o := jpegOrientation(data); format == "jpeg" && o != 1 {
+		// the EXIF saying how to turn it is dropped, so turn the pixels instead
+		rgba = orient(toRGBA(m), o)
+		m = rgba
+	}
+	full, err := encodeImage(m, format)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	thumbs := make(map[int][]byte)
+	for _, width := range thumbnailWidths {
+		if width >= m.Bounds().Dx() {
+			break
+		}
+		if rgba == nil {
+			rgba = toRGBA(m)
+		}
+		thumbs[width], err = encodeImage(scaleImage(rgba, width), format)
+		if err != nil {
+			return "", nil, nil, err
+		}
+	}
+	return ext, full, thumbs, nil
+}
+
+// storeImages validates `images` and saves them and their thumbnails to the blob store, setting each one's `Filename`
+// and `Size`.  They are registered first so that collecting unused images, which may have found a copy of one unused,
+// leaves them for `imageGracePeriod`.  Images no article uses by then are collected, even if storing them failed
+func (api *API) storeImages(ctx context.Context, images []Image) error {
+	if len(images) > maxArticleImages {
+		return &requestError{400, fmt.Sprintf("articles may have at most %d images", maxArticleImages)}
+	}
+	blobs := make([]map[string][]byte, len(images))
+	for ii, img := range images {
+		data, err := decodeImage(img)
+		if err != nil {
+			return err
+		}
+		ext, full, thumbs, err := processImage(data)
+		if err != nil {
+			return err
+		}
+		name := imageFilename(full, ext)
+		blobs[ii] = map[string][]byte{name: full}
+		size := int64(len(full))
+		for width, thumb := range thumbs {
+			blobs[ii][thumbnailName(name, width)] = thumb
+			size += int64(len(thumb))
+		}
+		images[ii].Filename, images[ii].Size = name, size
+	}
+	if len(images) == 0 {
+		return nil
+	}
+	err := api.store.RegisterImages(ctx, images)
+	if err != nil {
+		return err
+	}
+	for ii := range blobs {
+		for name, data := range blobs[ii] {
+			err = api.images.Put(ctx, name, data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// releaseImages deletes those of images `names` that no article uses from the blob store, such as those an edit
+// replaced.  Runs after the request may have ended
+func (api *API) releaseImages(names []string) {
+	if len(names) > 0 {
+		collectImages(context.Background(), api.store, api.images, names...)
+	}
+}
+
+// deleteImageBlobs removes images and their thumbnails from `blobs`, logging failures
+func deleteImageBlobs(blobs BlobStore, names []string) {
+	for _, name := range names {
+		keys := []string{name}
+		for _, width := range thumbnailWidths {
+			keys = append(keys, thumbnailName(name, width))
+		}
+		for _, blob := range keys {
+			err := blobs.Delete(context.Background(), blob)
+			if err != nil {
+				log.Println("Error deleting image", blob+":", err)
+			}
+		}
+	}
+}
+
+// @Summary Get Image
+// @Description Serves an article image by a filename from the article's `images`.  Images never change, so may be cached.
+// @Description When images are kept in S3, redirects to a short-lived signed URL instead
+// @Param filename path string true "Image filename"
+// @Param width query integer false "Serve the narrowest thumbnail at least this wide, or the full image if none is"
+// @Produce png
+// @Produce jpeg
+// @Produce gif
+// @Success 200 {file} binary "The image"
+// @Success 302 "Redirect to a signed URL of the image"
+// @Success 304 "The client's cached copy is current"
+// @Failure 400 {object} main.ErrJSON "Invalid width"
+// @Failure 404 {object} main.ErrJSON "No such image"
+// @Failure 500 {object} main.ErrJSON "Internal error"
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Router /api/image/{filename} [GET]
+func (api *API) serveImage(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["filename"]
+	if !imageFilenameRe.MatchString(name) {
+		writeError("image not found", 404, w)
+		return
+	}
+	blob := name
+	if s := r.URL.Query().Get("width"); len(s) > 0 {
+		width, err := strconv.Atoi(s)
+		if err != nil || width < 1 {
+			writeError("invalid width", 400, w)
+			return
+		}
+		for _, thumbWidth := range thumbnailWidths {
+			if thumbWidth >= width {
+				blob = thumbnailName(name, thumbWidth)
+				break
+			}
+		}
+	}
+	if blob != name {
+		exists, err := api.images.Exists(r.Context(), blob)
+		if err != nil {
+			internalError("reading image", w, err)
+			return
+		} else if !exists {
+			// no thumbnail that wide, the image is narrower
+			blob = name
+		}
+	}
+
+	if signer, ok := api.images.(URLSigner); ok && api.imageURLExpiry > 0 {
+		exists, err := api.images.Exists(r.Context(), blob)
+		if err != nil {
+			internalError("reading image", w, err)
+			return
+		} else if !exists {
+			writeError("image not found", 404, w)
+			return
+		}
+		u, err := signer.SignedURL(r.Context(), blob, api.imageURLExpiry)
+		if err != nil {
+			internalError("signing image URL", w, err)
+			return
+		}
+		// the redirect must not outlive the URL
+		w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(api.imageURLExpiry/time.Second/2)))
+		http.Redirect(w, r, u, http.StatusFound)
+		return
+	}
+
+	etag := `"` + blob + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	data, err := api.images.Get(r.Context(), blob)
+	if err == errBlobNotFound {
+		writeError("image not found", 404, w)
+		return
+	} else if err != nil {
+		internalError("reading image", w, err)
+		return
+	}
+	w.Header().Set("Content-Type", imageTypes[filepath.Ext(name)])
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(imageMaxAge)+", immutable")
+	w.Header().Set("ETag", etag)
+	w.Write(data)
+}
+
+// ImageStats sums up stored images and how much storing each image once saves
+type ImageStats struct {
+	// Distinct images stored
+	Images int64 `json:"images" example:"10"`
+	// Bytes stored for them, thumbnails included
+	StoredBytes int64 `json:"stored_bytes" example:"1048576"`
+	// Images attached to articles, in the trash or not, counting each time an image is reused
+	References int64 `json:"references" example:"25"`
+	// Bytes the references would take if every one were stored separately
+	ReferencedBytes int64 `json:"referenced_bytes" example:"2621440"`
+	// ReferencedBytes - StoredBytes
+	SavedBytes int64 `json:"saved_bytes" example:"1572864"`
+}
+
+// RegisterImages records `images` as stored now, so CollectImages leaves them for `imageGracePeriod`
+func (db *DB) RegisterImages(ctx context.Context, images []Image) error {
+	if len(images) == 0 {
+		return nil
+	}
+	return db.run(ctx, func(ctx context.Context, c *DB) error {
+		return c.registerImages(ctx, images)
+	})
+}
+
+// registerImages records `images` in the `images` table, marking those already there as stored now
+func (db *DB) registerImages(ctx context.Context, images []Image) error {
+	s := "INSERT INTO images (Filename, Size, CreatedAt) VALUES (?,?,?)" + strings.Repeat(",(?,?,?)", len(images)-1)
+	switch db.dialect {
+	case dialectSQLite, dialectPostgres:
+		s += " ON CONFLICT (Filename) DO UPDATE SET CreatedAt=excluded.CreatedAt"
+	default:
+		s += " ON DUPLICATE KEY UPDATE CreatedAt=VALUES(CreatedAt)"
+	}
+	now := time.Now().UTC()
+	var params []interface{}
+	for _, img := range images {
+		params = append(params, img.Filename, img.Size, now)
+	}
+	_, err := db.Exec(ctx, s+";", params...)
+	return err
+}
+
+// CollectImages unregisters images no article references, in the trash or not, returning their filenames.  Only `names`
+// are considered if any are given.  Images stored in the last `imageGracePeriod` are kept, as an upload may be about to
+// use them.  `remove` deletes the images from the blob store before their rows go, while the rows are locked, so an
+// upload registering one of them again waits and writes it after it was removed
+func (db *DB) CollectImages(ctx context.Context, remove func([]string), names ...string) ([]string, error) {
+	cutoff := time.Now().UTC().Add(-imageGracePeriod)
+	var unused []string
+	err := db.run(ctx, func(ctx context.Context, c *DB) error {
+		return c.withTx(ctx, func(tx *DB) error {
+			unused = unused[:0]
+			s := "SELECT Filename FROM images WHERE CreatedAt < ?" +
+				" AND NOT EXISTS (SELECT 1 FROM article_images ai WHERE ai.Filename = images.Filename)"
+			params := []interface{}{cutoff}
+			if len(names) > 0 {
+				names = uniqueStrings(names)
+				s += " AND Filename IN (?" + strings.Repeat(",?", len(names)-1) + ")"
+				for _, name := range names {
+					params = append(params, name)
+				}
+			}
+			rows, err := tx.Query(ctx, s+tx.forUpdate()+";", params...)
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				var name string
+				if err = rows.Scan(&name); err != nil {
+					rows.Close()
+					return err
+				}
+				unused = append(unused, name)
+			}
+			rows.Close()
+			if err = rows.Err(); err != nil || len(unused) == 0 {
+				return err
+			}
+			remove(unused)
+			params = params[:0]
+			for _, name := range unused {
+				params = append(params, name)
+			}
+			_, err = tx.Exec(ctx, "DELETE FROM images WHERE Filename IN (?"+strings.Repeat(",?", len(unused)-1)+");", params...)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return unused, nil
+}
+
+// ImageStats sums up the images stored and referenced
+func (db *DB) ImageStats(ctx context.Context) (ImageStats, error) {
+	stats := ImageStats{}
+	err := db.read(ctx, func(ctx context.Context, c *DB) error {
+		err := c.QueryRow(ctx, "SELECT COUNT(*), COALESCE(SUM(Size), 0) FROM images;").Scan(&stats.Images, &stats.StoredBytes)
+		if err != nil {
+			return err
+		}
+		return c.QueryRow(ctx, "SELECT COUNT(*), COALESCE(SUM(i.Size), 0) FROM article_images ai"+
+			" INNER JOIN images i ON i.Filename = ai.Filename;").Scan(&stats.References, &stats.ReferencedBytes)
+	})
+	stats.SavedBytes = stats.ReferencedBytes - stats.StoredBytes
+	return stats, err
+}
+
+// collectImages deletes images no article references from `blobs`, from among `names` if any are given, logging
+// failures
+func collectImages(ctx context.Context, store Store, blobs BlobStore, names ...string) {
+	_, err := store.CollectImages(ctx, func(unused []string) { deleteImageBlobs(blobs, unused) }, names...)
+	if err != nil {
+		log.Println("Error collecting unused images:", err)
+	}
+}
+
+// AdminStats reports on storage
+type AdminStats struct {
+	Images ImageStats `json:"images"`
+}
+
+// @Summary Storage Stats
+// @Description Admins only.  Reports how many images are stored and how much storing each distinct image once saves
+// @Produce json
+// @Security Bearer
+// @Success 200 {object} main.AdminStats "Stats"
+// @Failure 401 {object} main.ErrJSON "Missing or invalid token"
+// @Failure 403 {object} main.ErrJSON "Role not allowed"
+// @Failure 500 {object} main.ErrJSON "Internal error"
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
+// @Router /api/admin/stats [GET]
+func (api *API) adminStats(w http.ResponseWriter, r *http.Request) {
+	images, err := api.store.ImageStats(r.Context())
+	if err != nil {
+		internalError("querying image stats", w, err)
+		return
+	}
+	resp, err := json.Marshal(AdminStats{Images: images})
+	if err != nil {
+		internalError("marshalling response", w, err)
+		return
+	}
+	w.Write(resp)
+}
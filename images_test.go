@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// testImage encodes a `w` by `h` gradient in `format`
+func testImage(t *testing.T, format string, w, h int) []byte {
+	m := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			m.Set(x, y, color.RGBA{uint8(x), uint8(y), 100, 255})
+		}
+	}
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, m)
+	case "jpeg":
+		err = jpeg.Encode(&buf, m, nil)
+	case "gif":
+		err = gif.Encode(&buf, m, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// imageSize decodes the width and height of image `data`, and its format
+func imageSize(t *testing.T, data []byte) (int, int, string) {
+	t.Helper()
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config.Width, config.Height, format
+}
+
+func TestProcessImage(t *testing.T) {
+	for _, c := range []struct {
+		format, ext string
+		w, h        int
+		thumbs      []int
+	}{
+		{"png", ".png", 600, 300, []int{160, 480}},
+		{"jpeg", ".jpg", 200, 100, []int{160}},
+		{"gif", ".gif", 160, 50, nil},
+	} {
+		ext, full, thumbs, err := processImage(testImage(t, c.format, c.w, c.h))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the format comes from the data, and is kept
+		if w, h, format := imageSize(t, full); ext != c.ext || format != c.format || w != c.w || h != c.h {
+			t.Errorf("%s processed as a %dx%d %s stored as %s", c.format, w, h, format, ext)
+		}
+		if len(thumbs) != len(c.thumbs) {
+			t.Errorf("%dx%d %s has %d thumbnails, want %v", c.w, c.h, c.format, len(thumbs), c.thumbs)
+		}
+		for _, width := range c.thumbs {
+			if w, h, format := imageSize(t, thumbs[width]); w != width || h != c.h*width/c.w || format != c.format {
+				t.Errorf("%d wide thumbnail of %dx%d %s is %dx%d %s", width, c.w, c.h, c.format, w, h, format)
+			}
+		}
+	}
+
+	for data, want := range map[string]string{
+		"not an image": "png, jpeg or gif",
+		string(testImage(t, "png", maxImageDimension+1, 1)): "4096x4096",
+		string(testImage(t, "gif", 1, maxImageDimension+1)): "4096x4096",
+		string(testImage(t, "png", 10, 10)[:60]):            "corrupt",
+	} {
+		_, _, _, err := processImage([]byte(data))
+		if rerr, ok := err.(*requestError); !ok || rerr.code != 400 || !strings.Contains(rerr.msg, want) {
+			t.Errorf("processing %.20q: got %v, want a 400 mentioning %q", data, err, want)
+		}
+	}
+}
+
+func TestDecodeImage(t *testing.T) {
+	for data, code := range map[string]int{
+		"":     400,
+		"!!":   400,
+		"AAAA": 0,
+		strings.Repeat("A", base64.StdEncoding.EncodedLen(maxImageSize+3)): 413,
+	} {
+		_, err := decodeImage(Image{Data: data})
+		if code == 0 {
+			if err != nil {
+				t.Errorf("decoding %q: %v", data, err)
+			}
+		} else if rerr, ok := err.(*requestError); !ok || rerr.code != code {
+			t.Errorf("decoding %d characters: got %v, want code %d", len(data), err, code)
+		}
+	}
+}
+
+func TestScaleImage(t *testing.T) {
+	// each pixel of the 2x1 result averages two columns of the 4x2 source
+	src := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for ii := range src.Pix {
+		src.Pix[ii] = uint8(ii % 4 * 60)
+	}
+	src.Pix[0] = 100
+	dst := scaleImage(src, 2)
+	if b := dst.Bounds(); b.Dx() != 2 || b.Dy() != 1 {
+		t.Fatalf("scaled to %dx%d", b.Dx(), b.Dy())
+	}
+	if !bytes.Equal(dst.Pix, []uint8{25, 60, 120, 180, 0, 60, 120, 180}) {
+		t.Errorf("scaled pixels %v", dst.Pix)
+	}
+	// of a sub-image, only its own pixels
+	sub := toRGBA(src.SubImage(image.Rect(2, 0, 4, 2)))
+	if dst := scaleImage(sub, 1); !bytes.Equal(dst.Pix, []uint8{0, 60, 120, 180}) {
+		t.Errorf("scaled sub-image pixels %v", dst.Pix)
+	}
+	// very wide images are at least a pixel tall
+	if dst := scaleImage(image.NewRGBA(image.Rect(0, 0, 1000, 1)), 10); dst.Bounds().Dy() != 1 {
+		t.Errorf("scaled to %d pixels tall", dst.Bounds().Dy())
+	}
+}
+
+func TestServeImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blobs, err := NewFSBlobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	ext, full, thumbs, err := processImage(testImage(t, "png", 600, 300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := imageFilename(full, ext)
+	if err = blobs.Put(ctx, name, full); err != nil {
+		t.Fatal(err)
+	}
+	for width, thumb := range thumbs {
+		if err = blobs.Put(ctx, thumbnailName(name, width), thumb); err != nil {
+			t.Fatal(err)
+		}
+	}
+	api := &API{images: blobs}
+	serve := func(filename, query, etag string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/image/"+filename+query, nil)
+		if len(etag) > 0 {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		api.serveImage(w, mux.SetURLVars(r, map[string]string{"filename": filename}))
+		return w
+	}
+
+	w := serve(name, "", "")
+	if w.Code != 200 || w.Header().Get("Content-Type") != "image/png" || !strings.Contains(w.Header().Get("Cache-Control"), "immutable") {
+		t.Errorf("image served with %d, %q cached %q", w.Code, w.Header().Get("Content-Type"), w.Header().Get("Cache-Control"))
+	}
+	// the narrowest thumbnail at least as wide as asked for, or the full image
+	for query, want := range map[string]int{"?width=100": 160, "?width=160": 160, "?width=200": 480, "?width=1000": 600} {
+		w := serve(name, query, "")
+		if width, _, _ := imageSize(t, w.Body.Bytes()); w.Code != 200 || width != want {
+			t.Errorf("%s served %d wide with %d, want %d", query, width, w.Code, want)
+		}
+	}
+	if w := serve(name, "?width=200", `"`+thumbnailName(name, 480)+`"`); w.Code != 304 || w.Body.Len() > 0 {
+		t.Errorf("cached thumbnail served with %d", w.Code)
+	}
+	if w := serve(name, "?width=200", `"`+name+`"`); w.Code != 200 {
+		t.Errorf("thumbnail cached as the full image served with %d", w.Code)
+	}
+	for _, c := range []struct {
+		filename, query string
+		code            int
+	}{
+		{name, "?width=x", 400},
+		{name, "?width=0", 400},
+		{"x.png", "", 404},
+		{"../" + name, "", 404},
+		{strings.Repeat("0", 64) + ".png", "", 404},
+		{strings.TrimSuffix(name, ".png") + ".gif", "?width=100", 404},
+	} {
+		if w := serve(c.filename, c.query, ""); w.Code != c.code {
+			t.Errorf("%s%s served with %d, want %d", c.filename, c.query, w.Code, c.code)
+		}
+	}
+}
+
+func TestCollectImagesReregistered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(grace time.Duration) { imageGracePeriod = grace }(imageGracePeriod)
+	imageGracePeriod = -time.Minute
+	for name, store := range testStores(t, dir) {
+		t.Run(name, func(t *testing.T) {
+			defer store.Close()
+			ctx := context.Background()
+			blobs, err := NewFSBlobStore(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			img := []Image{{Filename: "a.png", Size: 3}}
+			if err := store.RegisterImages(ctx, img); err != nil {
+				t.Fatal(err)
+			}
+			if err := blobs.Put(ctx, "a.png", []byte("png")); err != nil {
+				t.Fatal(err)
+			}
+
+			// an upload of the same image stores it again while the collector is deleting it
+			uploaded := make(chan error, 1)
+			remove := func(unused []string) {
+				go func() {
+					err := store.RegisterImages(ctx, img)
+					if err == nil {
+						err = blobs.Put(ctx, "a.png", []byte("png"))
+					}
+					uploaded <- err
+				}()
+				time.Sleep(50 * time.Millisecond)
+				deleteImageBlobs(blobs, unused)
+			}
+			unused, err := store.CollectImages(ctx, remove)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(unused) != 1 || unused[0] != "a.png" {
+				t.Fatal("collected", unused)
+			}
+			if err := <-uploaded; err != nil {
+				t.Fatal(err)
+			}
+
+			if ok, err := blobs.Exists(ctx, "a.png"); err != nil || !ok {
+				t.Error("uploaded image deleted:", err)
+			}
+			stats, err := store.ImageStats(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Images != 1 {
+				t.Errorf("%d images registered, want 1", stats.Images)
+			}
+		})
+	}
+}
+
+func TestStoreImagesDedupe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	chart := base64.StdEncoding.EncodeToString(testImage(t, "png", 300, 200))
+	shot := base64.StdEncoding.EncodeToString(testImage(t, "gif", 50, 50))
+	for name, store := range testStores(t, dir) {
+		t.Run(name, func(t *testing.T) {
+			defer store.Close()
+			ctx := context.Background()
+			blobDir := filepath.Join(dir, name+"-images")
+			blobs, err := NewFSBlobStore(blobDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored := func() int {
+				files, err := ioutil.ReadDir(blobDir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return len(files)
+			}
+			api := &API{store: store, images: blobs}
+			upload := func(article UploadArticle) int64 {
+				t.Helper()
+				if err := api.storeImages(ctx, article.Images); err != nil {
+					t.Fatal(err)
+				}
+				id, err := store.InsertArticle(ctx, article)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return id
+			}
+
+			// the same image uploaded twice is stored once, under the same name
+			a := UploadArticle{Name: "a", Images: []Image{{Data: chart}}}
+			b := UploadArticle{Name: "b", Images: []Image{{Data: chart}, {Data: shot}}}
+			upload(a)
+			bID := upload(b)
+			if a.Images[0].Filename != b.Images[0].Filename || !imageFilenameRe.MatchString(a.Images[0].Filename) {
+				t.Errorf("same image stored as %s and %s", a.Images[0].Filename, b.Images[0].Filename)
+			}
+			if b.Images[1].Filename == b.Images[0].Filename {
+				t.Error("different images stored under the same name")
+			}
+			// the chart, its one thumbnail and the shot
+			if n := stored(); n != 3 {
+				t.Errorf("%d blobs stored, want 3", n)
+			}
+			stats, err := store.ImageStats(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := ImageStats{
+				Images:          2,
+				StoredBytes:     a.Images[0].Size + b.Images[1].Size,
+				References:      3,
+				ReferencedBytes: 2*a.Images[0].Size + b.Images[1].Size,
+				SavedBytes:      a.Images[0].Size,
+			}
+			if stats != want {
+				t.Errorf("stats %+v, want %+v", stats, want)
+			}
+
+			// an image is collected once no article uses it, trashed articles included
+			defer func(grace time.Duration) { imageGracePeriod = grace }(imageGracePeriod)
+			imageGracePeriod = -time.Minute
+			if err = store.RemoveArticle(ctx, bID); err != nil {
+				t.Fatal(err)
+			}
+			purgeTrash(ctx, store, blobs, 0)
+			if n := stored(); n != 3 {
+				t.Errorf("%d blobs left after trashing, want 3", n)
+			}
+			time.Sleep(time.Millisecond)
+			purgeTrash(ctx, store, blobs, time.Nanosecond)
+			if n := stored(); n != 2 {
+				t.Errorf("%d blobs left after purging, want the chart and its thumbnail", n)
+			}
+			if stats, err = store.ImageStats(ctx); err != nil || stats.Images != 1 || stats.SavedBytes != 0 {
+				t.Errorf("stats %+v, %v", stats, err)
+			}
+		})
+	}
+}
+
+func TestCollectImagesGracePeriod(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(grace time.Duration) { imageGracePeriod = grace }(imageGracePeriod)
+	for name, store := range testStores(t, dir) {
+		t.Run(name, func(t *testing.T) {
+			defer store.Close()
+			ctx := context.Background()
+			imageGracePeriod = time.Hour
+			images := []Image{{Filename: "a.png", Size: 3}, {Filename: "b.png", Size: 4}}
+			if err := store.RegisterImages(ctx, images); err != nil {
+				t.Fatal(err)
+			}
+			// registering again, as a second upload of the same image does, is no error
+			if err := store.RegisterImages(ctx, images[:1]); err != nil {
+				t.Fatal(err)
+			}
+			var removed []string
+			remove := func(unused []string) { removed = append(removed, unused...) }
+			if unused, err := store.CollectImages(ctx, remove); err != nil || len(unused) != 0 || len(removed) != 0 {
+				t.Fatalf("collected %v within the grace period: %v", unused, err)
+			}
+
+			imageGracePeriod = -time.Minute
+			unused, err := store.CollectImages(ctx, remove, "a.png", "a.png", "never.png")
+			if err != nil || !reflect.DeepEqual(unused, []string{"a.png"}) || !reflect.DeepEqual(removed, unused) {
+				t.Fatalf("collected %v and removed %v of those named: %v", unused, removed, err)
+			}
+			unused, err = store.CollectImages(ctx, remove)
+			if err != nil || !reflect.DeepEqual(unused, []string{"b.png"}) {
+				t.Fatalf("collected %v of all: %v", unused, err)
+			}
+			if stats, err := store.ImageStats(ctx); err != nil || stats != (ImageStats{}) {
+				t.Errorf("stats %+v, %v", stats, err)
+			}
+		})
+	}
+}
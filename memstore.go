@@ -0,0 +1,1078 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	errMemNameNull      = errors.New("column 'Name' cannot be null")
+	errMemDuplicateTag  = errors.New("duplicate entry for key 'Name'")
+	errMemDuplicateLink = errors.New("duplicate entry for key 'PRIMARY'")
+	errMemForeignKey    = errors.New("cannot add or update a child row: a foreign key constraint fails")
+)
+
+// MemStore is an in-memory Store with the same search/order/limit semantics as the MySQL backed `DB`.
+// Contents are lost when the process exits
+type MemStore struct {
+	// writer serializes writes and transactions.  mu guards the maps below so reads can run during a transaction
+	writer sync.Mutex
+	mu     sync.RWMutex
+
+	articles map[int64]DBArticle
+	tags     map[int64]DBTag
+	// article ID -> set of tag IDs
+	links map[int64]map[int64]bool
+	// article or tag ID -> its revisions, oldest first
+	articleRevisions map[int64][]ArticleRevision
+	tagRevisions     map[int64][]TagRevision
+	// image filename -> bytes stored for it, once however many articles use it, and when it was last stored
+	images map[string]memImage
+	users  map[int64]User
+	// session ID -> session, until it expires
+	sessions map[string]Session
+
+	nextArticleID         int64
+	nextTagID             int64
+	nextArticleRevisionID int64
+	nextTagRevisionID     int64
+	nextUserID            int64
+
+	created time.Time
+}
+
+// NewMemStore creates an empty in-memory store
+func NewMemStore() *MemStore {
+	return &MemStore{
+		articles:              make(map[int64]DBArticle),
+		tags:                  make(map[int64]DBTag),
+		links:                 make(map[int64]map[int64]bool),
+		articleRevisions:      make(map[int64][]ArticleRevision),
+		tagRevisions:          make(map[int64][]TagRevision),
+		images:                make(map[string]memImage),
+		users:                 make(map[int64]User),
+		sessions:              make(map[string]Session),
+		nextArticleID:         1,
+		nextTagID:             1,
+		nextArticleRevisionID: 1,
+		nextTagRevisionID:     1,
+		nextUserID:            1,
+		created:               time.Now(),
+	}
+}
+
+// Init is a no-op.  Tables always exist in memory
+func (m *MemStore) Init() {
+	fmt.Println("Initializing in-memory store...")
+}
+
+// Close is a no-op
+func (m *MemStore) Close() error {
+	return nil
+}
+
+// ConnState always reports the store up.  There is no connection to lose
+func (m *MemStore) ConnState() ConnState {
+	return ConnState{Status: connUp, Since: m.created, CheckedAt: time.Now()}
+}
+
+// lockWrite takes the locks needed to modify the store, returning a function releasing them
+func (m *MemStore) lockWrite() func() {
+	m.writer.Lock()
+	m.mu.Lock()
+	return func() {
+		m.mu.Unlock()
+		m.writer.Unlock()
+	}
+}
+
+// clone returns a deep copy of the store.  Caller must hold `m.mu`
+func (m *MemStore) clone() *MemStore {
+	c := NewMemStore()
+	for id, a := range m.articles {
+		c.articles[id] = a
+	}
+	for id, t := range m.tags {
+		c.tags[id] = t
+	}
+	for id, tagIDs := range m.links {
+		c.links[id] = make(map[int64]bool)
+		for tagID := range tagIDs {
+			c.links[id][tagID] = true
+		}
+	}
+	// revisions are immutable, so the slices only need copying to be appended to
+	for id, revisions := range m.articleRevisions {
+		c.articleRevisions[id] = append([]ArticleRevision{}, revisions...)
+	}
+	for id, revisions := range m.tagRevisions {
+		c.tagRevisions[id] = append([]TagRevision{}, revisions...)
+	}
+	for name, img := range m.images {
+		c.images[name] = img
+	}
+	for id, u := range m.users {
+		c.users[id] = u
+	}
+	for id, s := range m.sessions {
+		c.sessions[id] = s
+	}
+	c.nextArticleID = m.nextArticleID
+	c.nextTagID = m.nextTagID
+	c.nextArticleRevisionID, c.nextTagRevisionID = m.nextArticleRevisionID, m.nextTagRevisionID
+	c.nextUserID = m.nextUserID
+	return c
+}
+
+// WithTx runs `fn` against a copy of the store, replacing the store's contents with the copy if `fn` returns nil
+// before `ctx` ends.  Other writers wait for the transaction to finish, readers see the contents from before it
+func (m *MemStore) WithTx(ctx context.Context, fn func(Store) error) error {
+	m.writer.Lock()
+	defer m.writer.Unlock()
+
+	m.mu.RLock()
+	tx := m.clone()
+	m.mu.RUnlock()
+
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+	if err = ctx.Err(); err != nil {
+		// like a SQL transaction rolled back by its context
+		return err
+	}
+
+	m.mu.Lock()
+	m.articles, m.tags, m.links = tx.articles, tx.tags, tx.links
+	m.articleRevisions, m.tagRevisions = tx.articleRevisions, tx.tagRevisions
+	m.images, m.users, m.sessions = tx.images, tx.users, tx.sessions
+	m.nextArticleID, m.nextTagID = tx.nextArticleID, tx.nextTagID
+	m.nextArticleRevisionID, m.nextTagRevisionID = tx.nextArticleRevisionID, tx.nextTagRevisionID
+	m.nextUserID = tx.nextUserID
+	m.mu.Unlock()
+	return nil
+}
+
+// checkLen mirrors MySQL strict mode rejecting values longer than a VARCHAR column
+func checkLen(column, s string, max int) error {
+	if utf8.RuneCountInString(s) > max {
+		return fmt.Errorf("data too long for column '%s'", column)
+	}
+	return nil
+}
+
+func checkArticle(a UploadArticle) error {
+	if len(a.Name) == 0 {
+		return errMemNameNull
+	}
+	if err := checkLen("Name", a.Name, 512); err != nil {
+		return err
+	}
+	if err := checkLen("URL", a.URL, 512); err != nil {
+		return err
+	}
+	return checkLen("Description", a.Description, 1024)
+}
+
+func checkTag(t UploadTag) error {
+	if len(t.Name) == 0 {
+		return errMemNameNull
+	}
+	if err := checkLen("Name", t.Name, 16); err != nil {
+		return err
+	}
+	return checkLen("Description", t.Description, 256)
+}
+
+// tagByName compares names case-insensitively like MySQL's default collation, including tags in the trash.
+// Caller must hold `m.mu`
+func (m *MemStore) tagByName(name string) (DBTag, bool) {
+	for _, t := range m.tags {
+		if strings.EqualFold(t.Name, name) {
+			return t, true
+		}
+	}
+	return DBTag{}, false
+}
+
+// tagIDByName is tagByName ignoring tags in the trash.  Caller must hold `m.mu`
+func (m *MemStore) tagIDByName(name string) (int64, bool) {
+	t, ok := m.tagByName(name)
+	if !ok || t.DeletedAt != nil {
+		return 0, false
+	}
+	return t.ID, true
+}
+
+// TagNameExists checks if a tag named `s` exists and is not in the trash, returning the tag ID && true/false
+func (m *MemStore) TagNameExists(ctx context.Context, s string) (int64, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.tagIDByName(s)
+}
+
+// TagNamesExist is TagNameExists in a loop
+func (m *MemStore) TagNamesExist(ctx context.Context, s ...string) ([]int64, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	res := []int64{}
+	for _, t := range s {
+		id, exists := m.tagIDByName(t)
+		if !exists {
+			return []int64{}, false
+		}
+		res = append(res, id)
+	}
+	return res, true
+}
+
+// articleTags returns tags linked to an article ordered by tag ID, except those in the trash.  Caller must hold `m.mu`
+func (m *MemStore) articleTags(id int64) []DBTag {
+	tags := []DBTag{}
+	for tagID := range m.links[id] {
+		if t, ok := m.tags[tagID]; ok && t.DeletedAt == nil {
+			tags = append(tags, t)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].ID < tags[j].ID })
+	return tags
+}
+
+// withTags returns a copy of `a` with its tag names filled in.  Caller must hold `m.mu`
+func (m *MemStore) withTags(a DBArticle) DBArticle {
+	for _, t := range m.articleTags(a.ID) {
+		a.Tags = append(a.Tags, t.Name)
+	}
+	return a
+}
+
+// ArticleTags finds all tags associated with an article ID
+func (m *MemStore) ArticleTags(ctx context.Context, id int64) ([]DBTag, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.articleTags(id), nil
+}
+
+// likeMatcher builds a case-insensitive matcher equivalent to `LIKE CONCAT('%',s,'%')`
+func likeMatcher(s string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("(?is)")
+	escaped := false
+	for _, c := range s {
+		switch {
+		case escaped:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '%':
+			b.WriteString(".*")
+		case c == '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if escaped {
+		b.WriteString(regexp.QuoteMeta("\\"))
+	}
+	return regexp.MustCompile(b.String())
+}
+
+// matchesLike reports whether `name` or `description` match; an empty description is NULL and never matches
+func matchesLike(re *regexp.Regexp, name, description string) bool {
+	return re.MatchString(name) || (len(description) > 0 && re.MatchString(description))
+}
+
+// lessBy compares two rows by the column `findOrderby` would pick, then by ID like `orderBy`
+func lessBy(orderby string, id1 int64, name1, desc1 string, id2 int64, name2, desc2 string) bool {
+	var a, b string
+	switch findOrderby(orderby) {
+	case "Name":
+		a, b = strings.ToLower(name1), strings.ToLower(name2)
+	case "Description":
+		a, b = strings.ToLower(desc1), strings.ToLower(desc2)
+	}
+	if a != b {
+		return a < b
+	}
+	return id1 < id2
+}
+
+// page applies LIMIT/OFFSET the same way the SQL queries do: `offset` does nothing unless `limit` is specified
+func page(n, limit, offset int) (int, int) {
+	if limit <= 0 {
+		return 0, n
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > n {
+		offset = n
+	}
+	end := offset + limit
+	if end > n {
+		end = n
+	}
+	return offset, end
+}
+
+// ArticlesWithTagsSearch returns `limit` articles whose tags match all supplied tags and `tq` if it is not nil, offset by `offset`, whose names OR description match `lookslike`.
+// Results start after `after` if it is not nil.  The total counts every match, ignoring `after`, `limit` and `offset`,
+// whether or not `withTotal` is set
+func (m *MemStore) ArticlesWithTagsSearch(ctx context.Context, tags []string, tq tagQuery, lookslike, orderby string, reverse bool, after *searchCursor, limit, offset int, withTotal bool) ([]DBArticle, int, error) {
+	return m.articleSearch(tags, tq, nil, lookslike, orderby, reverse, after, limit, offset)
+}
+
+// ArticlesFullTextSearch is ArticlesWithTagsSearch restricted to articles matching the full-text `query`.
+// Results are ordered by relevance unless `orderby` says otherwise
+func (m *MemStore) ArticlesFullTextSearch(ctx context.Context, tags []string, tq tagQuery, query, lookslike, orderby string, reverse bool, after *searchCursor, limit, offset int, withTotal bool) ([]DBArticle, int, error) {
+	q := parseFullText(query)
+	if q.empty() {
+		return []DBArticle{}, 0, nil
+	}
+	return m.articleSearch(tags, tq, &q, lookslike, orderby, reverse, after, limit, offset)
+}
+
+// articleSearch is ArticlesWithTagsSearch, additionally matching the full-text query `ft` if it is not nil
+func (m *MemStore) articleSearch(tags []string, tq tagQuery, ft *fullTextQuery, lookslike, orderby string, reverse bool, after *searchCursor, limit, offset int) ([]DBArticle, int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var re *regexp.Regexp
+	if len(lookslike) > 0 {
+		re = likeMatcher(lookslike)
+	}
+
+	articles := []DBArticle{}
+	total := 0
+	relevance := make(map[int64]int)
+	for _, a := range m.articles {
+		if a.DeletedAt != nil {
+			continue
+		}
+		if tq != nil && !tq.matches(m.withTags(a).Tags) {
+			continue
+		}
+		if len(tags) > 0 {
+			// mirrors `HAVING COUNT(a.ID)=len(tags)`
+			count := 0
+			for _, t := range m.articleTags(a.ID) {
+				for _, name := range tags {
+					if strings.EqualFold(t.Name, name) {
+						count++
+						break
+					}
+				}
+			}
+			if count != len(tags) {
+				continue
+			}
+		}
+		if re != nil && !matchesLike(re, a.Name, a.Description) {
+			continue
+		}
+		if ft != nil {
+			score := fullTextScore(*ft, a.Name, a.Description)
+			if score == 0 {
+				continue
+			}
+			relevance[a.ID] = score
+		}
+		total++
+		if after != nil && !afterCursor(after, a.ID, a.Name, a.Description) {
+			continue
+		}
+		articles = append(articles, a)
+	}
+
+	sort.Slice(articles, func(i, j int) bool { return articles[i].ID < articles[j].ID })
+	if ft != nil && (len(orderby) == 0 || findOrderby(orderby) == "Relevance") {
+		// most relevant first unless reversed
+		sort.SliceStable(articles, func(i, j int) bool {
+			if reverse {
+				return relevance[articles[i].ID] < relevance[articles[j].ID]
+			}
+			return relevance[articles[i].ID] > relevance[articles[j].ID]
+		})
+	} else if len(orderby) > 0 || reverse {
+		sort.SliceStable(articles, func(i, j int) bool {
+			a, b := articles[i], articles[j]
+			if reverse {
+				a, b = b, a
+			}
+			return lessBy(orderby, a.ID, a.Name, a.Description, b.ID, b.Name, b.Description)
+		})
+	}
+
+	start, end := page(len(articles), limit, offset)
+	articles = articles[start:end]
+	for ii := range articles {
+		articles[ii] = m.withTags(articles[ii])
+	}
+	return articles, total, nil
+}
+
+// TagSearch returns `limit` tags whose names are in `tags`, offset by `offset`, whose names match `lookslike`, and how many match in all
+func (m *MemStore) TagSearch(ctx context.Context, tags []string, lookslike, orderby string, reverse bool, after *searchCursor, limit int, offset int, withTotal bool) ([]DBTag, int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var re *regexp.Regexp
+	if len(lookslike) > 0 {
+		re = likeMatcher(lookslike)
+	}
+
+	rtags := []DBTag{}
+	total := 0
+	for _, t := range m.tags {
+		if t.DeletedAt != nil {
+			continue
+		}
+		if len(tags) > 0 {
+			found := false
+			for _, name := range tags {
+				if strings.EqualFold(t.Name, name) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		if re != nil && !matchesLike(re, t.Name, t.Description) {
+			continue
+		}
+		total++
+		if after != nil && !afterCursor(after, t.ID, t.Name, t.Description) {
+			continue
+		}
+		rtags = append(rtags, t)
+	}
+
+	sort.Slice(rtags, func(i, j int) bool { return rtags[i].ID < rtags[j].ID })
+	if len(orderby) > 0 || reverse {
+		sort.SliceStable(rtags, func(i, j int) bool {
+			a, b := rtags[i], rtags[j]
+			if reverse {
+				a, b = b, a
+			}
+			return lessBy(orderby, a.ID, a.Name, a.Description, b.ID, b.Name, b.Description)
+		})
+	}
+
+	start, end := page(len(rtags), limit, offset)
+	return rtags[start:end], total, nil
+}
+
+// ArticleByID searches for an articles with an ID, returning `nil` if not found or in the trash
+func (m *MemStore) ArticleByID(ctx context.Context, id int64) (*DBArticle, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	a, ok := m.articles[id]
+	if !ok || a.DeletedAt != nil {
+		return nil, nil
+	}
+	a = m.withTags(a)
+	return &a, nil
+}
+
+// TagByID searches for a tag with an ID, returning `nil` if not found or in the trash
+func (m *MemStore) TagByID(ctx context.Context, id int64) (*DBTag, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	t, ok := m.tags[id]
+	if !ok || t.DeletedAt != nil {
+		return nil, nil
+	}
+	return &t, nil
+}
+
+// insertLink links an article to a tag.  Caller must hold `m.mu` for writing
+func (m *MemStore) insertLink(articleID, tagID int64) error {
+	if m.links[articleID][tagID] {
+		return errMemDuplicateLink
+	}
+	if _, ok := m.articles[articleID]; !ok {
+		return errMemForeignKey
+	}
+	if _, ok := m.tags[tagID]; !ok {
+		return errMemForeignKey
+	}
+	if m.links[articleID] == nil {
+		m.links[articleID] = make(map[int64]bool)
+	}
+	m.links[articleID][tagID] = true
+	return nil
+}
+
+// InsertArticleTag links an article to a tag.  The link table has no auto increment column so the returned ID is always 0
+func (m *MemStore) InsertArticleTag(ctx context.Context, articleID int64, tagID int64) (int64, error) {
+	defer m.lockWrite()()
+	return 0, m.insertLink(articleID, tagID)
+}
+
+// InsertArticleTags updates an article's tags.  No links are inserted if any would be a duplicate
+func (m *MemStore) InsertArticleTags(ctx context.Context, id int64, tagIDs []int64) error {
+	defer m.lockWrite()()
+	seen := make(map[int64]bool)
+	for _, tagID := range tagIDs {
+		if seen[tagID] || m.links[id][tagID] {
+			return errMemDuplicateLink
+		}
+		if _, ok := m.tags[tagID]; !ok {
+			return errMemForeignKey
+		}
+		seen[tagID] = true
+	}
+	if _, ok := m.articles[id]; !ok && len(tagIDs) > 0 {
+		return errMemForeignKey
+	}
+	for _, tagID := range tagIDs {
+		m.insertLink(id, tagID)
+	}
+	return nil
+}
+
+// InsertArticle inserts an article, linking its tags and returning the article's ID.
+// Returns `errTagsNotExist` without inserting anything if any tag does not exist
+func (m *MemStore) InsertArticle(ctx context.Context, a UploadArticle) (int64, error) {
+	defer m.lockWrite()()
+	tagIDs := []int64{}
+	for _, t := range a.Tags {
+		tagID, ok := m.tagIDByName(t)
+		if !ok {
+			return 0, errTagsNotExist
+		}
+		tagIDs = append(tagIDs, tagID)
+	}
+	if err := checkArticle(a); err != nil {
+		return 0, err
+	}
+	id := m.nextArticleID
+	m.nextArticleID++
+	m.articles[id] = DBArticle{
+		ID:          id,
+		Name:        a.Name,
+		URL:         a.URL,
+		Description: a.Description,
+		Images:      m.registerImages(a.Images),
+	}
+	for _, tagID := range uniqueIDs(tagIDs) {
+		m.insertLink(id, tagID)
+	}
+	return id, nil
+}
+
+// InsertTag inserts a tag, returning ID of inserted element.
+// Returns `errTagInTrash` if a tag in the trash has the same name
+func (m *MemStore) InsertTag(ctx context.Context, t UploadTag) (int64, error) {
+	if err := checkTag(t); err != nil {
+		return 0, err
+	}
+	defer m.lockWrite()()
+	if other, exists := m.tagByName(t.Name); exists && other.DeletedAt != nil {
+		return 0, errTagInTrash
+	} else if exists {
+		return 0, errMemDuplicateTag
+	}
+	id := m.nextTagID
+	m.nextTagID++
+	m.tags[id] = DBTag{
+		ID:          id,
+		Name:        t.Name,
+		Description: t.Description,
+	}
+	return id, nil
+}
+
+// RemoveArticleTags removes all article-tag links by articleID, except links to tags in the trash which are kept for
+// when the tag is restored
+func (m *MemStore) RemoveArticleTags(ctx context.Context, articleID int64) error {
+	defer m.lockWrite()()
+	for tagID := range m.links[articleID] {
+		if m.tags[tagID].DeletedAt == nil {
+			delete(m.links[articleID], tagID)
+		}
+	}
+	return nil
+}
+
+// RemoveTagsFromArticles removes all article-tag links by tagID
+func (m *MemStore) RemoveTagsFromArticles(ctx context.Context, tagID int64) error {
+	defer m.lockWrite()()
+	for _, tagIDs := range m.links {
+		delete(tagIDs, tagID)
+	}
+	return nil
+}
+
+// RemoveArticle moves an article to the trash.  Its article-tag links are kept until it is purged
+func (m *MemStore) RemoveArticle(ctx context.Context, id int64) error {
+	defer m.lockWrite()()
+	if a, ok := m.articles[id]; ok && a.DeletedAt == nil {
+		now := time.Now().UTC()
+		a.DeletedAt = &now
+		m.articles[id] = a
+	}
+	return nil
+}
+
+// RemoveTag moves a tag to the trash.  Its article-tag links are kept until it is purged
+func (m *MemStore) RemoveTag(ctx context.Context, id int64) error {
+	defer m.lockWrite()()
+	if t, ok := m.tags[id]; ok && t.DeletedAt == nil {
+		now := time.Now().UTC()
+		t.DeletedAt = &now
+		m.tags[id] = t
+	}
+	return nil
+}
+
+// trashedFirst orders rows most recently deleted first, then by descending ID like TrashedArticles' ORDER BY
+func trashedFirst(deleted1 *time.Time, id1 int64, deleted2 *time.Time, id2 int64) bool {
+	if !deleted1.Equal(*deleted2) {
+		return deleted1.After(*deleted2)
+	}
+	return id1 > id2
+}
+
+// TrashedArticles returns `limit` articles in the trash, most recently deleted first, offset by `offset`
+func (m *MemStore) TrashedArticles(ctx context.Context, limit, offset int) ([]DBArticle, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	articles := []DBArticle{}
+	for _, a := range m.articles {
+		if a.DeletedAt != nil {
+			articles = append(articles, m.withTags(a))
+		}
+	}
+	sort.Slice(articles, func(i, j int) bool {
+		return trashedFirst(articles[i].DeletedAt, articles[i].ID, articles[j].DeletedAt, articles[j].ID)
+	})
+	start, end := page(len(articles), limit, offset)
+	return articles[start:end], nil
+}
+
+// TrashedTags returns `limit` tags in the trash, most recently deleted first, offset by `offset`
+func (m *MemStore) TrashedTags(ctx context.Context, limit, offset int) ([]DBTag, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	tags := []DBTag{}
+	for _, t := range m.tags {
+		if t.DeletedAt != nil {
+			tags = append(tags, t)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return trashedFirst(tags[i].DeletedAt, tags[i].ID, tags[j].DeletedAt, tags[j].ID)
+	})
+	start, end := page(len(tags), limit, offset)
+	return tags[start:end], nil
+}
+
+// RestoreArticle takes an article out of the trash along with its article-tag links, reporting whether it was in the trash
+func (m *MemStore) RestoreArticle(ctx context.Context, id int64) (bool, error) {
+	defer m.lockWrite()()
+	a, ok := m.articles[id]
+	if !ok || a.DeletedAt == nil {
+		return false, nil
+	}
+	a.DeletedAt = nil
+	m.articles[id] = a
+	return true, nil
+}
+
+// RestoreTag takes a tag out of the trash along with its article-tag links, reporting whether it was in the trash
+func (m *MemStore) RestoreTag(ctx context.Context, id int64) (bool, error) {
+	defer m.lockWrite()()
+	t, ok := m.tags[id]
+	if !ok || t.DeletedAt == nil {
+		return false, nil
+	}
+	t.DeletedAt = nil
+	m.tags[id] = t
+	return true, nil
+}
+
+// PurgeTrash permanently removes articles and tags moved to the trash before `before` and, like ON DELETE CASCADE,
+// their article-tag links.  Their revisions are kept.  Returns how many were removed
+func (m *MemStore) PurgeTrash(ctx context.Context, before time.Time) (int64, error) {
+	defer m.lockWrite()()
+	var purged int64
+	for id, a := range m.articles {
+		if a.DeletedAt != nil && a.DeletedAt.Before(before) {
+			delete(m.articles, id)
+			delete(m.links, id)
+			purged++
+		}
+	}
+	for id, t := range m.tags {
+		if t.DeletedAt != nil && t.DeletedAt.Before(before) {
+			delete(m.tags, id)
+			for _, tagIDs := range m.links {
+				delete(tagIDs, id)
+			}
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// UpdateArticle updates an article's information, BUT NOT TAGS.  Its images are replaced unless `article.Images` is nil
+func (m *MemStore) UpdateArticle(ctx context.Context, id int64, article UploadArticle) error {
+	if err := checkArticle(article); err != nil {
+		return err
+	}
+	defer m.lockWrite()()
+	old, ok := m.articles[id]
+	if !ok {
+		return nil
+	}
+	images := old.Images
+	if article.Images != nil {
+		images = m.registerImages(article.Images)
+	}
+	m.articles[id] = DBArticle{
+		ID:          id,
+		Name:        article.Name,
+		URL:         article.URL,
+		Description: article.Description,
+		Images:      images,
+	}
+	return nil
+}
+
+// memImage is a registered image
+type memImage struct {
+	size   int64
+	stored time.Time
+}
+
+// RegisterImages records `images` as stored now, so CollectImages leaves them for `imageGracePeriod`
+func (m *MemStore) RegisterImages(ctx context.Context, images []Image) error {
+	defer m.lockWrite()()
+	m.registerImages(images)
+	return nil
+}
+
+// registerImages records `images` in `m.images` as stored now and lists their filenames as the SQL backends return them,
+// nil if there are none.  Caller must hold `m.mu`
+func (m *MemStore) registerImages(images []Image) []string {
+	if len(images) == 0 {
+		return nil
+	}
+	now := time.Now()
+	for _, img := range images {
+		m.images[img.Filename] = memImage{size: img.Size, stored: now}
+	}
+	return imageFilenames(images)
+}
+
+// imageRefs counts the articles, in the trash or not, using each image.  Caller must hold `m.mu`
+func (m *MemStore) imageRefs() map[string]int64 {
+	refs := make(map[string]int64)
+	for _, a := range m.articles {
+		for _, name := range a.Images {
+			refs[name]++
+		}
+	}
+	return refs
+}
+
+// CollectImages unregisters images no article references, in the trash or not, returning their filenames.  Only `names`
+// are considered if any are given.  Images stored in the last `imageGracePeriod` are kept, as an upload may be about to
+// use them.  `remove` deletes the images from the blob store first, holding the lock so none can be registered again
+// until they are gone
+func (m *MemStore) CollectImages(ctx context.Context, remove func([]string), names ...string) ([]string, error) {
+	defer m.lockWrite()()
+	refs := m.imageRefs()
+	if len(names) == 0 {
+		for name := range m.images {
+			names = append(names, name)
+		}
+	}
+	cutoff := time.Now().Add(-imageGracePeriod)
+	unused := []string{}
+	for _, name := range uniqueStrings(names) {
+		img, ok := m.images[name]
+		if ok && refs[name] == 0 && img.stored.Before(cutoff) {
+			unused = append(unused, name)
+		}
+	}
+	if len(unused) > 0 {
+		remove(unused)
+	}
+	for _, name := range unused {
+		delete(m.images, name)
+	}
+	return unused, nil
+}
+
+// ImageStats sums up the images stored and referenced
+func (m *MemStore) ImageStats(ctx context.Context) (ImageStats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	stats := ImageStats{}
+	for _, img := range m.images {
+		stats.Images++
+		stats.StoredBytes += img.size
+	}
+	for name, n := range m.imageRefs() {
+		stats.References += n
+		stats.ReferencedBytes += n * m.images[name].size
+	}
+	stats.SavedBytes = stats.ReferencedBytes - stats.StoredBytes
+	return stats, nil
+}
+
+// UserByName returns the user named `name`, ignoring case, or nil
+func (m *MemStore) UserByName(ctx context.Context, name string) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, u := range m.users {
+		if strings.EqualFold(u.Name, name) {
+			return &u, nil
+		}
+	}
+	return nil, nil
+}
+
+// UserByID returns user `id`, or nil
+func (m *MemStore) UserByID(ctx context.Context, id int64) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if u, ok := m.users[id]; ok {
+		return &u, nil
+	}
+	return nil, nil
+}
+
+// InsertUser registers `user`, returning its ID, or `errUserExists`
+func (m *MemStore) InsertUser(ctx context.Context, user User) (int64, error) {
+	if err := checkLen("Name", user.Name, 30); err != nil {
+		return 0, err
+	}
+	defer m.lockWrite()()
+	for _, u := range m.users {
+		if strings.EqualFold(u.Name, user.Name) {
+			return 0, errUserExists
+		}
+	}
+	user.ID = m.nextUserID
+	m.nextUserID++
+	m.users[user.ID] = user
+	return user.ID, nil
+}
+
+// Users lists users, oldest first
+func (m *MemStore) Users(ctx context.Context, limit, offset int) ([]User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	users := []User{}
+	for _, u := range m.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	start, end := page(len(users), limit, offset)
+	return users[start:end], nil
+}
+
+// SetUserRole changes user `id`'s role, reporting whether the user exists.  Returns `errLastAdmin` rather than demote the
+// only admin
+func (m *MemStore) SetUserRole(ctx context.Context, id int64, role Role) (bool, error) {
+	defer m.lockWrite()()
+	u, ok := m.users[id]
+	if !ok {
+		return false, nil
+	}
+	if u.Role == RoleAdmin && role != RoleAdmin {
+		admins := 0
+		for _, other := range m.users {
+			if other.Role == RoleAdmin {
+				admins++
+			}
+		}
+		if admins <= 1 {
+			return true, errLastAdmin
+		}
+	}
+	u.Role = role
+	m.users[id] = u
+	return true, nil
+}
+
+// InsertSession records a new session, first removing sessions that have expired
+func (m *MemStore) InsertSession(ctx context.Context, s Session) error {
+	defer m.lockWrite()()
+	if _, ok := m.users[s.UserID]; !ok {
+		return errMemForeignKey
+	}
+	for id, other := range m.sessions {
+		if other.ExpiresAt.Before(s.CreatedAt) {
+			delete(m.sessions, id)
+		}
+	}
+	m.sessions[s.ID] = s
+	return nil
+}
+
+// SessionByID returns session `id`, or nil
+func (m *MemStore) SessionByID(ctx context.Context, id string) (*Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if s, ok := m.sessions[id]; ok {
+		return &s, nil
+	}
+	return nil, nil
+}
+
+// RotateSession replaces the refresh token of session `id` and extends it to `expiresAt`, if its current refresh token
+// hashes to `oldHash` and it is active.  Reports whether it was replaced
+func (m *MemStore) RotateSession(ctx context.Context, id, oldHash, newHash string, expiresAt time.Time) (bool, error) {
+	defer m.lockWrite()()
+	s, ok := m.sessions[id]
+	if !ok || s.RefreshHash != oldHash || !s.active(time.Now()) {
+		return false, nil
+	}
+	s.RefreshHash, s.ExpiresAt = newHash, expiresAt
+	m.sessions[id] = s
+	return true, nil
+}
+
+// RevokeSession logs session `id` out
+func (m *MemStore) RevokeSession(ctx context.Context, id string) error {
+	defer m.lockWrite()()
+	if s, ok := m.sessions[id]; ok && s.RevokedAt == nil {
+		now := time.Now().UTC()
+		s.RevokedAt = &now
+		m.sessions[id] = s
+	}
+	return nil
+}
+
+// UpdateTag updates a tag's information
+func (m *MemStore) UpdateTag(ctx context.Context, id int64, tag UploadTag) error {
+	if err := checkTag(tag); err != nil {
+		return err
+	}
+	defer m.lockWrite()()
+	if _, ok := m.tags[id]; !ok {
+		return nil
+	}
+	// names are unique across the trash too
+	if other, exists := m.tagByName(tag.Name); exists && other.ID != id {
+		return errMemDuplicateTag
+	}
+	m.tags[id] = DBTag{
+		ID:          id,
+		Name:        tag.Name,
+		Description: tag.Description,
+	}
+	return nil
+}
+
+// SaveArticleRevision records the current state of article `id`, in the trash or not, as a revision made by `action`
+// of user `userID`, or of nobody known if it is 0.  Does nothing if the article does not exist
+func (m *MemStore) SaveArticleRevision(ctx context.Context, id int64, action string, userID int64) error {
+	defer m.lockWrite()()
+	a, ok := m.articles[id]
+	if !ok {
+		return nil
+	}
+	a = m.withTags(a)
+	if a.Tags == nil {
+		a.Tags = []string{}
+	}
+	m.articleRevisions[id] = append(m.articleRevisions[id], ArticleRevision{
+		ID:          m.nextArticleRevisionID,
+		ArticleID:   id,
+		Action:      action,
+		Name:        a.Name,
+		URL:         a.URL,
+		Description: a.Description,
+		Tags:        a.Tags,
+		CreatedAt:   time.Now().UTC(),
+		UserID:      userID,
+	})
+	m.nextArticleRevisionID++
+	return nil
+}
+
+// SaveTagRevision records the current state of tag `id`, in the trash or not, as a revision made by `action` of user
+// `userID`, or of nobody known if it is 0.  Does nothing if the tag does not exist
+func (m *MemStore) SaveTagRevision(ctx context.Context, id int64, action string, userID int64) error {
+	defer m.lockWrite()()
+	t, ok := m.tags[id]
+	if !ok {
+		return nil
+	}
+	m.tagRevisions[id] = append(m.tagRevisions[id], TagRevision{
+		ID:          m.nextTagRevisionID,
+		TagID:       id,
+		Action:      action,
+		Name:        t.Name,
+		Description: t.Description,
+		CreatedAt:   time.Now().UTC(),
+		UserID:      userID,
+	})
+	m.nextTagRevisionID++
+	return nil
+}
+
+// ArticleRevisions returns `limit` revisions of article `id`, newest first, offset by `offset`
+func (m *MemStore) ArticleRevisions(ctx context.Context, id int64, limit, offset int) ([]ArticleRevision, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	revisions := []ArticleRevision{}
+	for ii := len(m.articleRevisions[id]) - 1; ii >= 0; ii-- {
+		revisions = append(revisions, m.articleRevisions[id][ii])
+	}
+	start, end := page(len(revisions), limit, offset)
+	return revisions[start:end], nil
+}
+
+// TagRevisions returns `limit` revisions of tag `id`, newest first, offset by `offset`
+func (m *MemStore) TagRevisions(ctx context.Context, id int64, limit, offset int) ([]TagRevision, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	revisions := []TagRevision{}
+	for ii := len(m.tagRevisions[id]) - 1; ii >= 0; ii-- {
+		revisions = append(revisions, m.tagRevisions[id][ii])
+	}
+	start, end := page(len(revisions), limit, offset)
+	return revisions[start:end], nil
+}
+
+// ArticleRevision returns revision `rev` of article `id`, or `nil` if the article has no such revision
+func (m *MemStore) ArticleRevision(ctx context.Context, id, rev int64) (*ArticleRevision, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, r := range m.articleRevisions[id] {
+		if r.ID == rev {
+			return &r, nil
+		}
+	}
+	return nil, nil
+}
+
+// TagRevision returns revision `rev` of tag `id`, or `nil` if the tag has no such revision
+func (m *MemStore) TagRevision(ctx context.Context, id, rev int64) (*TagRevision, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, r := range m.tagRevisions[id] {
+		if r.ID == rev {
+			return &r, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,625 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// migration is a numbered schema change.  `up` and `down` map a dialect to the statements run, in order, to apply or revert it.
+// Dialects missing from a map have nothing to do for that migration
+type migration struct {
+	version     int
+	description string
+	up          map[string][]string
+	down        map[string][]string
+}
+
+// migrations must be ordered by version, starting at 1 with no gaps.  Never edit a migration once it has shipped, add a new one
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create articles, tags and article_to_tag",
+		// IF NOT EXISTS adopts databases created before migrations existed
+		up: map[string][]string{
+			dialectMySQL: {
+				"CREATE TABLE IF NOT EXISTS articles( ID INT AUTO_INCREMENT, Name VARCHAR(512) NOT NULL, URL VARCHAR(512), Description VARCHAR(1024), PRIMARY KEY (ID) );",
+				"CREATE TABLE IF NOT EXISTS tags( ID INT AUTO_INCREMENT, Name VARCHAR(16) UNIQUE, Description VARCHAR(256), PRIMARY KEY (ID, Name) );",
+				"CREATE TABLE IF NOT EXISTS article_to_tag( ArticleID INT, TagID INT, PRIMARY KEY (ArticleID, TagID) );",
+			},
+			// NOCASE matches MySQL's case-insensitive collation and CHECK stands in for VARCHAR limits, which SQLite does not enforce
+			dialectSQLite: {
+				"CREATE TABLE IF NOT EXISTS articles( ID INTEGER PRIMARY KEY AUTOINCREMENT," +
+					" Name VARCHAR(512) NOT NULL COLLATE NOCASE CHECK (length(Name) <= 512)," +
+					" URL VARCHAR(512) CHECK (length(URL) <= 512)," +
+					" Description VARCHAR(1024) COLLATE NOCASE CHECK (length(Description) <= 1024) );",
+				"CREATE TABLE IF NOT EXISTS tags( ID INTEGER PRIMARY KEY AUTOINCREMENT," +
+					" Name VARCHAR(16) NOT NULL UNIQUE COLLATE NOCASE CHECK (length(Name) <= 16)," +
+					" Description VARCHAR(256) COLLATE NOCASE CHECK (length(Description) <= 256) );",
+				"CREATE TABLE IF NOT EXISTS article_to_tag( ArticleID INTEGER NOT NULL, TagID INTEGER NOT NULL, PRIMARY KEY (ArticleID, TagID) );",
+			},
+			// tag names are unique regardless of case, like MySQL
+			dialectPostgres: {
+				"CREATE TABLE IF NOT EXISTS articles( ID SERIAL PRIMARY KEY, Name VARCHAR(512) NOT NULL, URL VARCHAR(512), Description VARCHAR(1024) );",
+				"CREATE TABLE IF NOT EXISTS tags( ID SERIAL PRIMARY KEY, Name VARCHAR(16) NOT NULL, Description VARCHAR(256) );",
+				"CREATE UNIQUE INDEX IF NOT EXISTS tags_name_key ON tags (LOWER(Name));",
+				"CREATE TABLE IF NOT EXISTS article_to_tag( ArticleID INT, TagID INT, PRIMARY KEY (ArticleID, TagID) );",
+			},
+		},
+		down: map[string][]string{
+			dialectMySQL:    {"DROP TABLE article_to_tag;", "DROP TABLE tags;", "DROP TABLE articles;"},
+			dialectSQLite:   {"DROP TABLE article_to_tag;", "DROP TABLE tags;", "DROP TABLE articles;"},
+			dialectPostgres: {"DROP TABLE article_to_tag;", "DROP TABLE tags;", "DROP TABLE articles;"},
+		},
+	},
+	{
+		version:     2,
+		description: "make tags.ID the sole primary key on MySQL",
+		up: map[string][]string{
+			dialectMySQL: {"ALTER TABLE tags MODIFY Name VARCHAR(16) NOT NULL, DROP PRIMARY KEY, ADD PRIMARY KEY (ID);"},
+		},
+		down: map[string][]string{
+			dialectMySQL: {"ALTER TABLE tags DROP PRIMARY KEY, ADD PRIMARY KEY (ID, Name);"},
+		},
+	},
+	{
+		version:     3,
+		description: "remove orphaned article_to_tag links and cascade deletes from articles and tags",
+		up: map[string][]string{
+			dialectMySQL: {
+				"DELETE FROM article_to_tag WHERE ArticleID NOT IN (SELECT ID FROM articles) OR TagID NOT IN (SELECT ID FROM tags);",
+				"ALTER TABLE article_to_tag" +
+					" ADD CONSTRAINT article_to_tag_article_fk FOREIGN KEY (ArticleID) REFERENCES articles (ID) ON DELETE CASCADE," +
+					" ADD CONSTRAINT article_to_tag_tag_fk FOREIGN KEY (TagID) REFERENCES tags (ID) ON DELETE CASCADE;",
+			},
+			// SQLite cannot add constraints to an existing table so it is rebuilt
+			dialectSQLite: {
+				"CREATE TABLE article_to_tag_new( ArticleID INTEGER NOT NULL REFERENCES articles (ID) ON DELETE CASCADE," +
+					" TagID INTEGER NOT NULL REFERENCES tags (ID) ON DELETE CASCADE, PRIMARY KEY (ArticleID, TagID) );",
+				"INSERT INTO article_to_tag_new (ArticleID, TagID) SELECT ArticleID, TagID FROM article_to_tag" +
+					" WHERE ArticleID IN (SELECT ID FROM articles) AND TagID IN (SELECT ID FROM tags);",
+				"DROP TABLE article_to_tag;",
+				"ALTER TABLE article_to_tag_new RENAME TO article_to_tag;",
+				"CREATE INDEX article_to_tag_tag ON article_to_tag (TagID);",
+			},
+			dialectPostgres: {
+				"DELETE FROM article_to_tag WHERE ArticleID NOT IN (SELECT ID FROM articles) OR TagID NOT IN (SELECT ID FROM tags);",
+				"ALTER TABLE article_to_tag" +
+					" ADD CONSTRAINT article_to_tag_article_fk FOREIGN KEY (ArticleID) REFERENCES articles (ID) ON DELETE CASCADE," +
+					" ADD CONSTRAINT article_to_tag_tag_fk FOREIGN KEY (TagID) REFERENCES tags (ID) ON DELETE CASCADE;",
+				"CREATE INDEX article_to_tag_tag ON article_to_tag (TagID);",
+			},
+		},
+		down: map[string][]string{
+			dialectMySQL: {
+				"ALTER TABLE article_to_tag DROP FOREIGN KEY article_to_tag_article_fk, DROP FOREIGN KEY article_to_tag_tag_fk;",
+				// MySQL created this index to back the foreign key
+				"ALTER TABLE article_to_tag DROP INDEX article_to_tag_tag_fk;",
+			},
+			dialectSQLite: {
+				"CREATE TABLE article_to_tag_old( ArticleID INTEGER NOT NULL, TagID INTEGER NOT NULL, PRIMARY KEY (ArticleID, TagID) );",
+				"INSERT INTO article_to_tag_old (ArticleID, TagID) SELECT ArticleID, TagID FROM article_to_tag;",
+				"DROP TABLE article_to_tag;",
+				"ALTER TABLE article_to_tag_old RENAME TO article_to_tag;",
+			},
+			dialectPostgres: {
+				"DROP INDEX article_to_tag_tag;",
+				"ALTER TABLE article_to_tag DROP CONSTRAINT article_to_tag_article_fk, DROP CONSTRAINT article_to_tag_tag_fk;",
+			},
+		},
+	},
+	{
+		version:     4,
+		description: "full-text index over article names and descriptions",
+		up: map[string][]string{
+			dialectMySQL: {"ALTER TABLE articles ADD FULLTEXT INDEX articles_fulltext (Name, Description);"},
+			// external content FTS4 table kept in sync by triggers, as described in https://www.sqlite.org/fts3.html#_external_content_fts4_tables_
+			dialectSQLite: {
+				"CREATE VIRTUAL TABLE articles_fts USING fts4(content=\"articles\", Name, Description);",
+				"CREATE TRIGGER articles_fts_bu BEFORE UPDATE ON articles BEGIN DELETE FROM articles_fts WHERE docid=old.ID; END;",
+				"CREATE TRIGGER articles_fts_bd BEFORE DELETE ON articles BEGIN DELETE FROM articles_fts WHERE docid=old.ID; END;",
+				"CREATE TRIGGER articles_fts_au AFTER UPDATE ON articles BEGIN INSERT INTO articles_fts (docid, Name, Description) VALUES (new.ID, new.Name, new.Description); END;",
+				"CREATE TRIGGER articles_fts_ai AFTER INSERT ON articles BEGIN INSERT INTO articles_fts (docid, Name, Description) VALUES (new.ID, new.Name, new.Description); END;",
+				"INSERT INTO articles_fts (articles_fts) VALUES ('rebuild');",
+			},
+			dialectPostgres: {"CREATE INDEX articles_fulltext ON articles USING GIN (" + postgresArticleVector + ");"},
+		},
+		down: map[string][]string{
+			dialectMySQL: {"ALTER TABLE articles DROP INDEX articles_fulltext;"},
+			dialectSQLite: {
+				"DROP TRIGGER articles_fts_bu;",
+				"DROP TRIGGER articles_fts_bd;",
+				"DROP TRIGGER articles_fts_au;",
+				"DROP TRIGGER articles_fts_ai;",
+				"DROP TABLE articles_fts;",
+			},
+			dialectPostgres: {"DROP INDEX articles_fulltext;"},
+		},
+	},
+	{
+		version:     5,
+		description: "soft delete articles and tags into a trash",
+		// article_to_tag links are kept while in the trash so restoring brings them back
+		up: map[string][]string{
+			dialectMySQL: {
+				"ALTER TABLE articles ADD COLUMN DeletedAt DATETIME NULL, ADD INDEX articles_deleted (DeletedAt);",
+				"ALTER TABLE tags ADD COLUMN DeletedAt DATETIME NULL, ADD INDEX tags_deleted (DeletedAt);",
+			},
+			dialectSQLite: {
+				"ALTER TABLE articles ADD COLUMN DeletedAt DATETIME;",
+				"CREATE INDEX articles_deleted ON articles (DeletedAt);",
+				"ALTER TABLE tags ADD COLUMN DeletedAt DATETIME;",
+				"CREATE INDEX tags_deleted ON tags (DeletedAt);",
+			},
+			dialectPostgres: {
+				"ALTER TABLE articles ADD COLUMN DeletedAt TIMESTAMP;",
+				"CREATE INDEX articles_deleted ON articles (DeletedAt);",
+				"ALTER TABLE tags ADD COLUMN DeletedAt TIMESTAMP;",
+				"CREATE INDEX tags_deleted ON tags (DeletedAt);",
+			},
+		},
+		// anything still in the trash is restored
+		down: map[string][]string{
+			dialectMySQL: {
+				"ALTER TABLE articles DROP INDEX articles_deleted, DROP COLUMN DeletedAt;",
+				"ALTER TABLE tags DROP INDEX tags_deleted, DROP COLUMN DeletedAt;",
+			},
+			dialectSQLite: {
+				"DROP INDEX articles_deleted;",
+				"ALTER TABLE articles DROP COLUMN DeletedAt;",
+				"DROP INDEX tags_deleted;",
+				"ALTER TABLE tags DROP COLUMN DeletedAt;",
+			},
+			dialectPostgres: {
+				"ALTER TABLE articles DROP COLUMN DeletedAt;",
+				"ALTER TABLE tags DROP COLUMN DeletedAt;",
+			},
+		},
+	},
+	{
+		version:     6,
+		description: "revision history of articles and tags",
+		// Tags holds a JSON array of tag names.  Revisions are purged along with their article or tag
+		up: map[string][]string{
+			dialectMySQL: {
+				"CREATE TABLE article_revisions( ID INT AUTO_INCREMENT, ArticleID INT NOT NULL, Action VARCHAR(16) NOT NULL," +
+					" Name VARCHAR(512) NOT NULL, URL VARCHAR(512), Description VARCHAR(1024), Tags TEXT NOT NULL, CreatedAt DATETIME NOT NULL," +
+					" PRIMARY KEY (ID), INDEX article_revisions_article (ArticleID, ID)," +
+					" CONSTRAINT article_revisions_article_fk FOREIGN KEY (ArticleID) REFERENCES articles (ID) ON DELETE CASCADE );",
+				"CREATE TABLE tag_revisions( ID INT AUTO_INCREMENT, TagID INT NOT NULL, Action VARCHAR(16) NOT NULL," +
+					" Name VARCHAR(16) NOT NULL, Description VARCHAR(256), CreatedAt DATETIME NOT NULL," +
+					" PRIMARY KEY (ID), INDEX tag_revisions_tag (TagID, ID)," +
+					" CONSTRAINT tag_revisions_tag_fk FOREIGN KEY (TagID) REFERENCES tags (ID) ON DELETE CASCADE );",
+			},
+			dialectSQLite: {
+				"CREATE TABLE article_revisions( ID INTEGER PRIMARY KEY AUTOINCREMENT," +
+					" ArticleID INTEGER NOT NULL REFERENCES articles (ID) ON DELETE CASCADE, Action VARCHAR(16) NOT NULL," +
+					" Name VARCHAR(512) NOT NULL, URL VARCHAR(512), Description VARCHAR(1024), Tags TEXT NOT NULL, CreatedAt DATETIME NOT NULL );",
+				"CREATE INDEX article_revisions_article ON article_revisions (ArticleID, ID);",
+				"CREATE TABLE tag_revisions( ID INTEGER PRIMARY KEY AUTOINCREMENT," +
+					" TagID INTEGER NOT NULL REFERENCES tags (ID) ON DELETE CASCADE, Action VARCHAR(16) NOT NULL," +
+					" Name VARCHAR(16) NOT NULL, Description VARCHAR(256), CreatedAt DATETIME NOT NULL );",
+				"CREATE INDEX tag_revisions_tag ON tag_revisions (TagID, ID);",
+			},
+			dialectPostgres: {
+				"CREATE TABLE article_revisions( ID SERIAL PRIMARY KEY, ArticleID INT NOT NULL REFERENCES articles (ID) ON DELETE CASCADE," +
+					" Action VARCHAR(16) NOT NULL, Name VARCHAR(512) NOT NULL, URL VARCHAR(512), Description VARCHAR(1024)," +
+					" Tags TEXT NOT NULL, CreatedAt TIMESTAMP NOT NULL );",
+				"CREATE INDEX article_revisions_article ON article_revisions (ArticleID, ID);",
+				"CREATE TABLE tag_revisions( ID SERIAL PRIMARY KEY, TagID INT NOT NULL REFERENCES tags (ID) ON DELETE CASCADE," +
+					" Action VARCHAR(16) NOT NULL, Name VARCHAR(16) NOT NULL, Description VARCHAR(256), CreatedAt TIMESTAMP NOT NULL );",
+				"CREATE INDEX tag_revisions_tag ON tag_revisions (TagID, ID);",
+			},
+		},
+		down: map[string][]string{
+			dialectMySQL:    {"DROP TABLE tag_revisions;", "DROP TABLE article_revisions;"},
+			dialectSQLite:   {"DROP TABLE tag_revisions;", "DROP TABLE article_revisions;"},
+			dialectPostgres: {"DROP TABLE tag_revisions;", "DROP TABLE article_revisions;"},
+		},
+	},
+	{
+		version:     7,
+		description: "article images",
+		// Filename names the image in the blob store.  Position orders an article's images
+		up: map[string][]string{
+			dialectMySQL: {
+				"CREATE TABLE article_images( ArticleID INT NOT NULL, Position INT NOT NULL, Filename VARCHAR(64) NOT NULL," +
+					" PRIMARY KEY (ArticleID, Position)," +
+					" CONSTRAINT article_images_article_fk FOREIGN KEY (ArticleID) REFERENCES articles (ID) ON DELETE CASCADE );",
+			},
+			dialectSQLite: {
+				"CREATE TABLE article_images( ArticleID INTEGER NOT NULL REFERENCES articles (ID) ON DELETE CASCADE," +
+					" Position INTEGER NOT NULL, Filename VARCHAR(64) NOT NULL, PRIMARY KEY (ArticleID, Position) );",
+			},
+			dialectPostgres: {
+				"CREATE TABLE article_images( ArticleID INT NOT NULL REFERENCES articles (ID) ON DELETE CASCADE," +
+					" Position INT NOT NULL, Filename VARCHAR(64) NOT NULL, PRIMARY KEY (ArticleID, Position) );",
+			},
+		},
+		down: map[string][]string{
+			dialectMySQL:    {"DROP TABLE article_images;"},
+			dialectSQLite:   {"DROP TABLE article_images;"},
+			dialectPostgres: {"DROP TABLE article_images;"},
+		},
+	},
+	{
+		version:     8,
+		description: "content-addressed article images shared between articles",
+		// images registers each stored image once, however many articles use it, so unreferenced ones can be found and
+		// deleted.  Size counts the image and its thumbnails, and is 0 for images stored before this migration.
+		// Filenames grow to a SHA-256 in hex plus extension
+		up: map[string][]string{
+			dialectMySQL: {
+				"ALTER TABLE article_images MODIFY Filename VARCHAR(80) NOT NULL, ADD INDEX article_images_filename (Filename);",
+				"CREATE TABLE images( Filename VARCHAR(80) NOT NULL, Size BIGINT NOT NULL, CreatedAt DATETIME NOT NULL, PRIMARY KEY (Filename) );",
+				"INSERT INTO images (Filename, Size, CreatedAt) SELECT DISTINCT Filename, 0, CURRENT_TIMESTAMP FROM article_images;",
+			},
+			dialectSQLite: {
+				"CREATE INDEX article_images_filename ON article_images (Filename);",
+				"CREATE TABLE images( Filename VARCHAR(80) NOT NULL PRIMARY KEY, Size INTEGER NOT NULL, CreatedAt DATETIME NOT NULL );",
+				"INSERT INTO images (Filename, Size, CreatedAt) SELECT DISTINCT Filename, 0, CURRENT_TIMESTAMP FROM article_images;",
+			},
+			dialectPostgres: {
+				"ALTER TABLE article_images ALTER COLUMN Filename TYPE VARCHAR(80);",
+				"CREATE INDEX article_images_filename ON article_images (Filename);",
+				"CREATE TABLE images( Filename VARCHAR(80) NOT NULL PRIMARY KEY, Size BIGINT NOT NULL, CreatedAt TIMESTAMP NOT NULL );",
+				"INSERT INTO images (Filename, Size, CreatedAt) SELECT DISTINCT Filename, 0, CURRENT_TIMESTAMP FROM article_images;",
+			},
+		},
+		// fails on MySQL and Postgres once SHA-256 named images are stored
+		down: map[string][]string{
+			dialectMySQL: {
+				"DROP TABLE images;",
+				"ALTER TABLE article_images DROP INDEX article_images_filename, MODIFY Filename VARCHAR(64) NOT NULL;",
+			},
+			dialectSQLite: {"DROP TABLE images;", "DROP INDEX article_images_filename;"},
+			dialectPostgres: {
+				"DROP TABLE images;",
+				"DROP INDEX article_images_filename;",
+				"ALTER TABLE article_images ALTER COLUMN Filename TYPE VARCHAR(64);",
+			},
+		},
+	},
+	{
+		version:     9,
+		description: "user accounts",
+		// PasswordHash is a bcrypt hash.  Names are unique regardless of case, like tag names
+		up: map[string][]string{
+			dialectMySQL: {
+				"CREATE TABLE users( ID INT AUTO_INCREMENT, Name VARCHAR(30) NOT NULL, PasswordHash VARCHAR(128) NOT NULL," +
+					" CreatedAt DATETIME NOT NULL, PRIMARY KEY (ID), UNIQUE INDEX users_name (Name) );",
+			},
+			dialectSQLite: {
+				"CREATE TABLE users( ID INTEGER PRIMARY KEY AUTOINCREMENT, Name VARCHAR(30) NOT NULL UNIQUE COLLATE NOCASE," +
+					" PasswordHash VARCHAR(128) NOT NULL, CreatedAt DATETIME NOT NULL );",
+			},
+			dialectPostgres: {
+				"CREATE TABLE users( ID SERIAL PRIMARY KEY, Name VARCHAR(30) NOT NULL, PasswordHash VARCHAR(128) NOT NULL," +
+					" CreatedAt TIMESTAMP NOT NULL );",
+				"CREATE UNIQUE INDEX users_name ON users (LOWER(Name));",
+			},
+		},
+		down: map[string][]string{
+			dialectMySQL:    {"DROP TABLE users;"},
+			dialectSQLite:   {"DROP TABLE users;"},
+			dialectPostgres: {"DROP TABLE users;"},
+		},
+	},
+	{
+		version:     10,
+		description: "login sessions",
+		// a session lasts from login until logout or until its refresh token expires.  RefreshHash is the SHA-256 in hex of
+		// the session's current refresh token, which changes every refresh
+		up: map[string][]string{
+			dialectMySQL: {
+				"CREATE TABLE sessions( ID CHAR(32) NOT NULL, UserID INT NOT NULL, RefreshHash CHAR(64) NOT NULL," +
+					" CreatedAt DATETIME NOT NULL, ExpiresAt DATETIME NOT NULL, RevokedAt DATETIME," +
+					" PRIMARY KEY (ID), INDEX sessions_expires (ExpiresAt)," +
+					" CONSTRAINT sessions_user_fk FOREIGN KEY (UserID) REFERENCES users (ID) ON DELETE CASCADE );",
+			},
+			dialectSQLite: {
+				"CREATE TABLE sessions( ID CHAR(32) NOT NULL PRIMARY KEY," +
+					" UserID INTEGER NOT NULL REFERENCES users (ID) ON DELETE CASCADE, RefreshHash CHAR(64) NOT NULL," +
+					" CreatedAt DATETIME NOT NULL, ExpiresAt DATETIME NOT NULL, RevokedAt DATETIME );",
+				"CREATE INDEX sessions_expires ON sessions (ExpiresAt);",
+			},
+			dialectPostgres: {
+				"CREATE TABLE sessions( ID CHAR(32) NOT NULL PRIMARY KEY, UserID INT NOT NULL REFERENCES users (ID) ON DELETE CASCADE," +
+					" RefreshHash CHAR(64) NOT NULL, CreatedAt TIMESTAMP NOT NULL, ExpiresAt TIMESTAMP NOT NULL, RevokedAt TIMESTAMP );",
+				"CREATE INDEX sessions_expires ON sessions (ExpiresAt);",
+			},
+		},
+		down: map[string][]string{
+			dialectMySQL:    {"DROP TABLE sessions;"},
+			dialectSQLite:   {"DROP TABLE sessions;"},
+			dialectPostgres: {"DROP TABLE sessions;"},
+		},
+	},
+	{
+		version:     11,
+		description: "user roles",
+		// the first user registered administers the rest, as users registered from now on do
+		up: map[string][]string{
+			dialectMySQL: {
+				"ALTER TABLE users ADD Role VARCHAR(16) NOT NULL DEFAULT 'contributor';",
+				// MySQL cannot select from the table being updated except through a derived table
+				"UPDATE users SET Role='admin' WHERE ID=(SELECT ID FROM (SELECT MIN(ID) AS ID FROM users) AS first);",
+			},
+			dialectSQLite: {
+				"ALTER TABLE users ADD COLUMN Role VARCHAR(16) NOT NULL DEFAULT 'contributor';",
+				"UPDATE users SET Role='admin' WHERE ID=(SELECT MIN(ID) FROM users);",
+			},
+			dialectPostgres: {
+				"ALTER TABLE users ADD COLUMN Role VARCHAR(16) NOT NULL DEFAULT 'contributor';",
+				"UPDATE users SET Role='admin' WHERE ID=(SELECT MIN(ID) FROM users);",
+			},
+		},
+		down: map[string][]string{
+			dialectMySQL:    {"ALTER TABLE users DROP COLUMN Role;"},
+			dialectSQLite:   {"ALTER TABLE users DROP COLUMN Role;"},
+			dialectPostgres: {"ALTER TABLE users DROP COLUMN Role;"},
+		},
+	},
+	{
+		version:     12,
+		description: "revision authors, and revisions kept when their article or tag is purged",
+		// UserID is NULL for revisions from before authors were recorded.  Purging the trash keeps the history
+		up: map[string][]string{
+			dialectMySQL: {
+				"ALTER TABLE article_revisions DROP FOREIGN KEY article_revisions_article_fk, ADD UserID INT," +
+					" ADD CONSTRAINT article_revisions_user_fk FOREIGN KEY (UserID) REFERENCES users (ID) ON DELETE SET NULL;",
+				"ALTER TABLE tag_revisions DROP FOREIGN KEY tag_revisions_tag_fk, ADD UserID INT," +
+					" ADD CONSTRAINT tag_revisions_user_fk FOREIGN KEY (UserID) REFERENCES users (ID) ON DELETE SET NULL;",
+			},
+			// SQLite cannot drop constraints so the tables are rebuilt
+			dialectSQLite: {
+				"CREATE TABLE article_revisions_new( ID INTEGER PRIMARY KEY AUTOINCREMENT, ArticleID INTEGER NOT NULL," +
+					" Action VARCHAR(16) NOT NULL, Name VARCHAR(512) NOT NULL, URL VARCHAR(512), Description VARCHAR(1024), Tags TEXT NOT NULL," +
+					" CreatedAt DATETIME NOT NULL, UserID INTEGER REFERENCES users (ID) ON DELETE SET NULL );",
+				"INSERT INTO article_revisions_new (ID, ArticleID, Action, Name, URL, Description, Tags, CreatedAt)" +
+					" SELECT ID, ArticleID, Action, Name, URL, Description, Tags, CreatedAt FROM article_revisions;",
+				"DROP TABLE article_revisions;",
+				"ALTER TABLE article_revisions_new RENAME TO article_revisions;",
+				"CREATE INDEX article_revisions_article ON article_revisions (ArticleID, ID);",
+				"CREATE TABLE tag_revisions_new( ID INTEGER PRIMARY KEY AUTOINCREMENT, TagID INTEGER NOT NULL," +
+					" Action VARCHAR(16) NOT NULL, Name VARCHAR(16) NOT NULL, Description VARCHAR(256), CreatedAt DATETIME NOT NULL," +
+					" UserID INTEGER REFERENCES users (ID) ON DELETE SET NULL );",
+				"INSERT INTO tag_revisions_new (ID, TagID, Action, Name, Description, CreatedAt)" +
+					" SELECT ID, TagID, Action, Name, Description, CreatedAt FROM tag_revisions;",
+				"DROP TABLE tag_revisions;",
+				"ALTER TABLE tag_revisions_new RENAME TO tag_revisions;",
+				"CREATE INDEX tag_revisions_tag ON tag_revisions (TagID, ID);",
+			},
+			dialectPostgres: {
+				"ALTER TABLE article_revisions DROP CONSTRAINT article_revisions_articleid_fkey," +
+					" ADD COLUMN UserID INT REFERENCES users (ID) ON DELETE SET NULL;",
+				"ALTER TABLE tag_revisions DROP CONSTRAINT tag_revisions_tagid_fkey," +
+					" ADD COLUMN UserID INT REFERENCES users (ID) ON DELETE SET NULL;",
+			},
+		},
+		// the history of purged articles and tags is lost
+		down: map[string][]string{
+			dialectMySQL: {
+				"DELETE FROM article_revisions WHERE ArticleID NOT IN (SELECT ID FROM articles);",
+				"DELETE FROM tag_revisions WHERE TagID NOT IN (SELECT ID FROM tags);",
+				"ALTER TABLE article_revisions DROP FOREIGN KEY article_revisions_user_fk;",
+				"ALTER TABLE article_revisions DROP COLUMN UserID," +
+					" ADD CONSTRAINT article_revisions_article_fk FOREIGN KEY (ArticleID) REFERENCES articles (ID) ON DELETE CASCADE;",
+				"ALTER TABLE tag_revisions DROP FOREIGN KEY tag_revisions_user_fk;",
+				"ALTER TABLE tag_revisions DROP COLUMN UserID," +
+					" ADD CONSTRAINT tag_revisions_tag_fk FOREIGN KEY (TagID) REFERENCES tags (ID) ON DELETE CASCADE;",
+			},
+			dialectSQLite: {
+				"CREATE TABLE article_revisions_old( ID INTEGER PRIMARY KEY AUTOINCREMENT," +
+					" ArticleID INTEGER NOT NULL REFERENCES articles (ID) ON DELETE CASCADE, Action VARCHAR(16) NOT NULL," +
+					" Name VARCHAR(512) NOT NULL, URL VARCHAR(512), Description VARCHAR(1024), Tags TEXT NOT NULL, CreatedAt DATETIME NOT NULL );",
+				"INSERT INTO article_revisions_old (ID, ArticleID, Action, Name, URL, Description, Tags, CreatedAt)" +
+					" SELECT ID, ArticleID, Action, Name, URL, Description, Tags, CreatedAt FROM article_revisions" +
+					" WHERE ArticleID IN (SELECT ID FROM articles);",
+				"DROP TABLE article_revisions;",
+				"ALTER TABLE article_revisions_old RENAME TO article_revisions;",
+				"CREATE INDEX article_revisions_article ON article_revisions (ArticleID, ID);",
+				"CREATE TABLE tag_revisions_old( ID INTEGER PRIMARY KEY AUTOINCREMENT," +
+					" TagID INTEGER NOT NULL REFERENCES tags (ID) ON DELETE CASCADE, Action VARCHAR(16) NOT NULL," +
+					" Name VARCHAR(16) NOT NULL, Description VARCHAR(256), CreatedAt DATETIME NOT NULL );",
+				"INSERT INTO tag_revisions_old (ID, TagID, Action, Name, Description, CreatedAt)" +
+					" SELECT ID, TagID, Action, Name, Description, CreatedAt FROM tag_revisions WHERE TagID IN (SELECT ID FROM tags);",
+				"DROP TABLE tag_revisions;",
+				"ALTER TABLE tag_revisions_old RENAME TO tag_revisions;",
+				"CREATE INDEX tag_revisions_tag ON tag_revisions (TagID, ID);",
+			},
+			dialectPostgres: {
+				"DELETE FROM article_revisions WHERE ArticleID NOT IN (SELECT ID FROM articles);",
+				"DELETE FROM tag_revisions WHERE TagID NOT IN (SELECT ID FROM tags);",
+				"ALTER TABLE article_revisions DROP COLUMN UserID," +
+					" ADD CONSTRAINT article_revisions_articleid_fkey FOREIGN KEY (ArticleID) REFERENCES articles (ID) ON DELETE CASCADE;",
+				"ALTER TABLE tag_revisions DROP COLUMN UserID," +
+					" ADD CONSTRAINT tag_revisions_tagid_fkey FOREIGN KEY (TagID) REFERENCES tags (ID) ON DELETE CASCADE;",
+			},
+		},
+	},
+	{
+		version:     13,
+		description: "no admin for registering first",
+		// whoever registered first was made an admin by migration 11.  Admins are now made with `debatabase admin <name>`
+		// or `ADMIN_USER`, which makes them admins again
+		up: map[string][]string{
+			dialectMySQL: {
+				"UPDATE users SET Role='contributor' WHERE Role='admin' AND ID=(SELECT ID FROM (SELECT MIN(ID) AS ID FROM users) AS first);",
+			},
+			dialectSQLite:   {"UPDATE users SET Role='contributor' WHERE Role='admin' AND ID=(SELECT MIN(ID) FROM users);"},
+			dialectPostgres: {"UPDATE users SET Role='contributor' WHERE Role='admin' AND ID=(SELECT MIN(ID) FROM users);"},
+		},
+		down: map[string][]string{
+			dialectMySQL: {
+				"UPDATE users SET Role='admin' WHERE ID=(SELECT ID FROM (SELECT MIN(ID) AS ID FROM users) AS first);",
+			},
+			dialectSQLite:   {"UPDATE users SET Role='admin' WHERE ID=(SELECT MIN(ID) FROM users);"},
+			dialectPostgres: {"UPDATE users SET Role='admin' WHERE ID=(SELECT MIN(ID) FROM users);"},
+		},
+	},
+}
+
+// errSchemaTooNew is returned when the database was migrated by a newer version of debatabase
+var errSchemaTooNew = errors.New("database schema is newer than this version of debatabase knows about")
+
+const (
+	// schemaLockName identifies the MySQL named lock held while migrating
+	schemaLockName = "debatabase_schema_migrations"
+	// schemaLockKey identifies the Postgres advisory lock held while migrating
+	schemaLockKey = 0x64626d67
+	// schemaLockTimeout is how many seconds MySQL waits for another instance to finish migrating
+	schemaLockTimeout = 60
+)
+
+// execer is satisfied by both *sql.Conn and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// LatestSchemaVersion is the version of the last known migration
+func LatestSchemaVersion() int {
+	return len(migrations)
+}
+
+// Migrate applies or reverts migrations until the schema is at version `target`.
+// Other instances are locked out while migrating.  Returns `errSchemaTooNew` if the database is ahead of the known migrations
+func (db *DB) Migrate(target int) error {
+	if target < 0 || target > len(migrations) {
+		return fmt.Errorf("unknown schema version %d, latest is %d", target, len(migrations))
+	}
+	for ii, m := range migrations {
+		if m.version != ii+1 {
+			return fmt.Errorf("migration %q has version %d, expected %d", m.description, m.version, ii+1)
+		}
+	}
+
+	ctx := context.Background()
+	// locks are held per connection so everything has to run on the same one
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = db.lockSchema(ctx, conn)
+	if err != nil {
+		return err
+	}
+	err = db.migrate(ctx, conn, target)
+	unlockErr := db.unlockSchema(ctx, conn, err == nil)
+	if err != nil {
+		return err
+	}
+	return unlockErr
+}
+
+// lockSchema blocks until no other instance is migrating
+func (db *DB) lockSchema(ctx context.Context, conn *sql.Conn) error {
+	switch db.dialect {
+	case dialectSQLite:
+		// SQLite locks the whole file.  Migrations run inside this transaction
+		_, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE;")
+		return err
+	case dialectPostgres:
+		_, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1);", schemaLockKey)
+		return err
+	default:
+		var ok sql.NullInt64
+		err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?);", schemaLockName, schemaLockTimeout).Scan(&ok)
+		if err != nil {
+			return err
+		}
+		if !ok.Valid || ok.Int64 != 1 {
+			return errors.New("timed out waiting for schema migration lock")
+		}
+		return nil
+	}
+}
+
+// unlockSchema releases the lock taken by lockSchema, committing SQLite's migrations if `commit`
+func (db *DB) unlockSchema(ctx context.Context, conn *sql.Conn, commit bool) error {
+	var err error
+	switch db.dialect {
+	case dialectSQLite:
+		if commit {
+			_, err = conn.ExecContext(ctx, "COMMIT;")
+		} else {
+			_, err = conn.ExecContext(ctx, "ROLLBACK;")
+		}
+	case dialectPostgres:
+		_, err = conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1);", schemaLockKey)
+	default:
+		_, err = conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?);", schemaLockName)
+	}
+	return err
+}
+
+// migrate does the work of Migrate.  Caller must hold the schema lock on `conn`
+func (db *DB) migrate(ctx context.Context, conn *sql.Conn, target int) error {
+	_, err := conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations( Version INT NOT NULL, Description VARCHAR(256), AppliedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP, PRIMARY KEY (Version) );")
+	if err != nil {
+		return err
+	}
+	var current int
+	err = conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(Version), 0) FROM schema_migrations;").Scan(&current)
+	if err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("%w: at version %d, latest known is %d", errSchemaTooNew, current, len(migrations))
+	}
+
+	for current < target {
+		m := migrations[current]
+		fmt.Printf("DB applying migration %d (%s)...\n", m.version, m.description)
+		err = db.applyMigration(ctx, conn, m.up[db.dialect],
+			"INSERT INTO schema_migrations (Version, Description) VALUES (?, ?);", m.version, m.description)
+		if err != nil {
+			return fmt.Errorf("migration %d: %w", m.version, err)
+		}
+		current++
+	}
+	for current > target {
+		m := migrations[current-1]
+		fmt.Printf("DB reverting migration %d (%s)...\n", m.version, m.description)
+		err = db.applyMigration(ctx, conn, m.down[db.dialect],
+			"DELETE FROM schema_migrations WHERE Version=?;", m.version)
+		if err != nil {
+			return fmt.Errorf("reverting migration %d: %w", m.version, err)
+		}
+		current--
+	}
+	return nil
+}
+
+// applyMigration runs `stmts` followed by the bookkeeping statement `record`.
+// Postgres runs them in a transaction; SQLite is already inside one and MySQL cannot roll back DDL
+func (db *DB) applyMigration(ctx context.Context, conn *sql.Conn, stmts []string, record string, args ...interface{}) error {
+	var ex execer = conn
+	var tx *sql.Tx
+	if db.dialect == dialectPostgres {
+		var err error
+		tx, err = conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		ex = tx
+	}
+	for _, s := range stmts {
+		_, err := ex.ExecContext(ctx, s)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := ex.ExecContext(ctx, db.rebind(record), args...)
+	if err != nil {
+		return err
+	}
+	if tx != nil {
+		return tx.Commit()
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMigrationsCoverDialects(t *testing.T) {
+	for ii, m := range migrations {
+		if m.version != ii+1 {
+			t.Errorf("migration %q has version %d, want %d", m.description, m.version, ii+1)
+		}
+		for _, dialect := range []string{dialectMySQL, dialectSQLite, dialectPostgres} {
+			if len(m.up[dialect]) > 0 && len(m.down[dialect]) == 0 {
+				t.Errorf("migration %d cannot be reverted on %s", m.version, dialect)
+			}
+		}
+	}
+}
+
+// schema lists the tables of SQLite `db` and their columns
+func schema(t *testing.T, db *DB) map[string][]string {
+	t.Helper()
+	rows, err := db.DB.Query("SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%' ORDER BY name;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+	s := make(map[string][]string)
+	for _, table := range tables {
+		rows, err := db.DB.Query("SELECT name FROM pragma_table_info(?) ORDER BY cid;", table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var col string
+			if err := rows.Scan(&col); err != nil {
+				t.Fatal(err)
+			}
+			s[table] = append(s[table], col)
+		}
+		rows.Close()
+	}
+	return s
+}
+
+func TestMigrateDownAndUp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := SQLiteConnect(filepath.Join(dir, "test.db"), PoolConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Init()
+	latest := schema(t, db)
+	version := func() int {
+		t.Helper()
+		v := 0
+		if err := db.DB.QueryRow("SELECT COALESCE(MAX(Version), 0) FROM schema_migrations;").Scan(&v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	// every migration reverts, and applies again over its own revert
+	for target := LatestSchemaVersion() - 1; target >= 0; target-- {
+		if err := db.Migrate(target); err != nil {
+			t.Fatalf("reverting to %d: %v", target, err)
+		}
+		if v := version(); v != target {
+			t.Fatalf("reverted to %d, at %d", target, v)
+		}
+	}
+	if s := schema(t, db); len(s) != 1 {
+		t.Errorf("tables left at version 0: %v", s)
+	}
+	for target := 1; target <= LatestSchemaVersion(); target++ {
+		if err := db.Migrate(target); err != nil {
+			t.Fatalf("applying %d: %v", target, err)
+		}
+	}
+	if s := schema(t, db); !reflect.DeepEqual(s, latest) {
+		t.Errorf("schema after reverting and applying every migration:\n%v\nwant\n%v", s, latest)
+	}
+
+	if err := db.Migrate(LatestSchemaVersion() + 1); err == nil {
+		t.Error("migrated past the latest version")
+	}
+	if _, err := db.DB.Exec("INSERT INTO schema_migrations (Version) VALUES (?);", LatestSchemaVersion()+1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrate(LatestSchemaVersion()); !errors.Is(err, errSchemaTooNew) {
+		t.Errorf("migrating a newer schema returned %v", err)
+	}
+}
+
+func TestMigrateFirstUserRole(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := SQLiteConnect(filepath.Join(dir, "test.db"), PoolConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Init()
+	ctx := context.Background()
+	var ids []int64
+	for _, name := range []string{"alice", "bob"} {
+		id, err := db.InsertUser(ctx, User{Name: name, PasswordHash: "x", CreatedAt: time.Now().UTC(), Role: RoleContributor})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	roles := func() []Role {
+		t.Helper()
+		var r []Role
+		for _, id := range ids {
+			u, err := db.UserByID(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = append(r, u.Role)
+		}
+		return r
+	}
+
+	// migration 11 made the first user an admin, and 13 takes it back
+	if err := db.Migrate(12); err != nil {
+		t.Fatal(err)
+	}
+	if r := roles(); !reflect.DeepEqual(r, []Role{RoleAdmin, RoleContributor}) {
+		t.Errorf("roles at version 12: %v", r)
+	}
+	if err := db.Migrate(13); err != nil {
+		t.Fatal(err)
+	}
+	if r := roles(); !reflect.DeepEqual(r, []Role{RoleContributor, RoleContributor}) {
+		t.Errorf("roles at version 13: %v", r)
+	}
+
+	// other admins are left alone
+	if _, err := db.SetUserRole(ctx, ids[1], RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrate(12); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrate(13); err != nil {
+		t.Fatal(err)
+	}
+	if r := roles(); !reflect.DeepEqual(r, []Role{RoleContributor, RoleAdmin}) {
+		t.Errorf("roles after another admin was made: %v", r)
+	}
+}
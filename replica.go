@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+// replica is a read-only copy of the database that searches can be sent to
+type replica struct {
+	db    *sql.DB
+	conns *ConnManager
+	// kills the replica's searches.  See DB.killer
+	killer *sql.DB
+	// index in the configured list, for logs.  DSNs hold passwords
+	num int
+}
+
+// primaryKey marks a context whose reads must see the primary's latest writes.  See withPrimary
+type primaryKey struct{}
+
+// withPrimary returns `ctx` marked so DB reads in it skip the replicas
+func withPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+// usePrimary reports whether `ctx` was marked by withPrimary
+func usePrimary(ctx context.Context) bool {
+	b, _ := ctx.Value(primaryKey{}).(bool)
+	return b
+}
+
+// AddReplicas opens the read replicas at `dsns`, written for the primary's dialect, sizing their pools by `pool`.
+// Replicas that cannot be reached yet are skipped by reads until their health checks pass
+func (db *DB) AddReplicas(dsns []string, pool PoolConfig) error {
+	pool.ConnectTimeout = 0
+	if db.nextReplica == nil {
+		db.nextReplica = new(uint32)
+	}
+	for _, dsn := range dsns {
+		rdb, err := sql.Open(db.dialect, dsn)
+		if err != nil {
+			return err
+		}
+		r := &replica{db: rdb, conns: newConnManager(rdb, pool), num: len(db.replicas) + 1}
+		if db.dialect == dialectMySQL {
+			r.killer, err = openKiller(dsn)
+			if err != nil {
+				rdb.Close()
+				return err
+			}
+		}
+		err = r.conns.connect(rdb.PingContext)
+		if err != nil {
+			log.Println("Error connecting to read replica", r.num, ":", err)
+		}
+		db.replicas = append(db.replicas, r)
+	}
+	return nil
+}
+
+// Watch checks the health of the primary and every replica until the DB is closed
+func (db *DB) Watch() {
+	for _, r := range db.replicas {
+		go r.conns.Watch()
+	}
+	db.conns.Watch()
+}
+
+// replica picks the next healthy replica, or nil if reads must go to the primary: inside a transaction, for a
+// context marked by withPrimary, or when no replica is up
+func (db *DB) replica(ctx context.Context) *replica {
+	if db.tx != nil || db.conn != nil || usePrimary(ctx) || len(db.replicas) == 0 {
+		return nil
+	}
+	start := atomic.AddUint32(db.nextReplica, 1)
+	for ii := range db.replicas {
+		r := db.replicas[(int(start)+ii)%len(db.replicas)]
+		if r.conns.up() {
+			return r
+		}
+	}
+	return nil
+}
+
+// read is run for read-only calls, sending them to a healthy replica if there is one.  If the replica fails the call
+// is retried on the primary, and if it could not be reached it is skipped until its next health check passes.  Calls
+// that hit the query timeout are not retried, as they would likely time out on the primary too, after as long again
+func (db *DB) read(ctx context.Context, fn func(context.Context, *DB) error) error {
+	r := db.replica(ctx)
+	if r == nil {
+		return db.run(ctx, fn)
+	}
+	c := *db
+	c.DB, c.killer, c.replicas = r.db, r.killer, nil
+	err := c.run(ctx, fn)
+	if err == nil || ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	log.Println("Error reading from replica", r.num, "(falling back to primary):", err)
+	if connError(err) {
+		r.conns.record(err)
+	}
+	return db.run(ctx, fn)
+}
+
+// connError reports whether `err` came from reaching the database, such as a refused or dropped connection, rather
+// than from the query itself
+func connError(err error) bool {
+	var netErr net.Error
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// connection exceptions, and the server shutting down or starting up
+		return pqErr.Code.Class() == "08" || pqErr.Code == "57P01" || pqErr.Code == "57P02" || pqErr.Code == "57P03"
+	}
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) || errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
+// primaryHeader carries the time, in Unix milliseconds, until which a client that wrote reads from the primary.  Writes
+// respond with it and clients send it back.  A header rather than a cookie, as a frontend on another origin sends no
+// cookies without credentials
+const primaryHeader = "X-Read-Primary-Until"
+
+// readYourWrites sends the reads of clients marked by `wrote` to the primary.  Times later than a write could have set
+// are ignored, so clients cannot keep themselves off the replicas
+func (api *API) readYourWrites(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ms, err := strconv.ParseInt(r.Header.Get(primaryHeader), 10, 64); err == nil {
+			now := time.Now()
+			until := time.Unix(0, ms*int64(time.Millisecond))
+			if now.Before(until) && !until.After(now.Add(api.primaryWindow)) {
+				r = r.WithContext(withPrimary(r.Context()))
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// wrote marks the client of a write handler `h` so its reads go to the primary for `window`
+func wrote(window time.Duration, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if window > 0 {
+			until := time.Now().Add(window).UnixNano() / int64(time.Millisecond)
+			w.Header().Set(primaryHeader, strconv.FormatInt(until, 10))
+		}
+		h(w, r)
+	}
+}
+
+// replicaStates reports the state of every replica
+func (db *DB) replicaStates() []ConnState {
+	states := []ConnState{}
+	for _, r := range db.replicas {
+		s := r.conns.State()
+		s.Name = "replica " + strconv.Itoa(r.num)
+		states = append(states, s)
+	}
+	return states
+}
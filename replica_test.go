@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// replicaDB opens a fresh SQLite DB in `dir` with `n` replicas, which are separate databases rather than copies
+func replicaDB(t *testing.T, dir string, n int) *DB {
+	db, err := SQLiteConnect(filepath.Join(dir, "primary.db"), PoolConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Init()
+	var dsns []string
+	for ii := 1; ii <= n; ii++ {
+		path := filepath.Join(dir, fmt.Sprint("replica", ii, ".db"))
+		r, err := SQLiteConnect(path, PoolConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Init()
+		r.Close()
+		dsns = append(dsns, "file:"+path+"?_foreign_keys=1")
+	}
+	if err = db.AddReplicas(dsns, PoolConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestReadFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db := replicaDB(t, dir, 1)
+	defer db.Close()
+	db.queryTimeout = 50 * time.Millisecond
+
+	// the replica fails every call, the first by timing out
+	var onPrimary, onReplica int
+	fail := func(ctx context.Context, c *DB) error {
+		if c.DB == db.DB {
+			onPrimary++
+			return nil
+		}
+		onReplica++
+		if onReplica == 1 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return errors.New("no such table: articles")
+	}
+	err = db.read(context.Background(), fail)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("timed out read returned %v", err)
+	}
+	if onReplica != 1 || onPrimary != 0 {
+		t.Errorf("timed out read ran %d times on the replica and %d on the primary, want once and never", onReplica, onPrimary)
+	}
+
+	// other query errors are retried on the primary without marking the replica down
+	err = db.read(context.Background(), fail)
+	if err != nil {
+		t.Error("failed read was not retried:", err)
+	}
+	if onReplica != 2 || onPrimary != 1 {
+		t.Errorf("failed read ran %d times on the replica and %d on the primary", onReplica, onPrimary)
+	}
+	if !db.replicas[0].conns.up() {
+		t.Error("query error marked the replica down")
+	}
+}
+
+// readFrom returns the name of the one article a search of `db` finds, telling which database it read
+func readFrom(t *testing.T, ctx context.Context, db Store) string {
+	t.Helper()
+	articles, _, err := db.ArticlesWithTagsSearch(ctx, nil, nil, "", "", false, nil, 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(articles) != 1 {
+		t.Fatalf("found %d articles", len(articles))
+	}
+	return articles[0].Name
+}
+
+func TestReadReplicas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db := replicaDB(t, dir, 2)
+	defer db.Close()
+	ctx := context.Background()
+	// each database has an article named after it
+	if _, err := db.InsertArticle(ctx, UploadArticle{Name: "primary"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range db.replicas {
+		_, err := r.db.Exec("INSERT INTO articles (Name) VALUES (?);", fmt.Sprint("replica ", r.num))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// reads take turns between the replicas
+	reads := make(map[string]int)
+	last := ""
+	for ii := 0; ii < 4; ii++ {
+		name := readFrom(t, ctx, db)
+		if name == last {
+			t.Errorf("read %s twice in a row", name)
+		}
+		reads[name]++
+		last = name
+	}
+	if reads["replica 1"] != 2 || reads["replica 2"] != 2 {
+		t.Errorf("reads went to %v", reads)
+	}
+
+	// unless they must see the latest writes
+	if name := readFrom(t, withPrimary(ctx), db); name != "primary" {
+		t.Errorf("read marked for the primary went to %s", name)
+	}
+	err = db.WithTx(ctx, func(tx Store) error {
+		if name := readFrom(t, ctx, tx); name != "primary" {
+			t.Errorf("read in a transaction went to %s", name)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := db.ConnState()
+	if len(state.Replicas) != 2 || state.Replicas[0].Name != "replica 1" || state.Replicas[1].Status != connUp {
+		t.Errorf("replica states %+v", state.Replicas)
+	}
+}
+
+func TestReplicaFailover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db := replicaDB(t, dir, 1)
+	defer db.Close()
+	ctx := context.Background()
+	if _, err := db.InsertArticle(ctx, UploadArticle{Name: "primary"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.replicas[0].db.Exec("INSERT INTO articles (Name) VALUES ('replica');"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a replica that cannot be reached is retried on the primary, then skipped
+	err = db.read(ctx, func(ctx context.Context, c *DB) error {
+		if c.DB != db.DB {
+			return driver.ErrBadConn
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal("read was not retried on the primary:", err)
+	}
+	if name := readFrom(t, ctx, db); name != "primary" {
+		t.Errorf("read went to %s while the replica was down", name)
+	}
+	if s := db.ConnState().Replicas[0]; s.Status != connDown || len(s.Error) == 0 {
+		t.Errorf("failed replica is %q with error %q", s.Status, s.Error)
+	}
+
+	// until its health check passes
+	db.replicas[0].conns.record(db.replicas[0].db.Ping())
+	if name := readFrom(t, ctx, db); name != "replica" {
+		t.Errorf("read went to %s after the replica came back", name)
+	}
+}
+
+func TestConnError(t *testing.T) {
+	for err, want := range map[error]bool{
+		driver.ErrBadConn: true,
+		fmt.Errorf("querying: %w", &net.OpError{Op: "dial", Err: errors.New("connection refused")}): true,
+		&pq.Error{Code: "08006"}:           true,
+		&pq.Error{Code: "57P01"}:           true,
+		&pq.Error{Code: "42P01"}:           false,
+		&pq.Error{Code: "57014"}:           false,
+		errors.New("no such table: users"): false,
+	} {
+		if connError(err) != want {
+			t.Errorf("connError(%v) = %v, want %v", err, !want, want)
+		}
+	}
+}
+
+func TestReadYourWrites(t *testing.T) {
+	api := &API{primaryWindow: time.Minute}
+	var primary bool
+	h := api.readYourWrites(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primary = usePrimary(r.Context())
+	}))
+	read := func(header string) bool {
+		req := httptest.NewRequest("GET", "/api/search/article", nil)
+		if len(header) > 0 {
+			req.Header.Set(primaryHeader, header)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		return primary
+	}
+
+	w := httptest.NewRecorder()
+	wrote(api.primaryWindow, func(w http.ResponseWriter, r *http.Request) {})(w, httptest.NewRequest("POST", "/api/upload/tag", nil))
+	until := w.Header().Get(primaryHeader)
+	if !read(until) {
+		t.Errorf("read with %s from a write went to a replica", until)
+	}
+	ms := func(d time.Duration) string {
+		return strconv.FormatInt(time.Now().Add(d).UnixNano()/int64(time.Millisecond), 10)
+	}
+	for header, want := range map[string]bool{
+		"":                        false,
+		"soon":                    false,
+		ms(time.Second):           true,
+		ms(-time.Second):          false,
+		ms(api.primaryWindow * 2): false,
+	} {
+		if got := read(header); got != want {
+			t.Errorf("read with %q went to the primary: %v, want %v", header, got, want)
+		}
+	}
+}
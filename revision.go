@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Actions recorded by revisions
+const (
+	revisionCreate  = "create"
+	revisionEdit    = "edit"
+	revisionDelete  = "delete"
+	revisionRestore = "restore"
+	revisionRevert  = "revert"
+)
+
+// ArticleRevision is an immutable snapshot of an article taken after it changed
+type ArticleRevision struct {
+	// Revision number, unique across all articles
+	ID        int64 `json:"id" example:"7"`
+	ArticleID int64 `json:"article_id" example:"1"`
+	// What was done to the article: "create", "edit", "delete", "restore" or "revert"
+	Action      string    `json:"action" example:"edit"`
+	Name        string    `json:"name" example:"google"`
+	URL         string    `json:"url" example:"google.com"`
+	Description string    `json:"description" example:"a popular search engine"`
+	Tags        []string  `json:"tags" example:"engine,search,browser"`
+	CreatedAt   time.Time `json:"created_at"`
+	// ID of the user who made the revision.  Omitted for revisions from before authors were recorded
+	UserID int64 `json:"user_id,omitempty" example:"1"`
+}
+
+// TagRevision is an immutable snapshot of a tag taken after it changed
+type TagRevision struct {
+	// Revision number, unique across all tags
+	ID    int64 `json:"id" example:"7"`
+	TagID int64 `json:"tag_id" example:"1"`
+	// What was done to the tag: "create", "edit", "delete", "restore" or "revert"
+	Action      string    `json:"action" example:"edit"`
+	Name        string    `json:"name" example:"engine"`
+	Description string    `json:"description" example:"a machine designed to convert one form of energy into mechanical energy"`
+	CreatedAt   time.Time `json:"created_at"`
+	// ID of the user who made the revision.  Omitted for revisions from before authors were recorded
+	UserID int64 `json:"user_id,omitempty" example:"1"`
+}
+
+// FieldChange is one field that differs between two revisions
+type FieldChange struct {
+	Field string      `json:"field" example:"description"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+	// Tag names only in `to`, for the "tags" field
+	Added []string `json:"added,omitempty"`
+	// Tag names only in `from`, for the "tags" field
+	Removed []string `json:"removed,omitempty"`
+}
+
+// RevisionDiff lists the fields changed between revisions `from` and `to`
+type RevisionDiff struct {
+	From    int64         `json:"from" example:"3"`
+	To      int64         `json:"to" example:"7"`
+	Changes []FieldChange `json:"changes"`
+}
+
+// missingNames returns the names in `a` that are not in `b`, ignoring case
+func missingNames(a, b []string) []string {
+	r := []string{}
+	for _, name := range a {
+		if !hasAllTags(b, []string{name}) {
+			r = append(r, name)
+		}
+	}
+	return r
+}
+
+// diffStrings appends a change to `field` if `from` and `to` differ
+func diffStrings(changes []FieldChange, field, from, to string) []FieldChange {
+	if from == to {
+		return changes
+	}
+	return append(changes, FieldChange{Field: field, From: from, To: to})
+}
+
+// diffArticles compares two revisions of an article field by field
+func diffArticles(from, to ArticleRevision) RevisionDiff {
+	changes := []FieldChange{}
+	changes = diffStrings(changes, "name", from.Name, to.Name)
+	changes = diffStrings(changes, "url", from.URL, to.URL)
+	changes = diffStrings(changes, "description", from.Description, to.Description)
+	added, removed := missingNames(to.Tags, from.Tags), missingNames(from.Tags, to.Tags)
+	if len(added) > 0 || len(removed) > 0 {
+		changes = append(changes, FieldChange{Field: "tags", From: from.Tags, To: to.Tags, Added: added, Removed: removed})
+	}
+	return RevisionDiff{From: from.ID, To: to.ID, Changes: changes}
+}
+
+// diffTags compares two revisions of a tag field by field
+func diffTags(from, to TagRevision) RevisionDiff {
+	changes := []FieldChange{}
+	changes = diffStrings(changes, "name", from.Name, to.Name)
+	changes = diffStrings(changes, "description", from.Description, to.Description)
+	return RevisionDiff{From: from.ID, To: to.ID, Changes: changes}
+}
+
+// SaveArticleRevision records the current state of article `id`, in the trash or not, as a revision made by `action`
+// of user `userID`, or of nobody known if it is 0.  Does nothing if the article does not exist
+func (db *DB) SaveArticleRevision(ctx context.Context, id int64, action string, userID int64) error {
+	return db.run(ctx, func(ctx context.Context, c *DB) error {
+		return c.withTx(ctx, func(tx *DB) error {
+			rows, err := tx.Query(ctx, "SELECT ID, Name, URL, Description FROM articles WHERE ID=?;", id)
+			if err != nil {
+				return err
+			}
+			articles := UnmarshalArticles(rows)
+			rows.Close()
+			if err = rows.Err(); err != nil || len(articles) == 0 {
+				return err
+			}
+			err = tx.populateArticlesTags(ctx, articles)
+			if err != nil {
+				return err
+			}
+			a := articles[0]
+			if a.Tags == nil {
+				a.Tags = []string{}
+			}
+			tags, err := json.Marshal(a.Tags)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(ctx, "INSERT INTO article_revisions (ArticleID, Action, Name, URL, Description, Tags, CreatedAt, UserID) VALUES (?, ?, ?, ?, ?, ?, ?, ?);",
+				id, action, a.Name, stringOrNil(a.URL), stringOrNil(a.Description), string(tags), time.Now().UTC(), idOrNil(userID))
+			return err
+		})
+	})
+}
+
+// SaveTagRevision records the current state of tag `id`, in the trash or not, as a revision made by `action` of user
+// `userID`, or of nobody known if it is 0.  Does nothing if the tag does not exist
+func (db *DB) SaveTagRevision(ctx context.Context, id int64, action string, userID int64) error {
+	return db.run(ctx, func(ctx context.Context, c *DB) error {
+		return c.withTx(ctx, func(tx *DB) error {
+			rows, err := tx.Query(ctx, "SELECT ID, Name, Description FROM tags WHERE ID=?;", id)
+			if err != nil {
+				return err
+			}
+			tags := UnmarshalTags(rows)
+			rows.Close()
+			if err = rows.Err(); err != nil || len(tags) == 0 {
+				return err
+			}
+			t := tags[0]
+			_, err = tx.Exec(ctx, "INSERT INTO tag_revisions (TagID, Action, Name, Description, CreatedAt, UserID) VALUES (?, ?, ?, ?, ?, ?);",
+				id, action, t.Name, stringOrNil(t.Description), time.Now().UTC(), idOrNil(userID))
+			return err
+		})
+	})
+}
+
+// unmarshalArticleRevisions scans rows of `article_revisions`
+func unmarshalArticleRevisions(rows *sql.Rows) ([]ArticleRevision, error) {
+	revisions := []ArticleRevision{}
+	for rows.Next() {
+		var url, desc sql.NullString
+		var tags string
+		var userID sql.NullInt64
+		r := ArticleRevision{}
+		err := rows.Scan(&r.ID, &r.ArticleID, &r.Action, &r.Name, &url, &desc, &tags, &r.CreatedAt, &userID)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(tags), &r.Tags)
+		if err != nil {
+			return nil, err
+		}
+		r.URL, r.Description, r.UserID = nullStringToString(url), nullStringToString(desc), userID.Int64
+		revisions = append(revisions, r)
+	}
+	return revisions, rows.Err()
+}
+
+// unmarshalTagRevisions scans rows of `tag_revisions`
+func unmarshalTagRevisions(rows *sql.Rows) ([]TagRevision, error) {
+	revisions := []TagRevision{}
+	for rows.Next() {
+		var desc sql.NullString
+		var userID sql.NullInt64
+		r := TagRevision{}
+		err := rows.Scan(&r.ID, &r.TagID, &r.Action, &r.Name, &desc, &r.CreatedAt, &userID)
+		if err != nil {
+			return nil, err
+		}
+		r.Description, r.UserID = nullStringToString(desc), userID.Int64
+		revisions = append(revisions, r)
+	}
+	return revisions, rows.Err()
+}
+
+const (
+	articleRevisionColumns = "SELECT ID, ArticleID, Action, Name, URL, Description, Tags, CreatedAt, UserID FROM article_revisions"
+	tagRevisionColumns     = "SELECT ID, TagID, Action, Name, Description, CreatedAt, UserID FROM tag_revisions"
+)
+
+// ArticleRevisions returns `limit` revisions of article `id`, newest first, offset by `offset`
+func (db *DB) ArticleRevisions(ctx context.Context, id int64, limit, offset int) ([]ArticleRevision, error) {
+	params := []interface{}{id}
+	s := articleRevisionColumns + " WHERE ArticleID=? ORDER BY ID DESC" + db.limit(limit, offset, &params) + ";"
+	var revisions []ArticleRevision
+	err := db.read(ctx, func(ctx context.Context, c *DB) error {
+		rows, err := c.Query(ctx, s, params...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		revisions, err = unmarshalArticleRevisions(rows)
+		return err
+	})
+	if err != nil {
+		return []ArticleRevision{}, err
+	}
+	return revisions, nil
+}
+
+// ArticleRevision returns revision `rev` of article `id`, or `nil` if the article has no such revision
+func (db *DB) ArticleRevision(ctx context.Context, id, rev int64) (*ArticleRevision, error) {
+	var revisions []ArticleRevision
+	err := db.read(ctx, func(ctx context.Context, c *DB) error {
+		rows, err := c.Query(ctx, articleRevisionColumns+" WHERE ArticleID=? AND ID=?;", id, rev)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		revisions, err = unmarshalArticleRevisions(rows)
+		return err
+	})
+	if err != nil || len(revisions) == 0 {
+		return nil, err
+	}
+	return &revisions[0], nil
+}
+
+// TagRevisions returns `limit` revisions of tag `id`, newest first, offset by `offset`
+func (db *DB) TagRevisions(ctx context.Context, id int64, limit, offset int) ([]TagRevision, error) {
+	params := []interface{}{id}
+	s := tagRevisionColumns + " WHERE TagID=? ORDER BY ID DESC" + db.limit(limit, offset, &params) + ";"
+	var revisions []TagRevision
+	err := db.read(ctx, func(ctx context.Context, c *DB) error {
+		rows, err := c.Query(ctx, s, params...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		revisions, err = unmarshalTagRevisions(rows)
+		return err
+	})
+	if err != nil {
+		return []TagRevision{}, err
+	}
+	return revisions, nil
+}
+
+// TagRevision returns revision `rev` of tag `id`, or `nil` if the tag has no such revision
+func (db *DB) TagRevision(ctx context.Context, id, rev int64) (*TagRevision, error) {
+	var revisions []TagRevision
+	err := db.read(ctx, func(ctx context.Context, c *DB) error {
+		rows, err := c.Query(ctx, tagRevisionColumns+" WHERE TagID=? AND ID=?;", id, rev)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		revisions, err = unmarshalTagRevisions(rows)
+		return err
+	})
+	if err != nil || len(revisions) == 0 {
+		return nil, err
+	}
+	return &revisions[0], nil
+}
+
+// baselineArticle records the state of article `id` as its "create" revision if it has none, so articles from before
+// revisions were kept can be reverted to how they were.  Its author is unknown.  Call before changing the article
+func baselineArticle(ctx context.Context, tx Store, id int64) error {
+	revisions, err := tx.ArticleRevisions(ctx, id, 1, 0)
+	if err != nil || len(revisions) > 0 {
+		return err
+	}
+	return tx.SaveArticleRevision(ctx, id, revisionCreate, 0)
+}
+
+// baselineTag is baselineArticle for tags
+func baselineTag(ctx context.Context, tx Store, id int64) error {
+	revisions, err := tx.TagRevisions(ctx, id, 1, 0)
+	if err != nil || len(revisions) > 0 {
+		return err
+	}
+	return tx.SaveTagRevision(ctx, id, revisionCreate, 0)
+}
+
+// revisionAuthor returns the ID of the user making request `r`, or 0 if it is not logged in
+func revisionAuthor(r *http.Request) int64 {
+	if claims := requestClaims(r); claims != nil {
+		return claims.userID()
+	}
+	return 0
+}
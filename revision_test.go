@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestDiffArticles(t *testing.T) {
+	from := ArticleRevision{ID: 3, Name: "googel", URL: "g.com", Tags: []string{"engine", "Search"}}
+	to := ArticleRevision{ID: 7, Name: "google", URL: "g.com", Description: "a search engine", Tags: []string{"search", "browser"}}
+	want := RevisionDiff{From: 3, To: 7, Changes: []FieldChange{
+		{Field: "name", From: "googel", To: "google"},
+		{Field: "description", From: "", To: "a search engine"},
+		{Field: "tags", From: from.Tags, To: to.Tags, Added: []string{"browser"}, Removed: []string{"engine"}},
+	}}
+	if got := diffArticles(from, to); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffArticles = %+v, want %+v", got, want)
+	}
+
+	// reordering tags or changing their case is no change
+	to = from
+	to.Tags = []string{"search", "ENGINE"}
+	if got := diffArticles(from, to); len(got.Changes) != 0 {
+		t.Errorf("same article differs by %+v", got.Changes)
+	}
+
+	got := diffTags(TagRevision{ID: 1, Name: "engine"}, TagRevision{ID: 2, Name: "motor"})
+	if !reflect.DeepEqual(got.Changes, []FieldChange{{Field: "name", From: "engine", To: "motor"}}) {
+		t.Errorf("diffTags = %+v", got)
+	}
+}
+
+func TestSaveRevisions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, store := range testStores(t, dir) {
+		t.Run(name, func(t *testing.T) {
+			defer store.Close()
+			ctx := context.Background()
+			tagID, err := store.InsertTag(ctx, UploadTag{Name: "engine"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			userID, err := store.InsertUser(ctx, User{Name: "alice", PasswordHash: "hash", Role: RoleEditor})
+			if err != nil {
+				t.Fatal(err)
+			}
+			id, err := store.InsertArticle(ctx, UploadArticle{Name: "googel", Tags: []string{"engine"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = store.SaveArticleRevision(ctx, id, revisionCreate, 0); err != nil {
+				t.Fatal(err)
+			}
+			err = replaceArticle(ctx, store, id, UploadArticle{Name: "google", URL: "google.com"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = store.SaveArticleRevision(ctx, id, revisionEdit, userID); err != nil {
+				t.Fatal(err)
+			}
+			// an article that does not exist has nothing to record
+			if err = store.SaveArticleRevision(ctx, id+1, revisionEdit, userID); err != nil {
+				t.Fatal(err)
+			}
+
+			revisions, err := store.ArticleRevisions(ctx, id, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(revisions) != 2 {
+				t.Fatalf("article has %d revisions", len(revisions))
+			}
+			// newest first, each a snapshot of the article when it was taken
+			edit, create := revisions[0], revisions[1]
+			if edit.Action != revisionEdit || edit.Name != "google" || edit.URL != "google.com" || len(edit.Tags) != 0 || edit.UserID != userID {
+				t.Errorf("edit revision %+v", edit)
+			}
+			if create.Action != revisionCreate || create.Name != "googel" || !reflect.DeepEqual(create.Tags, []string{"engine"}) || create.UserID != 0 {
+				t.Errorf("create revision %+v", create)
+			}
+			if edit.ID <= create.ID || edit.ArticleID != id || edit.CreatedAt.IsZero() {
+				t.Errorf("revision %d after %d of article %d at %v", edit.ID, create.ID, edit.ArticleID, edit.CreatedAt)
+			}
+			// the Tags of a revision with none are an empty list, not null
+			if edit.Tags == nil {
+				t.Error("edit revision has nil tags")
+			}
+
+			if page, err := store.ArticleRevisions(ctx, id, 1, 1); err != nil || len(page) != 1 || page[0].ID != create.ID {
+				t.Errorf("second page of one revision: %+v, %v", page, err)
+			}
+			if rev, err := store.ArticleRevision(ctx, id, create.ID); err != nil || rev == nil || rev.Name != "googel" {
+				t.Errorf("revision %d: %+v, %v", create.ID, rev, err)
+			}
+			// revisions belong to their article
+			if rev, err := store.ArticleRevision(ctx, id+1, create.ID); err != nil || rev != nil {
+				t.Errorf("revision %d of another article: %+v, %v", create.ID, rev, err)
+			}
+
+			if err = store.SaveTagRevision(ctx, tagID, revisionDelete, userID); err != nil {
+				t.Fatal(err)
+			}
+			tagRevisions, err := store.TagRevisions(ctx, tagID, 0, 0)
+			if err != nil || len(tagRevisions) != 1 || tagRevisions[0].Name != "engine" || tagRevisions[0].UserID != userID {
+				t.Errorf("tag revisions %+v, %v", tagRevisions, err)
+			}
+		})
+	}
+}
+
+func TestRouterRevisions(t *testing.T) {
+	rt := newRouterTest(t)
+	rt.expect("POST", "/api/upload/tag", RoleContributor, `{"name":"engine"}`, 200)
+	rt.expect("POST", "/api/upload/tag", RoleContributor, `{"name":"search"}`, 200)
+	rt.expect("POST", "/api/upload/article", RoleContributor, `{"name":"googel","url":"g.com","tags":["engine"]}`, 200)
+	rt.expect("POST", "/api/edit/article/1", RoleEditor, `{"name":"google","tags":["search","engine"]}`, 200)
+
+	var revisions []ArticleRevision
+	if err := json.Unmarshal(rt.expect("GET", "/api/revisions/article/1", RoleEditor, "", 200).Body.Bytes(), &revisions); err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 || revisions[0].Action != revisionEdit || revisions[1].Action != revisionCreate {
+		t.Fatalf("article revisions %+v", revisions)
+	}
+	edit, create := revisions[0], revisions[1]
+	if edit.UserID == 0 || edit.UserID == create.UserID {
+		t.Errorf("edit by user %d, create by user %d", edit.UserID, create.UserID)
+	}
+
+	var diff RevisionDiff
+	path := "/api/revisions/article/1/diff?from=" + strconv.FormatInt(create.ID, 10) + "&to=" + strconv.FormatInt(edit.ID, 10)
+	if err := json.Unmarshal(rt.expect("GET", path, RoleEditor, "", 200).Body.Bytes(), &diff); err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Changes) != 3 || diff.Changes[0].Field != "name" || !reflect.DeepEqual(diff.Changes[2].Added, []string{"search"}) {
+		t.Errorf("diff %+v", diff)
+	}
+	rt.expect("GET", "/api/revisions/article/1/diff?from="+strconv.FormatInt(create.ID, 10), RoleEditor, "", 400)
+	rt.expect("GET", "/api/revisions/article/1/diff?from="+strconv.FormatInt(create.ID, 10)+"&to=99", RoleEditor, "", 404)
+
+	// reverting restores the snapshot and is itself a revision
+	rt.expect("POST", "/api/revisions/article/1/"+strconv.FormatInt(create.ID, 10)+"/revert", RoleEditor, "", 200)
+	var article DBArticle
+	if err := json.Unmarshal(rt.expect("GET", "/api/search/article/1", "", "", 200).Body.Bytes(), &article); err != nil {
+		t.Fatal(err)
+	}
+	if article.Name != "googel" || article.URL != "g.com" || !reflect.DeepEqual(article.Tags, []string{"engine"}) {
+		t.Errorf("reverted article %+v", article)
+	}
+	if got := rt.names("/api/revisions/article/1?limit=1", RoleEditor); !reflect.DeepEqual(got, []string{"googel"}) {
+		t.Errorf("latest revision %v", got)
+	}
+	rt.expect("POST", "/api/revisions/article/1/99/revert", RoleEditor, "", 404)
+	rt.expect("POST", "/api/revisions/article/2/"+strconv.FormatInt(create.ID, 10)+"/revert", RoleEditor, "", 404)
+
+	// a tag cannot be reverted to a name another tag has taken since
+	rt.expect("POST", "/api/edit/tag/1", RoleEditor, `{"name":"motor"}`, 200)
+	var tagRevisions []TagRevision
+	if err := json.Unmarshal(rt.expect("GET", "/api/revisions/tag/1", RoleEditor, "", 200).Body.Bytes(), &tagRevisions); err != nil {
+		t.Fatal(err)
+	}
+	if len(tagRevisions) != 2 || tagRevisions[0].Name != "motor" || tagRevisions[1].Name != "engine" {
+		t.Fatalf("tag revisions %+v", tagRevisions)
+	}
+	rt.expect("POST", "/api/edit/tag/2", RoleEditor, `{"name":"engine"}`, 200)
+	rt.expect("POST", "/api/revisions/tag/1/"+strconv.FormatInt(tagRevisions[1].ID, 10)+"/revert", RoleEditor, "", 403)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Role decides what a user may do, see `rolePermissions`
+type Role string
+
+const (
+	// RoleViewer may only search, as clients that are not logged in
+	RoleViewer Role = "viewer"
+	// RoleContributor may also upload articles and tags.  Users are contributors when they register
+	RoleContributor Role = "contributor"
+	// RoleEditor may also edit, delete, restore and revert articles and tags
+	RoleEditor Role = "editor"
+	// RoleAdmin may do anything, including bulk uploads and changing users' roles
+	RoleAdmin Role = "admin"
+)
+
+// Permission is something a route needs its client's role to allow
+type Permission string
+
+const (
+	permSearch     Permission = "search"
+	permUpload     Permission = "upload"
+	permEdit       Permission = "edit"
+	permDelete     Permission = "delete"
+	permBulkUpload Permission = "bulk upload"
+	// permManageUsers also covers the other /api/admin routes
+	permManageUsers Permission = "manage users"
+)
+
+// rolePermissions is the permission matrix.  Routes check it on every request, so changing a user's role takes effect on
+// their next request
+var rolePermissions = map[Role]map[Permission]bool{
+	RoleViewer:      {permSearch: true},
+	RoleContributor: {permSearch: true, permUpload: true},
+	RoleEditor:      {permSearch: true, permUpload: true, permEdit: true, permDelete: true},
+	RoleAdmin:       {permSearch: true, permUpload: true, permEdit: true, permDelete: true, permBulkUpload: true, permManageUsers: true},
+}
+
+// errLastAdmin is returned when changing the role of the only admin, which would leave nobody able to change it back
+var errLastAdmin = errors.New("cannot change the role of the last admin")
+
+// validRole checks that `role` is one of the known roles
+func validRole(role Role) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// can reports whether `role` allows `perm`
+func (role Role) can(perm Permission) bool {
+	return rolePermissions[role][perm]
+}
+
+// require wraps `h` so it only runs for clients whose role allows `perm`, answering 401 if the client must log in and 403
+// if its role is not allowed.  Clients that are not logged in have the permissions of a viewer
+func (api *API) require(perm Permission, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if RoleViewer.can(perm) {
+			h(w, r)
+			return
+		}
+		claims := requestClaims(r)
+		if claims == nil {
+			var ok bool
+			if r, ok = api.authenticate(w, r); !ok {
+				return
+			}
+			claims = requestClaims(r)
+		}
+		// roles are looked up on every request rather than kept in the token so that changes take effect immediately
+		user, err := api.store.UserByID(withPrimary(r.Context()), claims.userID())
+		if err != nil {
+			internalError("querying user", w, err)
+			return
+		} else if user == nil {
+			unauthorized(errSessionRevoked, w)
+			return
+		} else if !user.Role.can(perm) {
+			writeError("role `"+string(user.Role)+"` may not "+string(perm), 403, w)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// makeAdmin promotes user `name` to admin, first registering them with `password` if they do not exist and `password`
+// is given.  Users register as contributors, so this is how the first admin is made
+func makeAdmin(ctx context.Context, store Store, name, password string) error {
+	user, err := store.UserByName(withPrimary(ctx), name)
+	if err != nil {
+		return err
+	} else if user != nil {
+		if user.Role == RoleAdmin {
+			return nil
+		}
+		_, err = store.SetUserRole(ctx, user.ID, RoleAdmin)
+		return err
+	} else if len(password) == 0 {
+		return fmt.Errorf("no user named `%s`", name)
+	}
+	if msg, ok := (UserCredentials{Name: name, Password: password}).validate(); !ok {
+		return errors.New(msg)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = store.InsertUser(ctx, User{Name: name, PasswordHash: hash, CreatedAt: time.Now().UTC(), Role: RoleAdmin})
+	return err
+}
+
+// RoleUpdate is sent to change a user's role
+type RoleUpdate struct {
+	Role Role `json:"role" enums:"viewer,contributor,editor,admin" example:"editor"`
+}
+
+// RolePermissions lists what a role may do
+type RolePermissions struct {
+	Role        Role         `json:"role" example:"editor"`
+	Permissions []Permission `json:"permissions" example:"search,upload,edit,delete"`
+}
+
+// @Summary List Roles
+// @Description Lists each role with the permissions it grants.  Clients that are not logged in are viewers
+// @Produce json
+// @Success 200 {array} main.RolePermissions "Roles, least permissive first"
+// @Router /api/user/roles [GET]
+func (api *API) roles(w http.ResponseWriter, r *http.Request) {
+	roles := []RolePermissions{}
+	for role, perms := range rolePermissions {
+		rp := RolePermissions{Role: role, Permissions: []Permission{}}
+		for perm := range perms {
+			rp.Permissions = append(rp.Permissions, perm)
+		}
+		sort.Slice(rp.Permissions, func(i, j int) bool { return rp.Permissions[i] < rp.Permissions[j] })
+		roles = append(roles, rp)
+	}
+	sort.Slice(roles, func(i, j int) bool {
+		if len(roles[i].Permissions) != len(roles[j].Permissions) {
+			return len(roles[i].Permissions) < len(roles[j].Permissions)
+		}
+		return roles[i].Role < roles[j].Role
+	})
+	resp, err := json.Marshal(roles)
+	if err != nil {
+		internalError("marshalling response", w, err)
+		return
+	}
+	w.Write(resp)
+}
+
+// @Summary List Users
+// @Description Admins only
+// @Param limit query integer false "Maximum number of results.  Defaults to 50, at most 500"
+// @Param offset query integer false "Results to skip"
+// @Produce json
+// @Security Bearer
+// @Success 200 {array} main.User "Users, oldest first"
+// @Failure 401 {object} main.ErrJSON "Missing or invalid token"
+// @Failure 403 {object} main.ErrJSON "Not an admin"
+// @Failure 500 {object} main.ErrJSON "Internal error"
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
+// @Router /api/admin/users [GET]
+func (api *API) listUsers(w http.ResponseWriter, r *http.Request) {
+	parts := make(map[string]string)
+	for k, v := range r.URL.Query() {
+		parts[k] = v[0]
+	}
+	limit, offset := readLimit(parts)
+	users, err := api.store.Users(r.Context(), limit, offset)
+	if err != nil {
+		internalError("querying users", w, err)
+		return
+	}
+	resp, err := json.Marshal(users)
+	if err != nil {
+		internalError("marshalling response", w, err)
+		return
+	}
+	w.Write(resp)
+}
+
+// @Summary Change User's Role
+// @Description Admins only.  The last admin cannot be demoted
+// @Accept  json
+// @Param id path integer true "ID of user"
+// @Param role body main.RoleUpdate true "New role"
+// @Security Bearer
+// @Success 200 "Ok"
+// @Failure 400 {object} main.ErrJSON "Bad request, or unknown role"
+// @Failure 401 {object} main.ErrJSON "Missing or invalid token"
+// @Failure 403 {object} main.ErrJSON "Not an admin, or demoting the last admin"
+// @Failure 404 {object} main.ErrJSON "User does not exist"
+// @Failure 500 {object} main.ErrJSON "Internal error"
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
+// @Router /api/admin/users/{id}/role [POST]
+func (api *API) setUserRole(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeError("invalid id", 400, w)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		internalError("reading body", w, err)
+		return
+	}
+	update := RoleUpdate{}
+	if err = json.Unmarshal(body, &update); err != nil {
+		writeError("malformed request", 400, w)
+		return
+	}
+	update.Role = Role(strings.ToLower(string(update.Role)))
+	if !validRole(update.Role) {
+		writeError("unknown role `"+string(update.Role)+"`", 400, w)
+		return
+	}
+	found, err := api.store.SetUserRole(r.Context(), id, update.Role)
+	if err == errLastAdmin {
+		writeError(errLastAdmin.Error(), 403, w)
+		return
+	} else if err != nil {
+		internalError("updating role", w, err)
+		return
+	} else if !found {
+		writeError("user not found", 404, w)
+		return
+	}
+}
+
+// Users lists users, oldest first
+func (db *DB) Users(ctx context.Context, limit, offset int) ([]User, error) {
+	var params []interface{}
+	s := "SELECT ID, Name, PasswordHash, CreatedAt, Role FROM users ORDER BY ID" + db.limit(limit, offset, &params) + ";"
+	users := []User{}
+	err := db.read(ctx, func(ctx context.Context, c *DB) error {
+		rows, err := c.Query(ctx, s, params...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			u := User{}
+			if err = rows.Scan(&u.ID, &u.Name, &u.PasswordHash, &u.CreatedAt, &u.Role); err != nil {
+				return err
+			}
+			users = append(users, u)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return []User{}, err
+	}
+	return users, nil
+}
+
+// SetUserRole changes user `id`'s role, reporting whether the user exists.  Returns `errLastAdmin` rather than demote the
+// only admin
+func (db *DB) SetUserRole(ctx context.Context, id int64, role Role) (bool, error) {
+	found := false
+	err := db.run(ctx, func(ctx context.Context, c *DB) error {
+		return c.withTx(ctx, func(tx *DB) error {
+			var current Role
+			err := tx.QueryRow(ctx, "SELECT Role FROM users WHERE ID=?"+tx.forUpdate()+";", id).Scan(&current)
+			if err == sql.ErrNoRows {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			found = true
+			if current == RoleAdmin && role != RoleAdmin {
+				// the admins stay locked so two admins demoting each other cannot both see the other one left
+				admins, err := tx.Query(ctx, "SELECT ID FROM users WHERE Role=?"+tx.forUpdate()+";", RoleAdmin)
+				if err != nil {
+					return err
+				}
+				n := 0
+				for admins.Next() {
+					n++
+				}
+				admins.Close()
+				if err = admins.Err(); err != nil {
+					return err
+				} else if n <= 1 {
+					return errLastAdmin
+				}
+			}
+			res, err := tx.Exec(ctx, "UPDATE users SET Role=? WHERE ID=?;", role, id)
+			if err != nil {
+				return err
+			}
+			affected, err := res.RowsAffected()
+			found = affected > 0 || current == role
+			return err
+		})
+	})
+	return found, err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStores returns a MemStore and a fresh SQLite DB in `dir`
+func testStores(t *testing.T, dir string) map[string]Store {
+	db, err := SQLiteConnect(filepath.Join(dir, "test.db"), PoolConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Init()
+	return map[string]Store{"memory": NewMemStore(), "sqlite": db}
+}
+
+func TestSetUserRoleLastAdmin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, store := range testStores(t, dir) {
+		t.Run(name, func(t *testing.T) {
+			defer store.Close()
+			ctx := context.Background()
+			var admins []int64
+			for _, name := range []string{"alice", "bob"} {
+				id, err := store.InsertUser(ctx, User{Name: name, PasswordHash: "x", CreatedAt: time.Now().UTC(), Role: RoleAdmin})
+				if err != nil {
+					t.Fatal(err)
+				}
+				admins = append(admins, id)
+			}
+
+			// each demotes the other at once, and one must be refused
+			errs := make([]error, 2)
+			var wg sync.WaitGroup
+			for ii := range admins {
+				wg.Add(1)
+				go func(ii int) {
+					defer wg.Done()
+					_, errs[ii] = store.SetUserRole(ctx, admins[1-ii], RoleEditor)
+				}(ii)
+			}
+			wg.Wait()
+			refused := 0
+			for _, err := range errs {
+				if err == errLastAdmin {
+					refused++
+				} else if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if refused != 1 {
+				t.Errorf("%d of 2 demotions refused", refused)
+			}
+
+			users, err := store.Users(ctx, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n := 0
+			for _, u := range users {
+				if u.Role == RoleAdmin {
+					n++
+				}
+			}
+			if n != 1 {
+				t.Errorf("%d admins left", n)
+			}
+
+			if found, err := store.SetUserRole(ctx, 1000, RoleEditor); found || err != nil {
+				t.Errorf("missing user: %v, %v", found, err)
+			}
+		})
+	}
+}
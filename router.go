@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,6 +12,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	_ "github.com/acarlson99/debatabase/docs" // docs is generated by Swag CLI, you have to import it.
 	"github.com/gorilla/mux"
@@ -21,8 +24,42 @@ const (
 	errInvalidID       = "invalid id"
 	errIDNotFound      = "id not found"
 	errNotAllTagsExist = "not all tags exist"
+	errTagNameInTrash  = "a tag with this name is in the trash, restore it instead"
+	errRevisionMissing = "revision not found"
+	errQueryTimeout    = "database query timed out"
+	errCanceled        = "request cancelled"
 )
 
+// API holds the dependencies shared by request handlers
+type API struct {
+	store Store
+	index *SearchIndex
+
+	// bulkheads for searches, single writes, CSV imports and password checks
+	search, write, bulk, logins *Bulkhead
+	// how long a client's reads go to the primary database after it writes
+	primaryWindow time.Duration
+	// where article images are kept
+	images BlobStore
+	// how long signed image URLs last
+	imageURLExpiry time.Duration
+	// signing and lifetime of login tokens
+	auth AuthConfig
+}
+
+// RouterConfig tunes the handlers made by CreateRouter
+type RouterConfig struct {
+	Bulkheads BulkheadConfig
+	// PrimaryWindow is how long a client's reads skip the read replicas after it writes, so it sees its own changes
+	PrimaryWindow time.Duration
+	// Images stores the images uploaded with articles
+	Images BlobStore
+	// ImageURLExpiry is how long the URLs images are redirected to last, if `Images` can sign URLs.  0 serves images
+	// through the API instead
+	ImageURLExpiry time.Duration
+	Auth           AuthConfig
+}
+
 // ErrJSON is an error message to be sent as response to request
 type ErrJSON struct {
 	Code  int    `json:"code,omitempty"`
@@ -30,6 +67,43 @@ type ErrJSON struct {
 	Error string `json:"error,omitempty"`
 }
 
+// SearchQuery is the normalized search a page of results came from
+type SearchQuery struct {
+	Tags      []string `json:"tags"`
+	TagQuery  string   `json:"tagquery,omitempty" example:"(economy OR immigration) AND NOT terrorism"`
+	Lookslike string   `json:"lookslike,omitempty"`
+	Fulltext  string   `json:"fulltext,omitempty"`
+	Q         string   `json:"q,omitempty"`
+	Orderby   string   `json:"orderby" example:"name"`
+	Reverse   bool     `json:"reverse"`
+}
+
+// ArticlePage is a page of article search results, returned instead of a bare array with `envelope=true`
+type ArticlePage struct {
+	Items []DBArticle `json:"items"`
+	// Number of matching articles across every page
+	Total int `json:"total" example:"120"`
+	Limit int `json:"limit" example:"50"`
+	// Number of matching articles before this page
+	Offset int `json:"offset" example:"100"`
+	// Pass as `cursor` for the next page.  Omitted on the last page
+	NextCursor string      `json:"next_cursor,omitempty"`
+	Query      SearchQuery `json:"query"`
+}
+
+// TagPage is a page of tag search results, returned instead of a bare array with `envelope=true`
+type TagPage struct {
+	Items []DBTag `json:"items"`
+	// Number of matching tags across every page
+	Total int `json:"total" example:"120"`
+	Limit int `json:"limit" example:"50"`
+	// Number of matching tags before this page
+	Offset int `json:"offset" example:"100"`
+	// Pass as `cursor` for the next page.  Omitted on the last page
+	NextCursor string      `json:"next_cursor,omitempty"`
+	Query      SearchQuery `json:"query"`
+}
+
 // writes `code` and JSON encoded `msg`
 func writeError(msg string, code int, w http.ResponseWriter) {
 	w.WriteHeader(code)
@@ -53,8 +127,38 @@ func writeNotFoundError(w http.ResponseWriter) {
 	writeError(errIDNotFound, 404, w)
 }
 
-// internalError writes a 500 response to a ResponseWriter and logs an error
+// requestError aborts a transaction, responding with `code` and `msg` instead of a 500
+type requestError struct {
+	code int
+	msg  string
+}
+
+func (e *requestError) Error() string {
+	return e.msg
+}
+
+// writeTxError writes the response for an error returned by Store.WithTx
+func writeTxError(logMsg string, w http.ResponseWriter, err error) {
+	var re *requestError
+	if errors.As(err, &re) {
+		writeError(re.msg, re.code, w)
+		return
+	}
+	internalError(logMsg, w, err)
+}
+
+// internalError writes a 500 response to a ResponseWriter and logs an error.
+// Errors from database calls cut short by the query timeout or by the client hanging up get a 504 or 503 instead
 func internalError(logMsg string, w http.ResponseWriter, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Println("Timed out", logMsg+":", err)
+		writeError(errQueryTimeout, 504, w)
+		return
+	} else if errors.Is(err, context.Canceled) {
+		log.Println("Cancelled", logMsg+":", err)
+		writeError(errCanceled, 503, w)
+		return
+	}
 	log.Println("Error", logMsg+":", err)
 	code := 500
 	w.WriteHeader(code)
@@ -71,24 +175,32 @@ func internalError(logMsg string, w http.ResponseWriter, err error) {
 
 // @Summary Search articles
 // @Param tags query string false "Tag names" collectionFormat(csv)
-// @Param limit query integer false "Maximum number of results"
-// @Param offset query integer false "Results to skip.  Does nothing unless 'limit' is specified"
+// @Param tagquery query string false "Boolean expression of tag names, e.g. (economy OR immigration) AND NOT terrorism.  \"Quote\" names containing spaces, parentheses or AND/OR/NOT"
+// @Param limit query integer false "Maximum number of results.  Defaults to 50, at most 500"
+// @Param offset query integer false "Results to skip.  Prefer 'cursor'"
+// @Param cursor query string false "Continue from the 'X-Next-Cursor' header of the previous page.  Requires the same 'orderby' and 'reverse'"
 // @Param lookslike query string false "Filter for matching names/descriptions"
-// @Param orderby query string false "Field by which to order results" Enums(id, name, description)
+// @Param fulltext query string false "Full-text search of names/descriptions.  Every word must match, \"quoted phrases\" must match in order"
+// @Param q query string false "Ranked search of names, descriptions, URL hosts and tag names.  Any word may match, stop words and word endings are ignored.  Cannot be combined with 'fulltext'"
+// @Param orderby query string false "Field by which to order results.  'relevance' (default with 'fulltext' or 'q') only applies to those searches" Enums(id, name, description, relevance)
 // @Param reverse query boolean false "Reverse search results"
+// @Param envelope query boolean false "Return a main.ArticlePage with the total and pagination metadata instead of an array"
 // @Produce json
-// @Success 200 {array} main.DBArticle "All matching articles"
+// @Success 200 {array} main.DBArticle "A page of matching articles.  'X-Next-Cursor' is set if there are more"
+// @Failure 400 {object} main.ErrJSON "Invalid 'tagquery' or 'cursor', or both 'q' and 'fulltext' supplied"
 // @Failure 500 {object} main.ErrJSON "Internal error"
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
 // @Router /api/search/article?tags=engine,train&limit=5&offset=5&lookslike=american&orderby=name [GET]
-func searchArticle(w http.ResponseWriter, r *http.Request) {
+func (api *API) searchArticle(w http.ResponseWriter, r *http.Request) {
 	parts := make(map[string]string)
 	for k, v := range r.URL.Query() {
 		parts[k] = v[0]
 	}
 	tags := parts["tags"]
-	limit, _ := strconv.Atoi(parts["limit"])
-	offset, _ := strconv.Atoi(parts["offset"])
 	lookslike := parts["lookslike"]
+	fulltext := parts["fulltext"]
+	q := parts["q"]
 	orderby := parts["orderby"]
 	rev := parts["reverse"] == "true"
 
@@ -97,13 +209,63 @@ func searchArticle(w http.ResponseWriter, r *http.Request) {
 		sp = strings.Split(tags, ",")
 	}
 
-	articles, err := db.ArticlesWithTagsSearch(sp, lookslike, orderby, rev, limit, offset)
+	var tq tagQuery
+	var err error
+	if len(parts["tagquery"]) > 0 {
+		tq, err = parseTagQuery(parts["tagquery"])
+		if err != nil {
+			writeError(err.Error(), 400, w)
+			return
+		}
+	}
+
+	if len(q) > 0 && len(fulltext) > 0 {
+		writeError("`q` and `fulltext` cannot be combined", 400, w)
+		return
+	}
+	order := searchOrder(orderby, len(q) > 0 || len(fulltext) > 0)
+	limit, offset, after, err := readPage(parts, order, rev)
+	if err != nil {
+		writeError(err.Error(), 400, w)
+		return
+	}
+
+	envelope := parts["envelope"] == "true"
+	// one extra result tells whether there is another page
+	var articles []DBArticle
+	var total int
+	if len(q) > 0 {
+		articles, total = api.index.Search(q, sp, tq, lookslike, orderby, rev, after, limit+1, offset)
+	} else if len(fulltext) > 0 {
+		articles, total, err = api.store.ArticlesFullTextSearch(r.Context(), sp, tq, fulltext, lookslike, orderby, rev, after, limit+1, offset, envelope)
+	} else {
+		articles, total, err = api.store.ArticlesWithTagsSearch(r.Context(), sp, tq, lookslike, orderby, rev, after, limit+1, offset, envelope)
+	}
 	if err != nil {
 		internalError("querying tags", w, err)
 		return
 	}
+	position := offset
+	if after != nil {
+		position = after.Offset
+	}
+	next := ""
+	if len(articles) > limit {
+		articles = articles[:limit]
+		last := articles[limit-1]
+		next = nextCursor(order, rev, position, limit, last.ID, last.Name, last.Description)
+		w.Header().Set("X-Next-Cursor", next)
+	}
 
-	resp, err := json.Marshal(articles)
+	var body interface{} = articles
+	if envelope {
+		query := SearchQuery{Tags: sp, Lookslike: lookslike, Fulltext: fulltext, Q: q, Orderby: order, Reverse: rev}
+		if tq != nil {
+			query.TagQuery = tq.String()
+		}
+		body = ArticlePage{Items: articles, Total: total, Limit: limit, Offset: position, NextCursor: next, Query: query}
+	}
+	resp, err := json.Marshal(body)
 	if err != nil {
 		internalError("marshalling response", w, err)
 		return
@@ -118,14 +280,16 @@ func searchArticle(w http.ResponseWriter, r *http.Request) {
 // @Failure 400 {object} main.ErrJSON "Bad request"
 // @Failure 404 {object} main.ErrJSON "Article not found"
 // @Failure 500 {object} main.ErrJSON string "Internal error"
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
 // @Router /api/search/article/{id} [GET]
-func searchArticleID(w http.ResponseWriter, r *http.Request) {
+func (api *API) searchArticleID(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
 		writeInvalidIDError(w)
 		return
 	}
-	articles, err := db.ArticleByID(int64(id))
+	articles, err := api.store.ArticleByID(r.Context(), int64(id))
 	if err != nil {
 		internalError("querying tags", w, err)
 		return
@@ -144,23 +308,26 @@ func searchArticleID(w http.ResponseWriter, r *http.Request) {
 
 // @Summary Search tags
 // @Param tags query string false "Tag names" collectionFormat(csv)
-// @Param limit query integer false "Maximum number of results"
-// @Param offset query integer false "Results to skip.  Does nothing unless 'limit' is specified"
+// @Param limit query integer false "Maximum number of results.  Defaults to 50, at most 500"
+// @Param offset query integer false "Results to skip.  Prefer 'cursor'"
+// @Param cursor query string false "Continue from the 'X-Next-Cursor' header of the previous page.  Requires the same 'orderby' and 'reverse'"
 // @Param lookslike query string false "Filter for matching names/descriptions"
 // @Param orderby query string false "Field by which to order results" Enums(id, name, description)
 // @Param reverse query boolean false "Reverse search results"
+// @Param envelope query boolean false "Return a main.TagPage with the total and pagination metadata instead of an array"
 // @Produce json
-// @Success 200 {array} main.DBTag "All matching tags"
+// @Success 200 {array} main.DBTag "A page of matching tags.  'X-Next-Cursor' is set if there are more"
+// @Failure 400 {object} main.ErrJSON "Invalid 'cursor'"
 // @Failure 500 {object} main.ErrJSON "Internal error"
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
 // @Router /api/search/tag?tags=engine,train&limit=5&offset=5&lookslike=american&orderby=name [GET]
-func searchTag(w http.ResponseWriter, r *http.Request) {
+func (api *API) searchTag(w http.ResponseWriter, r *http.Request) {
 	parts := make(map[string]string)
 	for k, v := range r.URL.Query() {
 		parts[k] = v[0]
 	}
 	tagStr := parts["tags"]
-	limit, _ := strconv.Atoi(parts["limit"])
-	offset, _ := strconv.Atoi(parts["offset"]) // NOTE: does nothing unless `limit` is specified
 	lookslike := parts["lookslike"]
 	orderby := parts["orderby"]
 	rev := parts["reverse"] == "true"
@@ -170,13 +337,38 @@ func searchTag(w http.ResponseWriter, r *http.Request) {
 		sp = strings.Split(tagStr, ",")
 	}
 
-	tags, err := db.TagSearch(sp, lookslike, orderby, rev, limit, offset)
+	order := searchOrder(orderby, false)
+	limit, offset, after, err := readPage(parts, order, rev)
+	if err != nil {
+		writeError(err.Error(), 400, w)
+		return
+	}
+
+	envelope := parts["envelope"] == "true"
+	// one extra result tells whether there is another page
+	tags, total, err := api.store.TagSearch(r.Context(), sp, lookslike, orderby, rev, after, limit+1, offset, envelope)
 	if err != nil {
 		internalError("querying tags", w, err)
 		return
 	}
+	position := offset
+	if after != nil {
+		position = after.Offset
+	}
+	next := ""
+	if len(tags) > limit {
+		tags = tags[:limit]
+		last := tags[limit-1]
+		next = nextCursor(order, rev, position, limit, last.ID, last.Name, last.Description)
+		w.Header().Set("X-Next-Cursor", next)
+	}
 
-	resp, err := json.Marshal(tags)
+	var body interface{} = tags
+	if envelope {
+		query := SearchQuery{Tags: sp, Lookslike: lookslike, Orderby: order, Reverse: rev}
+		body = TagPage{Items: tags, Total: total, Limit: limit, Offset: position, NextCursor: next, Query: query}
+	}
+	resp, err := json.Marshal(body)
 	if err != nil {
 		internalError("marshalling response", w, err)
 		return
@@ -191,14 +383,16 @@ func searchTag(w http.ResponseWriter, r *http.Request) {
 // @Failure 400 {object} main.ErrJSON "Bad request"
 // @Failure 404 {object} main.ErrJSON "Tag not found"
 // @Failure 500 {object} main.ErrJSON "Internal error"
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
 // @Router /api/search/tag/{id} [GET]
-func searchTagID(w http.ResponseWriter, r *http.Request) {
+func (api *API) searchTagID(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
 		writeInvalidIDError(w)
 		return
 	}
-	tags, err := db.TagByID(int64(id))
+	tags, err := api.store.TagByID(r.Context(), int64(id))
 	if err != nil {
 		internalError("querying tags", w, err)
 		return
@@ -215,82 +409,174 @@ func searchTagID(w http.ResponseWriter, r *http.Request) {
 	w.Write(resp)
 }
 
-func uploadCSVArticle(w http.ResponseWriter, r *http.Request) {
-	reader := csv.NewReader(r.Body)
-	for {
-		// name,url,description,tags
-		fields, err := reader.Read()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			log.Println("Error parsing CSV:", err)
-		}
-		if len(fields) != 4 {
-			log.Println("BAD NUMNER OF FIELDS")
-			continue
-		}
-		a := UploadArticle{
-			Name:        fields[0],
-			URL:         fields[1],
-			Description: fields[2],
-			Tags:        strings.Split(fields[3], ","),
-		}
-		_, err = db.InsertArticle(a)
-		if err != nil {
-			log.Println("Error inserting article:", err)
-		}
-	}
-	err := r.Body.Close()
+// @Summary Check health
+// @Produce json
+// @Success 200 {object} main.ConnState "Connected to the database"
+// @Failure 503 {object} main.ConnState "Not connected to the database"
+// @Router /api/health [GET]
+func (api *API) health(w http.ResponseWriter, r *http.Request) {
+	state := api.store.ConnState()
+	resp, err := json.Marshal(state)
 	if err != nil {
-		log.Println("Error closing http.Request body:", err)
+		internalError("marshalling response", w, err)
+		return
 	}
+	if state.Status != connUp {
+		w.WriteHeader(503)
+	}
+	w.Write(resp)
 }
 
-func uploadCSVTag(w http.ResponseWriter, r *http.Request) {
-	reader := csv.NewReader(r.Body)
-	for {
-		// name,description
-		fields, err := reader.Read()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			log.Println("Error parsing CSV:", err)
+// csvHeaderRow reports whether `fields` is the optional header row `header`
+func csvHeaderRow(fields []string, header ...string) bool {
+	if len(fields) != len(header) {
+		return false
+	}
+	for ii := range fields {
+		if !strings.EqualFold(strings.TrimSpace(fields[ii]), header[ii]) {
+			return false
 		}
-		if len(fields) != 2 {
-			log.Println("BAD NUMNER OF FIELDS")
-			continue
+	}
+	return true
+}
+
+// uploadCSVArticle inserts every article in the body or, if any row is invalid, none of them
+func (api *API) uploadCSVArticle(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		err := r.Body.Close()
+		if err != nil {
+			log.Println("Error closing http.Request body:", err)
 		}
-		t := UploadTag{
-			Name:        fields[0],
-			Description: fields[1],
+	}()
+	reader := csv.NewReader(r.Body)
+	// name,url,description,tags
+	reader.FieldsPerRecord = 4
+	err := api.store.WithTx(r.Context(), func(tx Store) error {
+		for line := 1; ; line++ {
+			fields, err := reader.Read()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return &requestError{400, "invalid CSV: " + err.Error()}
+			}
+			if line == 1 && csvHeaderRow(fields, "name", "url", "description", "tags") {
+				continue
+			}
+			a := UploadArticle{
+				Name:        fields[0],
+				URL:         fields[1],
+				Description: fields[2],
+				Tags: filterArr(strings.Split(fields[3], ","), func(s string) bool {
+					return len(s) > 0
+				}),
+			}
+			if len(a.Name) == 0 {
+				return &requestError{400, fmt.Sprintf("line %d: %s", line, errEmptyName)}
+			}
+			id, err := tx.InsertArticle(r.Context(), a)
+			if err == errTagsNotExist {
+				return &requestError{422, fmt.Sprintf("line %d: %s", line, errNotAllTagsExist)}
+			} else if err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			err = tx.SaveArticleRevision(r.Context(), id, revisionCreate, revisionAuthor(r))
+			if err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
 		}
-		_, err = db.InsertTag(t)
+	})
+	if err != nil {
+		writeTxError("inserting articles", w, err)
+		return
+	}
+}
+
+// uploadCSVTag inserts every tag in the body or, if any row is invalid, none of them
+func (api *API) uploadCSVTag(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		err := r.Body.Close()
 		if err != nil {
-			log.Println("Error inserting article:", err)
+			log.Println("Error closing http.Request body:", err)
 		}
-	}
-	err := r.Body.Close()
+	}()
+	reader := csv.NewReader(r.Body)
+	// name,description
+	reader.FieldsPerRecord = 2
+	err := api.store.WithTx(r.Context(), func(tx Store) error {
+		for line := 1; ; line++ {
+			fields, err := reader.Read()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return &requestError{400, "invalid CSV: " + err.Error()}
+			}
+			if line == 1 && csvHeaderRow(fields, "name", "description") {
+				continue
+			}
+			t := UploadTag{
+				Name:        fields[0],
+				Description: fields[1],
+			}
+			if len(t.Name) == 0 {
+				return &requestError{400, fmt.Sprintf("line %d: %s", line, errEmptyName)}
+			}
+			if _, exists := tx.TagNameExists(r.Context(), t.Name); exists {
+				return &requestError{403, fmt.Sprintf("line %d: tag exists", line)}
+			}
+			id, err := tx.InsertTag(r.Context(), t)
+			if err == errTagInTrash {
+				return &requestError{403, fmt.Sprintf("line %d: %s", line, errTagNameInTrash)}
+			} else if err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			err = tx.SaveTagRevision(r.Context(), id, revisionCreate, revisionAuthor(r))
+			if err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+	})
 	if err != nil {
-		log.Println("Error closing http.Request body:", err)
+		writeTxError("inserting tags", w, err)
+		return
 	}
 }
 
+// readArticleBody reads the body of `r`, an article that may carry images, writing an error and returning false if it is
+// larger than `maxArticleBody` or cannot be read
+func readArticleBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxArticleBody))
+	if err != nil && int64(len(body)) >= maxArticleBody {
+		writeError(fmt.Sprintf("articles must be at most %d bytes", maxArticleBody), 413, w)
+		return nil, false
+	} else if err != nil {
+		internalError("reading body", w, err)
+		return nil, false
+	}
+	return body, true
+}
+
 // @Summary Create Article
+// @Description Images are stored and listed in the article's `images` by filename, to be fetched from /api/image/{filename}
 // @Accept json
 // @Param tag body main.UploadArticle true "Article data"
+// @Security Bearer
 // @Success 200 "Ok"
-// @Failure 400 {object} main.ErrJSON "Bad request"
+// @Failure 400 {object} main.ErrJSON "Bad request, or invalid image(s)"
+// @Failure 401 {object} main.ErrJSON "Missing or invalid token"
+// @Failure 403 {object} main.ErrJSON "Role not allowed"
+// @Failure 413 {object} main.ErrJSON "Image or article too large"
 // @Failure 422 {object} main.ErrJSON "Invalid tag(s)"
 // @Failure 500 {object} main.ErrJSON "Internal error"
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
 // @Router /api/upload/article [POST]
-func uploadArticle(w http.ResponseWriter, r *http.Request) {
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		internalError("reading body", w, err)
+func (api *API) uploadArticle(w http.ResponseWriter, r *http.Request) {
+	body, ok := readArticleBody(w, r)
+	if !ok {
 		return
 	}
 	article := UploadArticle{}
-	err = json.Unmarshal(body, &article)
+	err := json.Unmarshal(body, &article)
 	if err != nil || len(article.Name) == 0 {
 		if err != nil {
 			log.Println("Error unmarshalling data:", err)
@@ -301,22 +587,29 @@ func uploadArticle(w http.ResponseWriter, r *http.Request) {
 	article.Tags = filterArr(article.Tags, func(s string) bool {
 		return len(s) > 0
 	})
-	fmt.Printf("%+v\n", article)
 
 	err = r.Body.Close()
 	if err != nil {
 		log.Println("Error closing http.Request body:", err)
 	}
 
-	// check if all tags exist
-	if _, e := db.TagNamesExist(article.Tags...); !e {
-		writeError(errNotAllTagsExist, 422, w)
+	err = api.storeImages(r.Context(), article.Images)
+	if err != nil {
+		writeTxError("storing images", w, err)
 		return
 	}
-
-	_, err = db.InsertArticle(article)
+	err = api.store.WithTx(r.Context(), func(tx Store) error {
+		id, err := tx.InsertArticle(r.Context(), article)
+		if err == errTagsNotExist {
+			return &requestError{422, errNotAllTagsExist}
+		} else if err != nil {
+			return err
+		}
+		return tx.SaveArticleRevision(r.Context(), id, revisionCreate, revisionAuthor(r))
+	})
 	if err != nil {
-		internalError("inserting article", w, err)
+		// the images are collected once `imageGracePeriod` passes
+		writeTxError("inserting article", w, err)
 		return
 	}
 }
@@ -324,12 +617,16 @@ func uploadArticle(w http.ResponseWriter, r *http.Request) {
 // @Summary Create Tag
 // @Accept  json
 // @Param tag body main.UploadTag true "Tag data"
+// @Security Bearer
 // @Success 200 "Ok"
 // @Failure 400 {object} main.ErrJSON "Bad request"
-// @Failure 403 {object} main.ErrJSON "Duplicate tag"
+// @Failure 401 {object} main.ErrJSON "Missing or invalid token"
+// @Failure 403 {object} main.ErrJSON "Duplicate tag, possibly in the trash, or role not allowed"
 // @Failure 500 {object} main.ErrJSON "Internal error"
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
 // @Router /api/upload/tag [POST]
-func uploadTag(w http.ResponseWriter, r *http.Request) {
+func (api *API) uploadTag(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		internalError("reading body", w, err)
@@ -341,10 +638,9 @@ func uploadTag(w http.ResponseWriter, r *http.Request) {
 		writeError(errEmptyName, 400, w)
 		return
 	}
-	fmt.Printf("%+v\n", tag)
 
 	// check duplicates
-	if _, r := db.TagNameExists(tag.Name); r {
+	if _, exists := api.store.TagNameExists(r.Context(), tag.Name); exists {
 		writeError("tag exists", 403, w)
 		log.Println("Not inserting tag. Already exists")
 		return
@@ -355,32 +651,46 @@ func uploadTag(w http.ResponseWriter, r *http.Request) {
 		log.Println("Error closing http.Request body:", err)
 	}
 
-	_, err = db.InsertTag(tag)
+	err = api.store.WithTx(r.Context(), func(tx Store) error {
+		id, err := tx.InsertTag(r.Context(), tag)
+		if err == errTagInTrash {
+			return &requestError{403, errTagNameInTrash}
+		} else if err != nil {
+			return err
+		}
+		return tx.SaveTagRevision(r.Context(), id, revisionCreate, revisionAuthor(r))
+	})
 	if err != nil {
-		internalError("inserting article", w, err)
+		writeTxError("inserting tag", w, err)
 		return
 	}
 }
 
 // @Summary Modify Article
+// @Description Omit `images` to keep the article's images, or send a list, possibly empty, to replace them
 // @Accept  json
 // @Param id path integer true "ID of article to modify"
 // @Param article body main.UploadArticle true "Updated article data"
+// @Security Bearer
 // @Success 200 "Ok"
-// @Failure 400 {object} main.ErrJSON "Bad request"
+// @Failure 400 {object} main.ErrJSON "Bad request, or invalid image(s)"
+// @Failure 401 {object} main.ErrJSON "Missing or invalid token"
+// @Failure 403 {object} main.ErrJSON "Role not allowed"
 // @Failure 404 {object} main.ErrJSON "Article does not exist"
+// @Failure 413 {object} main.ErrJSON "Image or article too large"
 // @Failure 422 {object} main.ErrJSON "Invalid tag(s)"
 // @Failure 500 {object} main.ErrJSON "Internal error"
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
 // @Router /api/edit/article/{id} [POST]
-func editArticle(w http.ResponseWriter, r *http.Request) {
+func (api *API) editArticle(w http.ResponseWriter, r *http.Request) {
 	article := UploadArticle{}
-	s, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		internalError("reading body", w, err)
+	s, ok := readArticleBody(w, r)
+	if !ok {
 		return
 	}
 	r.Body.Close()
-	err = json.Unmarshal(s, &article)
+	err := json.Unmarshal(s, &article)
 	id2, err2 := strconv.Atoi(mux.Vars(r)["id"])
 	id := int64(id2)
 	if err != nil {
@@ -396,50 +706,79 @@ func editArticle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// check if article exists
-	res, err := db.ArticleByID(id)
+	err = api.storeImages(r.Context(), article.Images)
 	if err != nil {
-		internalError("querying DB", w, err)
+		writeTxError("storing images", w, err)
 		return
-	} else if res == nil {
-		writeNotFoundError(w)
+	}
+	var replaced []string
+	err = api.store.WithTx(r.Context(), func(tx Store) error {
+		// check if article exists
+		res, err := tx.ArticleByID(r.Context(), id)
+		if err != nil {
+			return err
+		} else if res == nil {
+			return &requestError{404, errIDNotFound}
+		}
+		err = baselineArticle(r.Context(), tx, id)
+		if err != nil {
+			return err
+		}
+		err = replaceArticle(r.Context(), tx, id, article)
+		if err != nil {
+			return err
+		}
+		if article.Images != nil {
+			replaced = res.Images
+		}
+		return tx.SaveArticleRevision(r.Context(), id, revisionEdit, revisionAuthor(r))
+	})
+	if err != nil {
+		// the images are collected once `imageGracePeriod` passes
+		writeTxError("updating article", w, err)
 		return
 	}
+	api.releaseImages(replaced)
+}
+
+// replaceArticle overwrites article `id` with `article`, tags included.  Aborts with a 422 if a tag does not exist
+func replaceArticle(ctx context.Context, tx Store, id int64, article UploadArticle) error {
 	// check if tags exist
-	tagIDs, exists := db.TagNamesExist(article.Tags...)
+	tagIDs, exists := tx.TagNamesExist(ctx, article.Tags...)
 	if !exists {
-		writeError(errNotAllTagsExist, 422, w)
-		return
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return &requestError{422, errNotAllTagsExist}
 	}
 	// update
-	err = db.UpdateArticle(id, article)
+	err := tx.UpdateArticle(ctx, id, article)
 	if err != nil {
-		internalError("updating article", w, err)
-		return
+		return err
 	}
 	// update tags
-	err = db.RemoveArticleTags(id)
-	if err != nil {
-		internalError("removing tags", w, err)
-		return
-	}
-	err = db.InsertArticleTags(id, tagIDs)
+	err = tx.RemoveArticleTags(ctx, id)
 	if err != nil {
-		internalError("updating tags", w, err)
-		return
+		return err
 	}
+	return tx.InsertArticleTags(ctx, id, uniqueIDs(tagIDs))
 }
 
 // @Summary Modify Tag
 // @Accept  json
 // @Param id path integer true "ID of tag to modify"
 // @Param tag body main.UploadTag true "Updated tag data"
+// @Security Bearer
 // @Success 200 "Ok"
 // @Failure 400 {object} main.ErrJSON "Bad request"
+// @Failure 401 {object} main.ErrJSON "Missing or invalid token"
+// @Failure 403 {object} main.ErrJSON "Role not allowed"
 // @Failure 404 {object} main.ErrJSON "Tag does not exist"
 // @Failure 500 {object} main.ErrJSON "Internal error"
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
 // @Router /api/edit/tag/{id} [POST]
-func editTag(w http.ResponseWriter, r *http.Request) {
+func (api *API) editTag(w http.ResponseWriter, r *http.Request) {
 	tag := UploadTag{}
 	s, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -463,196 +802,603 @@ func editTag(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// check if exists
-	res, err := db.TagByID(id)
+	err = api.store.WithTx(r.Context(), func(tx Store) error {
+		// check if exists
+		res, err := tx.TagByID(r.Context(), id)
+		if err != nil {
+			return err
+		} else if res == nil {
+			return &requestError{404, errIDNotFound}
+		}
+		err = baselineTag(r.Context(), tx, id)
+		if err != nil {
+			return err
+		}
+		err = tx.UpdateTag(r.Context(), id, tag)
+		if err != nil {
+			return err
+		}
+		return tx.SaveTagRevision(r.Context(), id, revisionEdit, revisionAuthor(r))
+	})
 	if err != nil {
-		internalError("querying DB", w, err)
+		writeTxError("updating tag", w, err)
 		return
-	} else if res == nil {
-		writeNotFoundError(w)
+	}
+}
+
+// @Summary Delete Article
+// @Description Moves the article to the trash, from which it can be restored until it is purged
+// @Accept  json
+// @Param id path integer true "ID of article to modify"
+// @Security Bearer
+// @Success 200 "Ok"
+// @Failure 400 {object} main.ErrJSON "Bad request"
+// @Failure 401 {object} main.ErrJSON "Missing or invalid token"
+// @Failure 403 {object} main.ErrJSON "Role not allowed"
+// @Failure 404 {object} main.ErrJSON "Tag does not exist"
+// @Failure 500 {object} main.ErrJSON "Internal error"
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
+// @Router /api/del/article/{id} [POST]
+// @Router /api/del/article/{id} [DELETE]
+func (api *API) deleteArticle(w http.ResponseWriter, r *http.Request) {
+	id2, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeInvalidIDError(w)
 		return
 	}
-	// update
-	err = db.UpdateTag(id, tag)
+	id := int64(id2)
+	err = api.store.WithTx(r.Context(), func(tx Store) error {
+		res, err := tx.ArticleByID(r.Context(), id)
+		if err != nil {
+			return err
+		} else if res == nil {
+			return &requestError{404, errIDNotFound}
+		}
+		err = baselineArticle(r.Context(), tx, id)
+		if err != nil {
+			return err
+		}
+		// article-tag links are kept for restoring
+		err = tx.RemoveArticle(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		return tx.SaveArticleRevision(r.Context(), id, revisionDelete, revisionAuthor(r))
+	})
 	if err != nil {
-		internalError("updating tag", w, err)
+		writeTxError("querying DB", w, err)
 		return
 	}
 }
 
-// @Summary Delete Article
+// @Summary Delete Tag
+// @Description Moves the tag to the trash, from which it can be restored until it is purged
 // @Accept  json
-// @Param id path integer true "ID of article to modify"
+// @Param id path integer true "ID of tag to modify"
+// @Security Bearer
 // @Success 200 "Ok"
 // @Failure 400 {object} main.ErrJSON "Bad request"
+// @Failure 401 {object} main.ErrJSON "Missing or invalid token"
+// @Failure 403 {object} main.ErrJSON "Role not allowed"
 // @Failure 404 {object} main.ErrJSON "Tag does not exist"
 // @Failure 500 {object} main.ErrJSON "Internal error"
-// @Router /api/del/article/{id} [GET]
-func deleteArticle(w http.ResponseWriter, r *http.Request) {
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
+// @Router /api/del/tag/{id} [POST]
+// @Router /api/del/tag/{id} [DELETE]
+func (api *API) deleteTag(w http.ResponseWriter, r *http.Request) {
 	id2, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
 		writeInvalidIDError(w)
 		return
 	}
 	id := int64(id2)
-	res, err := db.ArticleByID(id)
+	err = api.store.WithTx(r.Context(), func(tx Store) error {
+		res, err := tx.TagByID(r.Context(), id)
+		if err != nil {
+			return err
+		} else if res == nil {
+			return &requestError{404, errIDNotFound}
+		}
+		err = baselineTag(r.Context(), tx, id)
+		if err != nil {
+			return err
+		}
+		// article-tag links are kept for restoring
+		err = tx.RemoveTag(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		return tx.SaveTagRevision(r.Context(), id, revisionDelete, revisionAuthor(r))
+	})
 	if err != nil {
-		internalError("querying DB", w, err)
+		writeTxError("querying DB", w, err)
 		return
-	} else if res == nil {
-		writeNotFoundError(w)
+	}
+}
+
+// @Summary List articles in the trash
+// @Param limit query integer false "Maximum number of results.  Defaults to 50, at most 500"
+// @Param offset query integer false "Results to skip"
+// @Produce json
+// @Security Bearer
+// @Success 200 {array} main.DBArticle "Articles in the trash, most recently deleted first"
+// @Failure 401 {object} main.ErrJSON "Missing or invalid token"
+// @Failure 403 {object} main.ErrJSON "Role not allowed"
+// @Failure 500 {object} main.ErrJSON "Internal error"
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
+// @Router /api/trash/article [GET]
+func (api *API) trashedArticles(w http.ResponseWriter, r *http.Request) {
+	parts := make(map[string]string)
+	for k, v := range r.URL.Query() {
+		parts[k] = v[0]
+	}
+	limit, offset := readLimit(parts)
+	articles, err := api.store.TrashedArticles(r.Context(), limit, offset)
+	if err != nil {
+		internalError("querying trash", w, err)
 		return
 	}
-	err = db.RemoveArticle(id)
+	resp, err := json.Marshal(articles)
 	if err != nil {
-		internalError("querying DB", w, err)
+		internalError("marshalling response", w, err)
 		return
 	}
-	err = db.RemoveArticleTags(id)
+	w.Write(resp)
+}
+
+// @Summary List tags in the trash
+// @Param limit query integer false "Maximum number of results.  Defaults to 50, at most 500"
+// @Param offset query integer false "Results to skip"
+// @Produce json
+// @Security Bearer
+// @Success 200 {array} main.DBTag "Tags in the trash, most recently deleted first"
+// @Failure 401 {object} main.ErrJSON "Missing or invalid token"
+// @Failure 403 {object} main.ErrJSON "Role not allowed"
+// @Failure 500 {object} main.ErrJSON "Internal error"
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
+// @Router /api/trash/tag [GET]
+func (api *API) trashedTags(w http.ResponseWriter, r *http.Request) {
+	parts := make(map[string]string)
+	for k, v := range r.URL.Query() {
+		parts[k] = v[0]
+	}
+	limit, offset := readLimit(parts)
+	tags, err := api.store.TrashedTags(r.Context(), limit, offset)
 	if err != nil {
-		internalError("querying DB", w, err)
+		internalError("querying trash", w, err)
 		return
 	}
+	resp, err := json.Marshal(tags)
+	if err != nil {
+		internalError("marshalling response", w, err)
+		return
+	}
+	w.Write(resp)
 }
 
-// @Summary Delete Tag
-// @Accept  json
-// @Param id path integer true "ID of tag to modify"
+// @Summary Restore Article
+// @Description Takes the article out of the trash along with its links to tags
+// @Param id path integer true "ID of article to restore"
+// @Security Bearer
 // @Success 200 "Ok"
 // @Failure 400 {object} main.ErrJSON "Bad request"
-// @Failure 404 {object} main.ErrJSON "Tag does not exist"
+// @Failure 401 {object} main.ErrJSON "Missing or invalid token"
+// @Failure 403 {object} main.ErrJSON "Role not allowed"
+// @Failure 404 {object} main.ErrJSON "Article is not in the trash"
+// @Failure 500 {object} main.ErrJSON "Internal error"
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
+// @Router /api/trash/article/{id}/restore [POST]
+func (api *API) restoreArticle(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeInvalidIDError(w)
+		return
+	}
+	err = api.store.WithTx(r.Context(), func(tx Store) error {
+		restored, err := tx.RestoreArticle(r.Context(), int64(id))
+		if err != nil {
+			return err
+		} else if !restored {
+			return &requestError{404, errIDNotFound}
+		}
+		return tx.SaveArticleRevision(r.Context(), int64(id), revisionRestore, revisionAuthor(r))
+	})
+	if err != nil {
+		writeTxError("restoring article", w, err)
+		return
+	}
+}
+
+// @Summary Restore Tag
+// @Description Takes the tag out of the trash along with its links to articles
+// @Param id path integer true "ID of tag to restore"
+// @Security Bearer
+// @Success 200 "Ok"
+// @Failure 400 {object} main.ErrJSON "Bad request"
+// @Failure 401 {object} main.ErrJSON "Missing or invalid token"
+// @Failure 403 {object} main.ErrJSON "Role not allowed"
+// @Failure 404 {object} main.ErrJSON "Tag is not in the trash"
+// @Failure 500 {object} main.ErrJSON "Internal error"
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
+// @Router /api/trash/tag/{id}/restore [POST]
+func (api *API) restoreTag(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeInvalidIDError(w)
+		return
+	}
+	err = api.store.WithTx(r.Context(), func(tx Store) error {
+		restored, err := tx.RestoreTag(r.Context(), int64(id))
+		if err != nil {
+			return err
+		} else if !restored {
+			return &requestError{404, errIDNotFound}
+		}
+		return tx.SaveTagRevision(r.Context(), int64(id), revisionRestore, revisionAuthor(r))
+	})
+	if err != nil {
+		writeTxError("restoring tag", w, err)
+		return
+	}
+}
+
+// revisionRange reads the `from` and `to` revision numbers of a diff request
+func revisionRange(r *http.Request) (from, to int64, ok bool) {
+	q := r.URL.Query()
+	from, err := strconv.ParseInt(q.Get("from"), 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	to, err = strconv.ParseInt(q.Get("to"), 10, 64)
+	return from, to, err == nil
+}
+
+// @Summary List Article Revisions
+// @Param id path integer true "ID of article"
+// @Param limit query integer false "Maximum number of results.  Defaults to 50, at most 500"
+// @Param offset query integer false "Results to skip"
+// @Produce json
+// @Security Bearer
+// @Success 200 {array} main.ArticleRevision "Revisions of the article, newest first"
+// @Failure 400 {object} main.ErrJSON "Bad request"
+// @Failure 401 {object} main.ErrJSON "Missing or invalid token"
+// @Failure 403 {object} main.ErrJSON "Role not allowed"
+// @Failure 500 {object} main.ErrJSON "Internal error"
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
+// @Router /api/revisions/article/{id} [GET]
+func (api *API) articleRevisions(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeInvalidIDError(w)
+		return
+	}
+	parts := make(map[string]string)
+	for k, v := range r.URL.Query() {
+		parts[k] = v[0]
+	}
+	limit, offset := readLimit(parts)
+	revisions, err := api.store.ArticleRevisions(r.Context(), int64(id), limit, offset)
+	if err != nil {
+		internalError("querying revisions", w, err)
+		return
+	}
+	resp, err := json.Marshal(revisions)
+	if err != nil {
+		internalError("marshalling response", w, err)
+		return
+	}
+	w.Write(resp)
+}
+
+// @Summary List Tag Revisions
+// @Param id path integer true "ID of tag"
+// @Param limit query integer false "Maximum number of results.  Defaults to 50, at most 500"
+// @Param offset query integer false "Results to skip"
+// @Produce json
+// @Security Bearer
+// @Success 200 {array} main.TagRevision "Revisions of the tag, newest first"
+// @Failure 400 {object} main.ErrJSON "Bad request"
+// @Failure 401 {object} main.ErrJSON "Missing or invalid token"
+// @Failure 403 {object} main.ErrJSON "Role not allowed"
+// @Failure 500 {object} main.ErrJSON "Internal error"
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
+// @Router /api/revisions/tag/{id} [GET]
+func (api *API) tagRevisions(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeInvalidIDError(w)
+		return
+	}
+	parts := make(map[string]string)
+	for k, v := range r.URL.Query() {
+		parts[k] = v[0]
+	}
+	limit, offset := readLimit(parts)
+	revisions, err := api.store.TagRevisions(r.Context(), int64(id), limit, offset)
+	if err != nil {
+		internalError("querying revisions", w, err)
+		return
+	}
+	resp, err := json.Marshal(revisions)
+	if err != nil {
+		internalError("marshalling response", w, err)
+		return
+	}
+	w.Write(resp)
+}
+
+// @Summary Diff Article Revisions
+// @Description Lists the fields that changed between two revisions of an article
+// @Param id path integer true "ID of article"
+// @Param from query integer true "Revision to compare from"
+// @Param to query integer true "Revision to compare to"
+// @Produce json
+// @Security Bearer
+// @Success 200 {object} main.RevisionDiff "Changed fields"
+// @Failure 400 {object} main.ErrJSON "Bad request"
+// @Failure 401 {object} main.ErrJSON "Missing or invalid token"
+// @Failure 403 {object} main.ErrJSON "Role not allowed"
+// @Failure 404 {object} main.ErrJSON "Article has no such revision"
+// @Failure 500 {object} main.ErrJSON "Internal error"
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
+// @Router /api/revisions/article/{id}/diff [GET]
+func (api *API) diffArticleRevisions(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeInvalidIDError(w)
+		return
+	}
+	from, to, ok := revisionRange(r)
+	if !ok {
+		writeError("from and to must be revision numbers", 400, w)
+		return
+	}
+	a, err := api.store.ArticleRevision(r.Context(), int64(id), from)
+	if err != nil {
+		internalError("querying revisions", w, err)
+		return
+	}
+	b, err := api.store.ArticleRevision(r.Context(), int64(id), to)
+	if err != nil {
+		internalError("querying revisions", w, err)
+		return
+	} else if a == nil || b == nil {
+		writeError(errRevisionMissing, 404, w)
+		return
+	}
+	resp, err := json.Marshal(diffArticles(*a, *b))
+	if err != nil {
+		internalError("marshalling response", w, err)
+		return
+	}
+	w.Write(resp)
+}
+
+// @Summary Diff Tag Revisions
+// @Description Lists the fields that changed between two revisions of a tag
+// @Param id path integer true "ID of tag"
+// @Param from query integer true "Revision to compare from"
+// @Param to query integer true "Revision to compare to"
+// @Produce json
+// @Security Bearer
+// @Success 200 {object} main.RevisionDiff "Changed fields"
+// @Failure 400 {object} main.ErrJSON "Bad request"
+// @Failure 401 {object} main.ErrJSON "Missing or invalid token"
+// @Failure 403 {object} main.ErrJSON "Role not allowed"
+// @Failure 404 {object} main.ErrJSON "Tag has no such revision"
+// @Failure 500 {object} main.ErrJSON "Internal error"
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
+// @Router /api/revisions/tag/{id}/diff [GET]
+func (api *API) diffTagRevisions(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeInvalidIDError(w)
+		return
+	}
+	from, to, ok := revisionRange(r)
+	if !ok {
+		writeError("from and to must be revision numbers", 400, w)
+		return
+	}
+	a, err := api.store.TagRevision(r.Context(), int64(id), from)
+	if err != nil {
+		internalError("querying revisions", w, err)
+		return
+	}
+	b, err := api.store.TagRevision(r.Context(), int64(id), to)
+	if err != nil {
+		internalError("querying revisions", w, err)
+		return
+	} else if a == nil || b == nil {
+		writeError(errRevisionMissing, 404, w)
+		return
+	}
+	resp, err := json.Marshal(diffTags(*a, *b))
+	if err != nil {
+		internalError("marshalling response", w, err)
+		return
+	}
+	w.Write(resp)
+}
+
+// @Summary Revert Article
+// @Description Sets the article's name, url, description and tags back to how they were at a revision.  The revert is recorded as a new revision
+// @Param id path integer true "ID of article to revert"
+// @Param rev path integer true "Revision to revert to"
+// @Security Bearer
+// @Success 200 "Ok"
+// @Failure 400 {object} main.ErrJSON "Bad request"
+// @Failure 401 {object} main.ErrJSON "Missing or invalid token"
+// @Failure 403 {object} main.ErrJSON "Role not allowed"
+// @Failure 404 {object} main.ErrJSON "Article does not exist or has no such revision"
+// @Failure 422 {object} main.ErrJSON "Tags at that revision no longer exist"
 // @Failure 500 {object} main.ErrJSON "Internal error"
-// @Router /api/del/tag/{id} [GET]
-func deleteTag(w http.ResponseWriter, r *http.Request) {
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
+// @Router /api/revisions/article/{id}/{rev}/revert [POST]
+func (api *API) revertArticle(w http.ResponseWriter, r *http.Request) {
 	id2, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
 		writeInvalidIDError(w)
 		return
 	}
+	rev, err := strconv.ParseInt(mux.Vars(r)["rev"], 10, 64)
+	if err != nil {
+		writeError("invalid revision", 400, w)
+		return
+	}
 	id := int64(id2)
-	res, err := db.TagByID(id)
+	err = api.store.WithTx(r.Context(), func(tx Store) error {
+		res, err := tx.ArticleByID(r.Context(), id)
+		if err != nil {
+			return err
+		} else if res == nil {
+			return &requestError{404, errIDNotFound}
+		}
+		old, err := tx.ArticleRevision(r.Context(), id, rev)
+		if err != nil {
+			return err
+		} else if old == nil {
+			return &requestError{404, errRevisionMissing}
+		}
+		err = replaceArticle(r.Context(), tx, id, UploadArticle{
+			Name:        old.Name,
+			URL:         old.URL,
+			Description: old.Description,
+			Tags:        old.Tags,
+		})
+		if err != nil {
+			return err
+		}
+		return tx.SaveArticleRevision(r.Context(), id, revisionRevert, revisionAuthor(r))
+	})
 	if err != nil {
-		internalError("querying DB", w, err)
+		writeTxError("reverting article", w, err)
 		return
-	} else if res == nil {
-		writeNotFoundError(w)
+	}
+}
+
+// @Summary Revert Tag
+// @Description Sets the tag's name and description back to how they were at a revision.  The revert is recorded as a new revision
+// @Param id path integer true "ID of tag to revert"
+// @Param rev path integer true "Revision to revert to"
+// @Security Bearer
+// @Success 200 "Ok"
+// @Failure 400 {object} main.ErrJSON "Bad request"
+// @Failure 401 {object} main.ErrJSON "Missing or invalid token"
+// @Failure 403 {object} main.ErrJSON "Another tag has the name the tag had at that revision, or role not allowed"
+// @Failure 404 {object} main.ErrJSON "Tag does not exist or has no such revision"
+// @Failure 500 {object} main.ErrJSON "Internal error"
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
+// @Router /api/revisions/tag/{id}/{rev}/revert [POST]
+func (api *API) revertTag(w http.ResponseWriter, r *http.Request) {
+	id2, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeInvalidIDError(w)
+		return
+	}
+	rev, err := strconv.ParseInt(mux.Vars(r)["rev"], 10, 64)
+	if err != nil {
+		writeError("invalid revision", 400, w)
+		return
+	}
+	id := int64(id2)
+	err = api.store.WithTx(r.Context(), func(tx Store) error {
+		res, err := tx.TagByID(r.Context(), id)
+		if err != nil {
+			return err
+		} else if res == nil {
+			return &requestError{404, errIDNotFound}
+		}
+		old, err := tx.TagRevision(r.Context(), id, rev)
+		if err != nil {
+			return err
+		} else if old == nil {
+			return &requestError{404, errRevisionMissing}
+		}
+		if other, exists := tx.TagNameExists(r.Context(), old.Name); exists && other != id {
+			return &requestError{403, "tag exists"}
+		}
+		err = tx.UpdateTag(r.Context(), id, UploadTag{Name: old.Name, Description: old.Description})
+		if err != nil {
+			return err
+		}
+		return tx.SaveTagRevision(r.Context(), id, revisionRevert, revisionAuthor(r))
+	})
+	if err != nil {
+		writeTxError("reverting tag", w, err)
 		return
 	}
-	err = db.RemoveTag(id)
-	if err != nil {
-		internalError("querying DB", w, err)
-		return
-	}
-	err = db.RemoveTagsFromArticles(id)
-	if err != nil {
-		internalError("querying DB", w, err)
-		return
-	}
-}
-
-// // @Summary Create User
-// // @Accept  json
-// // @Param user body main.DocUser true "User data"
-// // @Success 200 "Ok"
-// // @Failure 400 {object} main.ErrJSON "Bad request"
-// // @Failure 403 {object} main.ErrJSON "Duplicate"
-// // @Failure 500 {object} main.ErrJSON "Internal error"
-// // @Router /api/user/create [POST]
-// func userCreateHandler(w http.ResponseWriter, r *http.Request) {
-// 	body, err := ioutil.ReadAll(r.Body)
-// 	if err != nil {
-// 		internalError("reading body", w, err)
-// 		return
-// 	}
-// 	user := User{}
-// 	err = json.Unmarshal(body, &user)
-// 	if err != nil || len(user.Name) < UNameMinLen || len(user.Name) > UNameMaxLen || len(user.Passwd) < UPasswdMinLen || len(user.Passwd) > UNameMaxLen {
-// 		if err != nil {
-// 			log.Println("Error unmarshalling data:", err)
-// 			writeError("malformed request", 400, w)
-// 		} else {
-// 			writeError("invalid fields", 400, w)
-// 		}
-// 		return
-// 	}
-
-// 	// no duplicates
-// 	u, err := db.UserByName(user.Name)
-// 	if u != nil {
-// 		// user already exists
-// 		// forbidden
-// 		writeError("username taken", 403, w)
-// 		return
-// 	} else if err != nil {
-// 		internalError("querying users", w, err)
-// 		return
-// 	}
-
-// 	_, err = db.InsertUser(user)
-// 	if err != nil {
-// 		internalError("querying users", w, err)
-// 		return
-// 	}
-// }
-
-// // @Summary Log in as User
-// // @Accept  json
-// // @Param user body main.DocUser true "User data"
-// // @Success 200 {object} main.User "JWT token"
-// // @Failure 400 {object} main.ErrJSON "Bad request"
-// // @Failure 403 {object} main.ErrJSON "Invalid credentials"
-// // @Failure 500 {object} main.ErrJSON "Internal error"
-// // @Router /api/user/auth [POST]
-// func userAuthHandler(w http.ResponseWriter, r *http.Request) {
-// 	body, err := ioutil.ReadAll(r.Body)
-// 	if err != nil {
-// 		internalError("reading body", w, err)
-// 		return
-// 	}
-// 	user := User{}
-// 	err = json.Unmarshal(body, &user)
-// 	if err != nil || len(user.Name) < UNameMinLen || len(user.Name) > UNameMaxLen || len(user.Passwd) < UPasswdMinLen || len(user.Passwd) > UNameMaxLen {
-// 		if err != nil {
-// 			log.Println("Error unmarshalling data:", err)
-// 			writeError("malformed request", 400, w)
-// 		} else {
-// 			writeError("invalid fields", 400, w)
-// 		}
-// 		return
-// 	}
-
-// 	u, err := db.UserByName(user.Name)
-// 	if err != nil {
-// 		internalError("querying users", w, err)
-// 		return
-// 	} else if u == nil || user.Name != u.Name || user.Passwd != u.Passwd {
-// 		// user doesn't exist.  Cannot log in
-// 		// forbidden
-// 		writeError("invalid", 403, w)
-// 		return
-// 	}
-
-// 	// TODO: create JWT token and write to connection
-// 	resp, err := json.Marshal(*u)
-// 	if err != nil {
-// 		internalError("querying users", w, err)
-// 		return
-// 	}
-// 	w.Write(resp)
-// }
+}
+
+// writer wraps write handler `h` in bulkhead `b` and sends the client's following reads to the primary database
+func (api *API) writer(b *Bulkhead, h http.HandlerFunc) http.HandlerFunc {
+	return limit(b, wrote(api.primaryWindow, h))
+}
 
 func enableCors(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Next-Cursor, Retry-After, "+primaryHeader)
 		h.ServeHTTP(w, r)
 	})
 }
 
-// CreateRouter returns a new mux.Router with appropriately registered paths
-func CreateRouter(frontendStaticFiles string) *mux.Router {
+// preflight answers CORS preflight requests to any path, letting the frontend on another origin send tokens and JSON
+func preflight(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, "+primaryHeader)
+	w.Header().Set("Access-Control-Max-Age", "600")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateRouter returns a new mux.Router with appropriately registered paths whose handlers query `store` and its search index
+func CreateRouter(store *IndexedStore, config RouterConfig, frontendStaticFiles string) *mux.Router {
 	r := mux.NewRouter().StrictSlash(true)
+	bulkheads := config.Bulkheads
+	api := &API{
+		store:          store,
+		index:          store.index,
+		search:         newBulkhead("search", bulkheads.Search, bulkheads.QueueTimeout),
+		write:          newBulkhead("write", bulkheads.Write, bulkheads.QueueTimeout),
+		bulk:           newBulkhead("import", bulkheads.Import, bulkheads.QueueTimeout),
+		logins:         newBulkhead("login", bulkheads.Login, bulkheads.QueueTimeout),
+		primaryWindow:  config.PrimaryWindow,
+		images:         config.Images,
+		imageURLExpiry: config.ImageURLExpiry,
+		auth:           config.Auth,
+	}
+	if len(api.auth.Secret) == 0 {
+		secret, err := randomToken(32)
+		if err != nil {
+			panic(err)
+		}
+		api.auth.Secret = []byte(secret)
+	}
+	if api.auth.AccessTokenExpiry <= 0 {
+		api.auth.AccessTokenExpiry = defaultAccessTokenExpiry
+	}
+	if api.auth.RefreshTokenExpiry <= 0 {
+		api.auth.RefreshTokenExpiry = defaultRefreshTokenExpiry
+	}
 
 	r.Use(enableCors)
+	r.Use(api.readYourWrites)
+	// everything but reads, registering and logging in needs a token
+	r.Use(api.requireAuth)
+	// routes only accept their own methods, so preflights need a route of their own
+	r.Methods("OPTIONS").HandlerFunc(preflight)
 
 	// swagger serve
 	r.PathPrefix("/swagger/").Handler(httpSwagger.Handler(
@@ -660,26 +1406,46 @@ func CreateRouter(frontendStaticFiles string) *mux.Router {
 		httpSwagger.DocExpansion("list"),
 	))
 
+	r.HandleFunc("/api/health", api.health).Methods("GET")
 	// search
-	r.HandleFunc("/api/search/article/{id}", searchArticleID)
-	r.HandleFunc("/api/search/article", searchArticle)
-	r.HandleFunc("/api/search/tag/{id}", searchTagID)
-	r.HandleFunc("/api/search/tag", searchTag)
+	r.HandleFunc("/api/search/article/{id}", api.require(permSearch, limit(api.search, api.searchArticleID)))
+	r.HandleFunc("/api/search/article", api.require(permSearch, limit(api.search, api.searchArticle)))
+	r.HandleFunc("/api/search/tag/{id}", api.require(permSearch, limit(api.search, api.searchTagID)))
+	r.HandleFunc("/api/search/tag", api.require(permSearch, limit(api.search, api.searchTag)))
+	r.HandleFunc("/api/image/{filename}", api.require(permSearch, limit(api.search, api.serveImage))).Methods("GET")
+	r.HandleFunc("/api/admin/stats", api.require(permManageUsers, limit(api.search, api.adminStats))).Methods("GET")
 	// upload
-	r.HandleFunc("/api/upload/article/csv", uploadCSVArticle).Methods("POST") // create new article
-	r.HandleFunc("/api/upload/article", uploadArticle).Methods("POST")        // create new article
-	r.HandleFunc("/api/upload/tag/csv", uploadCSVTag).Methods("POST")         // create new tag
-	r.HandleFunc("/api/upload/tag", uploadTag).Methods("POST")                // create new tag
+	r.HandleFunc("/api/upload/article/csv", api.require(permBulkUpload, api.writer(api.bulk, api.uploadCSVArticle))).Methods("POST") // create new article
+	r.HandleFunc("/api/upload/article", api.require(permUpload, api.writer(api.write, api.uploadArticle))).Methods("POST")           // create new article
+	r.HandleFunc("/api/upload/tag/csv", api.require(permBulkUpload, api.writer(api.bulk, api.uploadCSVTag))).Methods("POST")         // create new tag
+	r.HandleFunc("/api/upload/tag", api.require(permUpload, api.writer(api.write, api.uploadTag))).Methods("POST")                   // create new tag
 	// edit
-	r.HandleFunc("/api/edit/article/{id}", editArticle).Methods("POST") // modify article by ID
-	r.HandleFunc("/api/edit/tag/{id}", editTag).Methods("POST")         // modify tag by ID
+	r.HandleFunc("/api/edit/article/{id}", api.require(permEdit, api.writer(api.write, api.editArticle))).Methods("POST") // modify article by ID
+	r.HandleFunc("/api/edit/tag/{id}", api.require(permEdit, api.writer(api.write, api.editTag))).Methods("POST")         // modify tag by ID
 	// delete
-	r.HandleFunc("/api/del/article/{id}", deleteArticle)
-	r.HandleFunc("/api/del/tag/{id}", deleteTag)
-	// // user
-	// // TODO: add users
-	// r.HandleFunc("/api/user/create", userCreateHandler) // creates user
-	// r.HandleFunc("/api/user/auth", userAuthHandler)     // sends Json Web Token to client if uname/passwd match DB
+	r.HandleFunc("/api/del/article/{id}", api.require(permDelete, api.writer(api.write, api.deleteArticle))).Methods("POST", "DELETE") // move article to trash
+	r.HandleFunc("/api/del/tag/{id}", api.require(permDelete, api.writer(api.write, api.deleteTag))).Methods("POST", "DELETE")         // move tag to trash
+	// trash
+	r.HandleFunc("/api/trash/article", api.require(permDelete, limit(api.search, api.trashedArticles))).Methods("GET")
+	r.HandleFunc("/api/trash/tag", api.require(permDelete, limit(api.search, api.trashedTags))).Methods("GET")
+	r.HandleFunc("/api/trash/article/{id}/restore", api.require(permDelete, api.writer(api.write, api.restoreArticle))).Methods("POST")
+	r.HandleFunc("/api/trash/tag/{id}/restore", api.require(permDelete, api.writer(api.write, api.restoreTag))).Methods("POST")
+
+	r.HandleFunc("/api/revisions/article/{id}", api.require(permEdit, limit(api.search, api.articleRevisions))).Methods("GET")
+	r.HandleFunc("/api/revisions/tag/{id}", api.require(permEdit, limit(api.search, api.tagRevisions))).Methods("GET")
+	r.HandleFunc("/api/revisions/article/{id}/diff", api.require(permEdit, limit(api.search, api.diffArticleRevisions))).Methods("GET")
+	r.HandleFunc("/api/revisions/tag/{id}/diff", api.require(permEdit, limit(api.search, api.diffTagRevisions))).Methods("GET")
+	r.HandleFunc("/api/revisions/article/{id}/{rev}/revert", api.require(permEdit, api.writer(api.write, api.revertArticle))).Methods("POST")
+	r.HandleFunc("/api/revisions/tag/{id}/{rev}/revert", api.require(permEdit, api.writer(api.write, api.revertTag))).Methods("POST")
+	// user
+	r.HandleFunc("/api/user/create", api.writer(api.logins, api.createUser)).Methods("POST")    // register user
+	r.HandleFunc("/api/user/auth", api.writer(api.logins, api.authUser)).Methods("POST")        // log in, issuing tokens
+	r.HandleFunc("/api/user/refresh", api.writer(api.write, api.refreshTokens)).Methods("POST") // swap refresh token for new tokens
+	r.HandleFunc("/api/user/logout", api.writer(api.write, api.logout)).Methods("POST")         // revoke session
+	r.HandleFunc("/api/user/roles", api.roles).Methods("GET")                                   // permission matrix
+	// admin
+	r.HandleFunc("/api/admin/users", api.require(permManageUsers, limit(api.search, api.listUsers))).Methods("GET")
+	r.HandleFunc("/api/admin/users/{id}/role", api.require(permManageUsers, api.writer(api.write, api.setUserRole))).Methods("POST")
 
 	// serve
 	// TODO: fix serving, serve only `index.html` with valid path (/search /present etc.)
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// routerTest is a router over a MemStore with a logged in user of every role
+type routerTest struct {
+	t      *testing.T
+	store  *IndexedStore
+	router http.Handler
+	tokens map[Role]string
+}
+
+func newRouterTest(t *testing.T) *routerTest {
+	store := NewSearchIndex().Wrap(NewMemStore())
+	rt := &routerTest{
+		t:      t,
+		store:  store,
+		router: CreateRouter(store, RouterConfig{Auth: AuthConfig{Secret: []byte("test secret")}}, ""),
+		tokens: map[Role]string{},
+	}
+	ctx := context.Background()
+	for _, role := range []Role{RoleViewer, RoleContributor, RoleEditor, RoleAdmin} {
+		login := `{"name":"` + string(role) + `","password":"password"}`
+		rt.expect("POST", "/api/user/create", "", login, 200)
+		user, err := store.UserByName(ctx, string(role))
+		if err != nil || user == nil {
+			t.Fatal("registered user not found:", err)
+		}
+		if role == RoleAdmin {
+			err = makeAdmin(ctx, store, user.Name, "")
+		} else if role != RoleContributor {
+			_, err = store.SetUserRole(ctx, user.ID, role)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens := Tokens{}
+		if err := json.Unmarshal(rt.expect("POST", "/api/user/auth", "", login, 200).Body.Bytes(), &tokens); err != nil {
+			t.Fatal(err)
+		}
+		rt.tokens[role] = tokens.AccessToken
+	}
+	return rt
+}
+
+// do sends a request as a user with `role`, or without a token if `role` is empty
+func (rt *routerTest) do(method, path string, role Role, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if len(role) > 0 {
+		req.Header.Set("Authorization", "Bearer "+rt.tokens[role])
+	}
+	w := httptest.NewRecorder()
+	rt.router.ServeHTTP(w, req)
+	return w
+}
+
+// expect is do, failing the test unless the response has status `code`
+func (rt *routerTest) expect(method, path string, role Role, body string, code int) *httptest.ResponseRecorder {
+	rt.t.Helper()
+	w := rt.do(method, path, role, body)
+	if w.Code != code {
+		rt.t.Fatalf("%s %s as %q: got %d %s, want %d", method, path, role, w.Code, strings.TrimSpace(w.Body.String()), code)
+	}
+	return w
+}
+
+// names searches `path` as a user with `role` and returns the names of the articles or tags found
+func (rt *routerTest) names(path string, role Role) []string {
+	rt.t.Helper()
+	var found []struct{ Name string }
+	if err := json.Unmarshal(rt.expect("GET", path, role, "", 200).Body.Bytes(), &found); err != nil {
+		rt.t.Fatal(err)
+	}
+	names := []string{}
+	for _, f := range found {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+// seed uploads a few tags and articles
+func (rt *routerTest) seed() {
+	for _, tag := range []string{"engine", "search", "train"} {
+		rt.expect("POST", "/api/upload/tag", RoleContributor, `{"name":"`+tag+`"}`, 200)
+	}
+	for _, article := range []string{
+		`{"name":"google","description":"a popular search engine","tags":["engine","search"]}`,
+		`{"name":"locomotive","description":"a railway engine","tags":["engine","train"]}`,
+		`{"name":"bing","description":"another search engine","tags":["search"]}`,
+		`{"name":"amtrak","description":"american passenger trains","tags":["train"]}`,
+	} {
+		rt.expect("POST", "/api/upload/article", RoleContributor, article, 200)
+	}
+}
+
+func TestRouterSearch(t *testing.T) {
+	rt := newRouterTest(t)
+	rt.seed()
+	for path, want := range map[string][]string{
+		"/api/search/article":                                                                 {"google", "locomotive", "bing", "amtrak"},
+		"/api/search/article?orderby=name":                                                    {"amtrak", "bing", "google", "locomotive"},
+		"/api/search/article?orderby=name&reverse=true":                                       {"locomotive", "google", "bing", "amtrak"},
+		"/api/search/article?orderby=name&limit=2":                                            {"amtrak", "bing"},
+		"/api/search/article?orderby=name&limit=2&offset=1":                                   {"bing", "google"},
+		"/api/search/article?tags=train":                                                      {"locomotive", "amtrak"},
+		"/api/search/article?lookslike=search":                                                {"google", "bing"},
+		"/api/search/article?fulltext=railway":                                                {"locomotive"},
+		"/api/search/article?q=railways":                                                      {"locomotive"},
+		"/api/search/article?tagquery=" + url.QueryEscape("engine AND NOT train"):             {"google"},
+		"/api/search/article?tagquery=" + url.QueryEscape("(train OR search) AND NOT engine"): {"bing", "amtrak"},
+		"/api/search/tag?orderby=name&reverse=true":                                           {"train", "search", "engine"},
+		"/api/search/tag?tags=engine,train":                                                   {"engine", "train"},
+	} {
+		if got := rt.names(path, ""); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", path, got, want)
+		}
+	}
+	for _, path := range []string{
+		"/api/search/article?tagquery=" + url.QueryEscape("engine AND"),
+		"/api/search/article?q=engine&fulltext=engine",
+		"/api/search/article?cursor=nonsense",
+	} {
+		rt.expect("GET", path, "", "", 400)
+	}
+}
+
+func TestRouterCursor(t *testing.T) {
+	rt := newRouterTest(t)
+	rt.seed()
+	for _, base := range []string{"/api/search/article?orderby=name&limit=3", "/api/search/tag?orderby=id&reverse=true&limit=2"} {
+		var all []string
+		path := base
+		for pages := 1; ; pages++ {
+			if pages > 4 {
+				t.Fatal(base, "never ran out of pages")
+			}
+			w := rt.expect("GET", path, "", "", 200)
+			var page []struct{ Name string }
+			json.Unmarshal(w.Body.Bytes(), &page)
+			for _, p := range page {
+				all = append(all, p.Name)
+			}
+			next := w.Header().Get("X-Next-Cursor")
+			if len(next) == 0 {
+				break
+			}
+			path = base + "&cursor=" + url.QueryEscape(next)
+		}
+		want := rt.names(strings.Split(base, "&limit")[0], "")
+		if !reflect.DeepEqual(all, want) {
+			t.Errorf("%s: paged through %v, want %v", base, all, want)
+		}
+	}
+	// a cursor only continues the order it came from
+	w := rt.expect("GET", "/api/search/article?orderby=name&limit=1", "", "", 200)
+	rt.expect("GET", "/api/search/article?orderby=id&limit=1&cursor="+url.QueryEscape(w.Header().Get("X-Next-Cursor")), "", "", 400)
+}
+
+func TestRouterTrash(t *testing.T) {
+	rt := newRouterTest(t)
+	rt.seed()
+	rt.expect("DELETE", "/api/del/article/3", RoleEditor, "", 200)
+	rt.expect("DELETE", "/api/del/tag/2", RoleEditor, "", 200)
+	rt.expect("GET", "/api/search/article/3", "", "", 404)
+	if got := rt.names("/api/search/article?orderby=name", ""); !reflect.DeepEqual(got, []string{"amtrak", "google", "locomotive"}) {
+		t.Error("trashed article still found:", got)
+	}
+	if got := rt.names("/api/trash/article", RoleEditor); !reflect.DeepEqual(got, []string{"bing"}) {
+		t.Error("trash:", got)
+	}
+	if got := rt.names("/api/trash/tag", RoleEditor); !reflect.DeepEqual(got, []string{"search"}) {
+		t.Error("trash:", got)
+	}
+	// a tag in the trash is left off its articles and holds its name
+	a := DBArticle{}
+	json.Unmarshal(rt.expect("GET", "/api/search/article/1", "", "", 200).Body.Bytes(), &a)
+	if !reflect.DeepEqual(a.Tags, []string{"engine"}) {
+		t.Error("tags with one in the trash:", a.Tags)
+	}
+	rt.expect("POST", "/api/upload/tag", RoleContributor, `{"name":"search"}`, 403)
+
+	rt.expect("POST", "/api/trash/article/3/restore", RoleEditor, "", 200)
+	rt.expect("POST", "/api/trash/tag/2/restore", RoleEditor, "", 200)
+	rt.expect("POST", "/api/trash/article/3/restore", RoleEditor, "", 404)
+	if got := rt.names("/api/trash/article", RoleEditor); len(got) != 0 {
+		t.Error("trash after restoring:", got)
+	}
+	if got := rt.names("/api/search/article?tags=search", ""); !reflect.DeepEqual(got, []string{"google", "bing"}) {
+		t.Error("restored:", got)
+	}
+}
+
+func TestRouterRoles(t *testing.T) {
+	rt := newRouterTest(t)
+	rt.seed()
+	for _, c := range []struct {
+		method, path string
+		role         Role
+		body         string
+		code         int
+	}{
+		// writes need a token
+		{"POST", "/api/upload/tag", "", `{"name":"anonymous"}`, 401},
+		{"DELETE", "/api/del/article/1", "", "", 401},
+		{"GET", "/api/admin/stats", "", "", 401},
+		{"GET", "/api/trash/article", "", "", 401},
+		{"GET", "/api/revisions/article/1", "", "", 401},
+		// and a role allowing them
+		{"POST", "/api/upload/tag", RoleViewer, `{"name":"viewed"}`, 403},
+		{"POST", "/api/edit/article/1", RoleContributor, `{"name":"google"}`, 403},
+		{"DELETE", "/api/del/article/1", RoleContributor, "", 403},
+		{"POST", "/api/upload/article/csv", RoleEditor, "name,url,description,tags\n", 403},
+		{"GET", "/api/admin/stats", RoleEditor, "", 403},
+		{"GET", "/api/trash/tag", RoleContributor, "", 403},
+		{"GET", "/api/revisions/tag/1/diff?from=1&to=2", RoleContributor, "", 403},
+		{"GET", "/api/admin/users", RoleContributor, "", 403},
+		{"POST", "/api/admin/users/1/role", RoleEditor, `{"role":"admin"}`, 403},
+		// reads need neither
+		{"GET", "/api/search/article", "", "", 200},
+		{"POST", "/api/upload/tag", RoleContributor, `{"name":"contributed"}`, 200},
+		{"POST", "/api/edit/article/1", RoleEditor, `{"name":"google","tags":["engine"]}`, 200},
+		{"GET", "/api/revisions/article/1", RoleEditor, "", 200},
+		{"GET", "/api/admin/stats", RoleAdmin, "", 200},
+	} {
+		w := rt.do(c.method, c.path, c.role, c.body)
+		if w.Code != c.code {
+			t.Errorf("%s %s as %q: got %d %s, want %d", c.method, c.path, c.role, w.Code, strings.TrimSpace(w.Body.String()), c.code)
+		}
+		if c.code == 401 && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s %s: 401 without WWW-Authenticate", c.method, c.path)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/api/upload/tag", strings.NewReader(`{"name":"forged"}`))
+	req.Header.Set("Authorization", "Bearer "+rt.tokens[RoleAdmin]+"x")
+	w := httptest.NewRecorder()
+	rt.router.ServeHTTP(w, req)
+	if w.Code != 401 {
+		t.Error("forged token:", w.Code)
+	}
+
+	// roles are checked on every request
+	editor, _ := rt.store.UserByName(context.Background(), string(RoleEditor))
+	rt.expect("POST", "/api/admin/users/"+strconv.FormatInt(editor.ID, 10)+"/role", RoleAdmin, `{"role":"viewer"}`, 200)
+	rt.expect("DELETE", "/api/del/article/1", RoleEditor, "", 403)
+
+	rt.expect("POST", "/api/user/logout", RoleContributor, "", 200)
+	rt.expect("POST", "/api/upload/tag", RoleContributor, `{"name":"logged out"}`, 401)
+}
+
+func TestRouterAdminUser(t *testing.T) {
+	ctx := context.Background()
+	store := NewSearchIndex().Wrap(NewMemStore())
+	router := CreateRouter(store, RouterConfig{Auth: AuthConfig{Secret: []byte("test secret")}}, "")
+	rt := &routerTest{t: t, store: store, router: router, tokens: map[Role]string{}}
+	login := func(name string) Tokens {
+		t.Helper()
+		tokens := Tokens{}
+		json.Unmarshal(rt.expect("POST", "/api/user/auth", "", `{"name":"`+name+`","password":"password"}`, 200).Body.Bytes(), &tokens)
+		return tokens
+	}
+
+	// as `ADMIN_USER` is applied at startup, before anyone registered
+	if err := makeAdmin(ctx, store, "root", ""); err == nil {
+		t.Error("made a missing user an admin without a password")
+	}
+	if err := makeAdmin(ctx, store, "root", "pw"); err == nil {
+		t.Error("registered an admin with an invalid password")
+	}
+	if err := makeAdmin(ctx, store, "root", "password"); err != nil {
+		t.Fatal(err)
+	}
+	tokens := login("root")
+	if tokens.User.Role != RoleAdmin {
+		t.Errorf("role %q, want admin", tokens.User.Role)
+	}
+	rt.tokens[RoleAdmin] = tokens.AccessToken
+	rt.expect("GET", "/api/admin/users", RoleAdmin, "", 200)
+
+	// and on a later start, after they registered as a contributor
+	rt.expect("POST", "/api/user/create", "", `{"name":"alice","password":"password"}`, 200)
+	rt.tokens[RoleContributor] = login("alice").AccessToken
+	rt.expect("GET", "/api/admin/users", RoleContributor, "", 403)
+	if err := makeAdmin(ctx, store, "alice", "ignored"); err != nil {
+		t.Fatal(err)
+	}
+	rt.expect("GET", "/api/admin/users", RoleContributor, "", 200)
+	if err := makeAdmin(ctx, store, "root", "password"); err != nil {
+		t.Error("making an admin an admin again:", err)
+	}
+}
+
+// holdingStore is a Store whose transactions wait for `release` once `entered` is set
+type holdingStore struct {
+	Store
+	entered, release chan struct{}
+}
+
+func (s *holdingStore) WithTx(ctx context.Context, fn func(Store) error) error {
+	if s.entered != nil {
+		s.entered <- struct{}{}
+		<-s.release
+	}
+	return s.Store.WithTx(ctx, fn)
+}
+
+func TestRouterLoginBulkhead(t *testing.T) {
+	held := &holdingStore{Store: NewMemStore()}
+	store := NewSearchIndex().Wrap(held)
+	bulkheads := BulkheadConfig{Write: 1, Login: 1, QueueTimeout: 10 * time.Millisecond}
+	router := CreateRouter(store, RouterConfig{Bulkheads: bulkheads, Auth: AuthConfig{Secret: []byte("test secret")}}, "")
+	rt := &routerTest{t: t, store: store, router: router, tokens: map[Role]string{}}
+	login := `{"name":"alice","password":"password"}`
+	rt.expect("POST", "/api/user/create", "", login, 200)
+	tokens := Tokens{}
+	json.Unmarshal(rt.expect("POST", "/api/user/auth", "", login, 200).Body.Bytes(), &tokens)
+	rt.tokens[RoleContributor] = tokens.AccessToken
+
+	held.entered, held.release = make(chan struct{}), make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rt.do("POST", "/api/upload/tag", RoleContributor, `{"name":"held"}`)
+	}()
+	<-held.entered
+	w := rt.do("POST", "/api/upload/tag", RoleContributor, `{"name":"shed"}`)
+	if w.Code != 503 || w.Header().Get("Retry-After") == "" {
+		t.Errorf("write over the cap: got %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	// a full write bulkhead does not keep users from logging in
+	rt.expect("POST", "/api/user/auth", "", login, 200)
+	rt.expect("POST", "/api/user/create", "", `{"name":"bob","password":"password"}`, 200)
+	close(held.release)
+	<-done
+}
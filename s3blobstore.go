@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// s3Algorithm is the only request signing algorithm S3BlobStore uses, AWS Signature Version 4
+	s3Algorithm = "AWS4-HMAC-SHA256"
+	// s3TimeFormat is the format of `X-Amz-Date`
+	s3TimeFormat = "20060102T150405Z"
+	// s3UnsignedPayload stands in for the body hash of presigned URLs
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	// s3MaxExpiry is the longest a presigned URL may last
+	s3MaxExpiry = 7 * 24 * time.Hour
+)
+
+// S3Config locates a bucket on S3 or an S3-compatible service such as MinIO
+type S3Config struct {
+	// Endpoint is the service's base URL, e.g. `https://s3.us-east-1.amazonaws.com` or `http://localhost:9000`
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// S3BlobStore is a BlobStore keeping each blob as an object in an S3 bucket.  Objects are addressed by path
+// (`endpoint/bucket/name`), which every S3-compatible service supports
+type S3BlobStore struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+	// now is the clock requests are signed with
+	now func() time.Time
+}
+
+// NewS3BlobStore stores blobs in the bucket described by `config`, which must already exist
+func NewS3BlobStore(config S3Config) (*S3BlobStore, error) {
+	endpoint, err := url.Parse(strings.TrimSuffix(config.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	} else if endpoint.Scheme != "http" && endpoint.Scheme != "https" || len(endpoint.Host) == 0 {
+		return nil, fmt.Errorf("S3 endpoint %q is not an http(s) URL", config.Endpoint)
+	} else if len(config.Bucket) == 0 || len(config.AccessKeyID) == 0 || len(config.SecretAccessKey) == 0 {
+		return nil, fmt.Errorf("S3 bucket and credentials are required")
+	}
+	if len(config.Region) == 0 {
+		config.Region = "us-east-1"
+	}
+	return &S3BlobStore{
+		config:   config,
+		endpoint: endpoint,
+		client:   &http.Client{},
+		now:      time.Now,
+	}, nil
+}
+
+// s3Escape percent-encodes `s` as SigV4 requires, leaving only unreserved characters and, if `path`, slashes
+func s3Escape(s string, path bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 || path && c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query encodes `q` sorted by key, as both the canonical request and the URL use it
+func s3Query(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string{}, q[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// objectURL is the URL of object `name`, without a query
+func (s *S3BlobStore) objectURL(name string) *url.URL {
+	u := *s.endpoint
+	u.Path = s.endpoint.Path + "/" + s.config.Bucket + "/" + name
+	u.RawPath = s3Escape(u.Path, true)
+	return &u
+}
+
+// scope is the credential scope of requests signed at `t`
+func (s *S3BlobStore) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + s.config.Region + "/s3/aws4_request"
+}
+
+// signature signs `method` on `u` with the canonical `headers`, all of which are signed, and `payloadHash` at `t`
+func (s *S3BlobStore) signature(method string, u *url.URL, headers map[string]string, payloadHash string, t time.Time) (string, string) {
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonical := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		s3Query(u.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	toSign := strings.Join([]string{s3Algorithm, t.Format(s3TimeFormat), s.scope(t), sha256Hex([]byte(canonical))}, "\n")
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretAccessKey), t.Format("20060102"))
+	for _, part := range []string{s.config.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, toSign)), signedHeaders
+}
+
+// do sends a signed `method` request for object `name` with `body`, returning the response if its status is 2xx or 404
+func (s *S3BlobStore) do(ctx context.Context, method, name string, body []byte) (*http.Response, error) {
+	u := s.objectURL(name)
+	t := s.now().UTC()
+	payloadHash := sha256Hex(body)
+	headers := map[string]string{
+		"host":                 u.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           t.Format(s3TimeFormat),
+	}
+	sig, signedHeaders := s.signature(method, u, headers, payloadHash, t)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Set("X-Amz-Date", headers["x-amz-date"])
+	req.Header.Set("Authorization", s3Algorithm+" Credential="+s.config.AccessKeyID+"/"+s.scope(t)+
+		", SignedHeaders="+signedHeaders+", Signature="+sig)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("S3 %s %s: %s: %s", method, name, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+// Put uploads `data` as object `name`
+func (s *S3BlobStore) Put(ctx context.Context, name string, data []byte) error {
+	resp, err := s.do(ctx, http.MethodPut, name, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("S3 bucket %q does not exist", s.config.Bucket)
+	}
+	return nil
+}
+
+// Get downloads object `name`
+func (s *S3BlobStore) Get(ctx context.Context, name string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errBlobNotFound
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Exists checks for object `name` without downloading it
+func (s *S3BlobStore) Exists(ctx context.Context, name string) (bool, error) {
+	resp, err := s.do(ctx, http.MethodHead, name, nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode != http.StatusNotFound, nil
+}
+
+// Delete removes object `name`
+func (s *S3BlobStore) Delete(ctx context.Context, name string) error {
+	resp, err := s.do(ctx, http.MethodDelete, name, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// SignedURL presigns a GET of object `name` that anyone holding the URL may use until `expiry` has passed, so objects in
+// a private bucket can be served straight from S3
+func (s *S3BlobStore) SignedURL(ctx context.Context, name string, expiry time.Duration) (string, error) {
+	if expiry < time.Second || expiry > s3MaxExpiry {
+		return "", fmt.Errorf("presigned URLs must expire within 1s to %s, not %s", s3MaxExpiry, expiry)
+	}
+	u := s.objectURL(name)
+	t := s.now().UTC()
+	q := url.Values{}
+	q.Set("X-Amz-Algorithm", s3Algorithm)
+	q.Set("X-Amz-Credential", s.config.AccessKeyID+"/"+s.scope(t))
+	q.Set("X-Amz-Date", t.Format(s3TimeFormat))
+	q.Set("X-Amz-Expires", strconv.Itoa(int(expiry/time.Second)))
+	q.Set("X-Amz-SignedHeaders", "host")
+	u.RawQuery = s3Query(q)
+	sig, _ := s.signature(http.MethodGet, u, map[string]string{"host": u.Host}, s3UnsignedPayload, t)
+	u.RawQuery += "&X-Amz-Signature=" + sig
+	return u.String(), nil
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// BM25 parameters.  `bm25K1` limits how much repeating a term helps, `bm25B` how much long articles are penalized
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// SearchIndex is an in-process inverted index over articles so ranked search behaves the same on every backend
+type SearchIndex struct {
+	mu   sync.RWMutex
+	docs map[int64]indexedArticle
+	// postings maps each term to how many times it occurs in each article
+	postings map[string]map[int64]int
+	// totalLen is the number of terms in every article, for the average article length
+	totalLen int
+
+	// refreshMu serializes re-reading articles from the store so an older read never replaces a newer one
+	refreshMu sync.Mutex
+}
+
+// indexedArticle is an article as it was indexed
+type indexedArticle struct {
+	article DBArticle
+	terms   map[string]int
+	length  int
+}
+
+// NewSearchIndex returns an empty index
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{
+		docs:     make(map[int64]indexedArticle),
+		postings: make(map[string]map[int64]int),
+	}
+}
+
+// urlHost returns the host of `u`, which may be missing its scheme
+func urlHost(u string) string {
+	if !strings.Contains(u, "://") {
+		u = "http://" + u
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	return parsed.Hostname()
+}
+
+// articleTerms returns the terms of an article's name, description, URL host and tag names
+func articleTerms(a DBArticle) []string {
+	text := append([]string{a.Name, a.Description, urlHost(a.URL)}, a.Tags...)
+	return analyze(strings.Join(text, " "))
+}
+
+// Add indexes `a`, replacing any earlier version of it
+func (idx *SearchIndex) Add(a DBArticle) {
+	doc := indexedArticle{article: a, terms: make(map[string]int)}
+	for _, t := range articleTerms(a) {
+		doc.terms[t]++
+		doc.length++
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(a.ID)
+	for t, n := range doc.terms {
+		if idx.postings[t] == nil {
+			idx.postings[t] = make(map[int64]int)
+		}
+		idx.postings[t][a.ID] = n
+	}
+	idx.docs[a.ID] = doc
+	idx.totalLen += doc.length
+}
+
+// Remove drops article `id` from the index
+func (idx *SearchIndex) Remove(id int64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(id)
+}
+
+// remove drops article `id` from the index.  Caller must hold `idx.mu` for writing
+func (idx *SearchIndex) remove(id int64) {
+	doc, ok := idx.docs[id]
+	if !ok {
+		return
+	}
+	for t := range doc.terms {
+		delete(idx.postings[t], id)
+		if len(idx.postings[t]) == 0 {
+			delete(idx.postings, t)
+		}
+	}
+	idx.totalLen -= doc.length
+	delete(idx.docs, id)
+}
+
+// Rebuild replaces the contents of the index with every article in `store`.  Articles are read from the primary
+// database, not a replica that may lag behind it
+func (idx *SearchIndex) Rebuild(ctx context.Context, store Store) error {
+	idx.refreshMu.Lock()
+	defer idx.refreshMu.Unlock()
+
+	articles, _, err := store.ArticlesWithTagsSearch(withPrimary(ctx), []string{}, nil, "", "", false, nil, 0, 0, false)
+	if err != nil {
+		return err
+	}
+	fresh := NewSearchIndex()
+	for _, a := range articles {
+		fresh.Add(a)
+	}
+
+	idx.mu.Lock()
+	idx.docs, idx.postings, idx.totalLen = fresh.docs, fresh.postings, fresh.totalLen
+	idx.mu.Unlock()
+	return nil
+}
+
+// refresh re-reads articles `ids` from `store`'s primary database, indexing the ones that still exist and dropping the rest
+func (idx *SearchIndex) refresh(ctx context.Context, store Store, ids []int64) {
+	idx.refreshMu.Lock()
+	defer idx.refreshMu.Unlock()
+	ctx = withPrimary(ctx)
+	for _, id := range ids {
+		a, err := store.ArticleByID(ctx, id)
+		if err != nil {
+			log.Println("Error re-indexing article", id, "for search:", err)
+		} else if a == nil {
+			idx.Remove(id)
+		} else {
+			idx.Add(*a)
+		}
+	}
+}
+
+// taggedWith returns the IDs of indexed articles with tag `name`
+func (idx *SearchIndex) taggedWith(name string) []int64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	ids := []int64{}
+	for id, doc := range idx.docs {
+		for _, t := range doc.article.Tags {
+			if strings.EqualFold(t, name) {
+				ids = append(ids, id)
+				break
+			}
+		}
+	}
+	return ids
+}
+
+// Search returns `limit` articles matching any word of `query`, offset by `offset`, with the best BM25 score first, and
+// how many match in all.  `tags`, `tq`, `lookslike`, `orderby`, `reverse` and `after` behave as they do for ArticlesWithTagsSearch
+func (idx *SearchIndex) Search(query string, tags []string, tq tagQuery, lookslike, orderby string, reverse bool, after *searchCursor, limit, offset int) ([]DBArticle, int) {
+	terms := []string{}
+	seen := make(map[string]bool)
+	for _, t := range analyze(query) {
+		if !seen[t] {
+			seen[t] = true
+			terms = append(terms, t)
+		}
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	scores := make(map[int64]float64)
+	n := float64(len(idx.docs))
+	for _, t := range terms {
+		posting := idx.postings[t]
+		df := float64(len(posting))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		avgLen := float64(idx.totalLen) / n
+		for id, tf := range posting {
+			f := float64(tf)
+			norm := 1 - bm25B + bm25B*float64(idx.docs[id].length)/avgLen
+			scores[id] += idf * f * (bm25K1 + 1) / (f + bm25K1*norm)
+		}
+	}
+
+	var re *regexp.Regexp
+	if len(lookslike) > 0 {
+		re = likeMatcher(lookslike)
+	}
+
+	articles := []DBArticle{}
+	total := 0
+	for id := range scores {
+		a := idx.docs[id].article
+		if !hasAllTags(a.Tags, tags) || (tq != nil && !tq.matches(a.Tags)) {
+			continue
+		}
+		if re != nil && !matchesLike(re, a.Name, a.Description) {
+			continue
+		}
+		total++
+		if after != nil && !afterCursor(after, a.ID, a.Name, a.Description) {
+			continue
+		}
+		articles = append(articles, a)
+	}
+
+	sort.Slice(articles, func(i, j int) bool { return articles[i].ID < articles[j].ID })
+	if len(orderby) == 0 || findOrderby(orderby) == "Relevance" {
+		// best score first unless reversed
+		sort.SliceStable(articles, func(i, j int) bool {
+			if reverse {
+				return scores[articles[i].ID] < scores[articles[j].ID]
+			}
+			return scores[articles[i].ID] > scores[articles[j].ID]
+		})
+	} else {
+		sort.SliceStable(articles, func(i, j int) bool {
+			a, b := articles[i], articles[j]
+			if reverse {
+				a, b = b, a
+			}
+			return lessBy(orderby, a.ID, a.Name, a.Description, b.ID, b.Name, b.Description)
+		})
+	}
+
+	start, end := page(len(articles), limit, offset)
+	return articles[start:end], total
+}
+
+// hasAllTags reports whether `names` contains every one of `tags`, ignoring case
+func hasAllTags(names, tags []string) bool {
+	for _, t := range tags {
+		found := false
+		for _, name := range names {
+			if strings.EqualFold(name, t) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// IndexedStore is a Store that mirrors every committed change to articles into a SearchIndex
+type IndexedStore struct {
+	Store
+	index *SearchIndex
+	// changed collects the articles touched inside a transaction to re-index once it commits.  nil outside a transaction
+	changed map[int64]bool
+}
+
+// Wrap returns `store` with its article changes mirrored into the index
+func (idx *SearchIndex) Wrap(store Store) *IndexedStore {
+	return &IndexedStore{Store: store, index: idx}
+}
+
+// WithTx runs `fn` in a transaction, re-indexing the articles it touched after it commits
+func (s *IndexedStore) WithTx(ctx context.Context, fn func(Store) error) error {
+	changed := s.changed
+	if changed == nil {
+		changed = make(map[int64]bool)
+	}
+	err := s.Store.WithTx(ctx, func(tx Store) error {
+		return fn(&IndexedStore{Store: tx, index: s.index, changed: changed})
+	})
+	if err == nil && s.changed == nil {
+		ids := []int64{}
+		for id := range changed {
+			ids = append(ids, id)
+		}
+		s.index.refresh(context.Background(), s.Store, ids)
+	}
+	return err
+}
+
+// touch re-indexes articles `ids` now, or once the current transaction commits.  Re-indexing ignores the request's
+// context because the change is already committed
+func (s *IndexedStore) touch(ids ...int64) {
+	if s.changed == nil {
+		s.index.refresh(context.Background(), s.Store, ids)
+		return
+	}
+	for _, id := range ids {
+		s.changed[id] = true
+	}
+}
+
+// tagged returns the IDs of indexed articles with tag `id`, which must be looked up before the tag changes
+func (s *IndexedStore) tagged(ctx context.Context, id int64) []int64 {
+	t, err := s.Store.TagByID(withPrimary(ctx), id)
+	if err != nil || t == nil {
+		return []int64{}
+	}
+	return s.index.taggedWith(t.Name)
+}
+
+// InsertArticleTag links an article to a tag and re-indexes the article
+func (s *IndexedStore) InsertArticleTag(ctx context.Context, articleID int64, tagID int64) (int64, error) {
+	id, err := s.Store.InsertArticleTag(ctx, articleID, tagID)
+	if err == nil {
+		s.touch(articleID)
+	}
+	return id, err
+}
+
+// InsertArticleTags links an article to tags and re-indexes the article
+func (s *IndexedStore) InsertArticleTags(ctx context.Context, id int64, tagIDs []int64) error {
+	err := s.Store.InsertArticleTags(ctx, id, tagIDs)
+	if err == nil {
+		s.touch(id)
+	}
+	return err
+}
+
+// InsertArticle inserts and indexes an article
+func (s *IndexedStore) InsertArticle(ctx context.Context, a UploadArticle) (int64, error) {
+	id, err := s.Store.InsertArticle(ctx, a)
+	if err == nil {
+		s.touch(id)
+	}
+	return id, err
+}
+
+// RemoveArticleTags unlinks an article from its tags and re-indexes the article
+func (s *IndexedStore) RemoveArticleTags(ctx context.Context, articleID int64) error {
+	err := s.Store.RemoveArticleTags(ctx, articleID)
+	if err == nil {
+		s.touch(articleID)
+	}
+	return err
+}
+
+// RemoveTagsFromArticles unlinks a tag from its articles and re-indexes them
+func (s *IndexedStore) RemoveTagsFromArticles(ctx context.Context, tagID int64) error {
+	ids := s.tagged(ctx, tagID)
+	err := s.Store.RemoveTagsFromArticles(ctx, tagID)
+	if err == nil {
+		s.touch(ids...)
+	}
+	return err
+}
+
+// RemoveArticle removes an article and drops it from the index
+func (s *IndexedStore) RemoveArticle(ctx context.Context, id int64) error {
+	err := s.Store.RemoveArticle(ctx, id)
+	if err == nil {
+		s.touch(id)
+	}
+	return err
+}
+
+// RemoveTag removes a tag and re-indexes the articles it was on
+func (s *IndexedStore) RemoveTag(ctx context.Context, id int64) error {
+	ids := s.tagged(ctx, id)
+	err := s.Store.RemoveTag(ctx, id)
+	if err == nil {
+		s.touch(ids...)
+	}
+	return err
+}
+
+// UpdateArticle updates and re-indexes an article
+func (s *IndexedStore) UpdateArticle(ctx context.Context, id int64, article UploadArticle) error {
+	err := s.Store.UpdateArticle(ctx, id, article)
+	if err == nil {
+		s.touch(id)
+	}
+	return err
+}
+
+// UpdateTag updates a tag and re-indexes the articles it is on
+func (s *IndexedStore) UpdateTag(ctx context.Context, id int64, tag UploadTag) error {
+	ids := s.tagged(ctx, id)
+	err := s.Store.UpdateTag(ctx, id, tag)
+	if err == nil {
+		s.touch(ids...)
+	}
+	return err
+}
+
+// RestoreArticle takes an article out of the trash and indexes it again
+func (s *IndexedStore) RestoreArticle(ctx context.Context, id int64) (bool, error) {
+	restored, err := s.Store.RestoreArticle(ctx, id)
+	if err == nil && restored {
+		s.touch(id)
+	}
+	return restored, err
+}
+
+// RestoreTag takes a tag out of the trash and re-indexes the articles it is back on
+func (s *IndexedStore) RestoreTag(ctx context.Context, id int64) (bool, error) {
+	restored, err := s.Store.RestoreTag(ctx, id)
+	if err != nil || !restored {
+		return restored, err
+	}
+	// the index dropped the tag's name from its articles, so they are found through the store
+	t, err := s.Store.TagByID(withPrimary(ctx), id)
+	if err != nil || t == nil {
+		log.Println("Error re-indexing articles tagged", id, "for search:", err)
+		return restored, nil
+	}
+	articles, _, err := s.Store.ArticlesWithTagsSearch(withPrimary(ctx), []string{t.Name}, nil, "", "", false, nil, 0, 0, false)
+	if err != nil {
+		log.Println("Error re-indexing articles tagged", id, "for search:", err)
+		return restored, nil
+	}
+	ids := []int64{}
+	for _, a := range articles {
+		ids = append(ids, a.ID)
+	}
+	s.touch(ids...)
+	return restored, nil
+}
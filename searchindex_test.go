@@ -0,0 +1,104 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStem(t *testing.T) {
+	for w, want := range map[string]string{
+		"caresses":    "caress",
+		"ponies":      "poni",
+		"cats":        "cat",
+		"feed":        "feed",
+		"agreed":      "agre",
+		"plastered":   "plaster",
+		"motoring":    "motor",
+		"sing":        "sing",
+		"hopping":     "hop",
+		"falling":     "fall",
+		"filing":      "file",
+		"happy":       "happi",
+		"relational":  "relat",
+		"conditional": "condit",
+		"digitizer":   "digit",
+		"hopeful":     "hope",
+		"goodness":    "good",
+		"adjustable":  "adjust",
+		"effective":   "effect",
+		"searching":   "search",
+		"searches":    "search",
+		"searched":    "search",
+		"is":          "is",
+		"café":        "café",
+		"mp3":         "mp3",
+	} {
+		if got := stem(w); got != want {
+			t.Errorf("stem(%q) = %q, want %q", w, got, want)
+		}
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	got := analyze("The frogs AREN'T searching, it's in the engines")
+	want := []string{"frog", "aren", "search", "engin"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("analyze = %v, want %v", got, want)
+	}
+}
+
+// found lists the IDs of `articles` in order
+func found(articles []DBArticle) []int64 {
+	ids := []int64{}
+	for _, a := range articles {
+		ids = append(ids, a.ID)
+	}
+	return ids
+}
+
+func TestSearchIndexBM25(t *testing.T) {
+	idx := NewSearchIndex()
+	for _, a := range []DBArticle{
+		{ID: 1, Name: "frogs", Description: "frogs and more frogs, a frog site"},
+		{ID: 2, Name: "frogs", Description: "a long page about ponds, lily pads, insects, herons and frogs"},
+		{ID: 3, Name: "toads", Description: "toads in ponds", Tags: []string{"amphibian"}},
+		{ID: 4, Name: "google", URL: "https://www.google.com/search", Description: "search engine"},
+	} {
+		idx.Add(a)
+	}
+	for _, c := range []struct {
+		query string
+		tags  []string
+		want  []int64
+	}{
+		// more of the term ranks higher, as does a shorter article
+		{"frog", nil, []int64{1, 2}},
+		// any term may match, and the rarer one counts for more
+		{"toads frogs", nil, []int64{3, 1, 2}},
+		{"ponds frogs", nil, []int64{2, 1, 3}},
+		// tag names and URL hosts are indexed
+		{"amphibian", nil, []int64{3}},
+		{"google.com", nil, []int64{4}},
+		{"ponds", []string{"Amphibian"}, []int64{3}},
+		{"the and", nil, []int64{}},
+		{"newts", nil, []int64{}},
+	} {
+		articles, total := idx.Search(c.query, c.tags, nil, "", "", false, nil, 0, 0)
+		if got := found(articles); !reflect.DeepEqual(got, c.want) || total != len(c.want) {
+			t.Errorf("%q tagged %v found %v of %d, want %v", c.query, c.tags, got, total, c.want)
+		}
+	}
+
+	articles, total := idx.Search("frogs ponds", nil, nil, "", "", true, nil, 1, 1)
+	if got := found(articles); !reflect.DeepEqual(got, []int64{1}) || total != 3 {
+		t.Errorf("reversed second page found %v of %d", got, total)
+	}
+
+	idx.Add(DBArticle{ID: 1, Name: "newts"})
+	idx.Remove(3)
+	for query, want := range map[string][]int64{"frogs": {2}, "newts": {1}, "toads": {}} {
+		if articles, _ := idx.Search(query, nil, nil, "", "", false, nil, 0, 0); !reflect.DeepEqual(found(articles), want) {
+			t.Errorf("after replacing and removing, %q found %v, want %v", query, found(articles), want)
+		}
+	}
+}
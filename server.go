@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -23,10 +26,29 @@ const (
 	UPasswdMaxLen = 50
 )
 
+// Database defaults, overridden by the environment variables named in `poolConfig`, `queryTimeout`, `routerConfig` and `main`
+const (
+	defaultQueryTimeout       = 30 * time.Second
+	defaultMaxOpenConns       = 25
+	defaultMaxIdleConns       = 25
+	defaultConnMaxLifetime    = 5 * time.Minute
+	defaultConnectTimeout     = 2 * time.Minute
+	defaultConnCheckPeriod    = 15 * time.Second
+	defaultMaxSearches        = 16
+	defaultMaxWrites          = 8
+	defaultMaxImports         = 1
+	defaultMaxLogins          = 4
+	defaultQueueTimeout       = 2 * time.Second
+	defaultPrimaryWindow      = 10 * time.Second
+	defaultTrashRetention     = 30 * 24 * time.Hour
+	defaultImageURLExpiry     = 15 * time.Minute
+	defaultAccessTokenExpiry  = 15 * time.Minute
+	defaultRefreshTokenExpiry = 30 * 24 * time.Hour
+)
+
 var (
 	hostPort string
 	hostAddr string
-	db       *DB
 )
 
 // DBArticle is a representation of an article from MySQL DB
@@ -37,17 +59,22 @@ type DBArticle struct {
 	Description string `json:"description" maximum:"1024" example:"a popular search engine"`
 	// List of tag names
 	Tags []string `json:"tags" example:"engine,search,browser"`
-	// This is a list of filenames to be queried via other endpoint
+	// Filenames of the article's images, served by /api/image/{filename}
 	Images []string `json:"images" maxItems:"4" example:"a.png, evidence1.png, metal-beams.jpg"` // NOTE: limit of 4
+	// When the article was moved to the trash.  Only set when listing the trash
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 // Image is an image format and Base64 representation of image
 type Image struct {
 	// Base64 encoded image data
 	Data string `json:"data" format:"base64" example:"dGhpcyBpcyBhbiBpbWFnZQo="`
-	// Image format (PNG,JPG,etc.)
-	Format   string `json:"format" example:"png"`
-	Filename string `swaggerignore:"true"`
+	// Image format (PNG,JPG,etc.).  Optional, the format is detected from `data`
+	Format string `json:"format" example:"png"`
+	// Set once the image is stored
+	Filename string `json:"-" swaggerignore:"true"`
+	// Bytes stored for the image and its thumbnails.  Set once the image is stored
+	Size int64 `json:"-" swaggerignore:"true"`
 }
 
 // UploadArticle is a representation of an article sent from frontend to be uploaded to MySQL DB
@@ -56,7 +83,8 @@ type UploadArticle struct {
 	URL         string   `json:"url" maximum:"512" example:"google.com"`
 	Description string   `json:"description" maximum:"1024" example:"a popular search engine"`
 	Tags        []string `json:"tags" example:"engine,search,browser"`
-	Images      []Image  `json:"images" maxItems:"4"`
+	// When editing, omit to keep the article's images or send a list to replace them
+	Images []Image `json:"images" maxItems:"4"`
 }
 
 // DBTag is a representation of a tag from MySQL DB
@@ -64,6 +92,8 @@ type DBTag struct {
 	ID          int64  `json:"id,omitempty" example:"1"`
 	Name        string `json:"name" maximum:"16" example:"engine"`
 	Description string `json:"description" maximum:"256" example:"a machine designed to convert one form of energy into mechanical energy"`
+	// When the tag was moved to the trash.  Only set when listing the trash
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 	// Name        string `json:"name"`
 	// Description string `json:"description"`
 }
@@ -74,16 +104,10 @@ type UploadTag struct {
 	Description string `json:"description" maximum:"256" example:"a machine designed to convert one form of energy into mechanical energy"`
 }
 
-// type User struct {
-// 	ID     int64  `json:"id,omitempty"` // NOTE: only updated when removing from DB
-// 	Name   string `json:"name" minLength:"3" maxLength:"30"`
-// 	Passwd string `json:"password" minLength:"5" maxLength:"50"`
-// }
-
 // CheckEnvVars checks environment variables to make sure they are set
 func CheckEnvVars() {
 	vars := []string{"APP_ENV", "MYSQL_USER", "MYSQL_PASSWORD", "MYSQL_HOSTNAME",
-		"MYSQL_DBNAME", "HOST_ADDRESS", "HOST_PORT", "FILES_TO_SERVE"}
+		"MYSQL_DBNAME", "HOST_ADDRESS", "HOST_PORT", "FILES_TO_SERVE", "AUTH_SECRET"}
 	for _, v := range vars {
 		if len(os.Getenv(v)) == 0 {
 			fmt.Println("WARNING: environment variable `" + v + "` not set")
@@ -91,12 +115,112 @@ func CheckEnvVars() {
 	}
 }
 
+// envDuration reads environment variable `name`, a duration such as "10s", defaulting to `def` and exiting if it is invalid
+func envDuration(name string, def time.Duration) time.Duration {
+	s := os.Getenv(name)
+	if len(s) == 0 {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		fmt.Println("Invalid `"+name+"`:", s)
+		os.Exit(1)
+	}
+	return d
+}
+
+// envInt reads environment variable `name`, a non-negative integer, defaulting to `def` and exiting if it is invalid
+func envInt(name string, def int) int {
+	s := os.Getenv(name)
+	if len(s) == 0 {
+		return def
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		fmt.Println("Invalid `"+name+"`:", s)
+		os.Exit(1)
+	}
+	return n
+}
+
+// queryTimeout reads `DB_QUERY_TIMEOUT`.  "0" disables the timeout
+func queryTimeout() time.Duration {
+	return envDuration("DB_QUERY_TIMEOUT", defaultQueryTimeout)
+}
+
+// poolConfig reads the connection pool settings.  `DB_MAX_OPEN_CONNS=0` leaves the pool unlimited
+func poolConfig() PoolConfig {
+	return PoolConfig{
+		MaxOpen:        envInt("DB_MAX_OPEN_CONNS", defaultMaxOpenConns),
+		MaxIdle:        envInt("DB_MAX_IDLE_CONNS", defaultMaxIdleConns),
+		MaxLifetime:    envDuration("DB_CONN_MAX_LIFETIME", defaultConnMaxLifetime),
+		ConnectTimeout: envDuration("DB_CONNECT_TIMEOUT", defaultConnectTimeout),
+		CheckPeriod:    envDuration("DB_CHECK_PERIOD", defaultConnCheckPeriod),
+	}
+}
+
+// routerConfig reads the concurrency caps for each operation class, `0` leaving a class unlimited, and how long
+// clients read from the primary after writing
+func routerConfig() RouterConfig {
+	return RouterConfig{
+		Bulkheads: BulkheadConfig{
+			Search:       envInt("MAX_CONCURRENT_SEARCHES", defaultMaxSearches),
+			Write:        envInt("MAX_CONCURRENT_WRITES", defaultMaxWrites),
+			Import:       envInt("MAX_CONCURRENT_IMPORTS", defaultMaxImports),
+			Login:        envInt("MAX_CONCURRENT_LOGINS", defaultMaxLogins),
+			QueueTimeout: envDuration("QUEUE_TIMEOUT", defaultQueueTimeout),
+		},
+		PrimaryWindow: envDuration("READ_YOUR_WRITES_WINDOW", defaultPrimaryWindow),
+		Auth: AuthConfig{
+			Secret:             []byte(os.Getenv("AUTH_SECRET")),
+			AccessTokenExpiry:  envDuration("ACCESS_TOKEN_EXPIRY", defaultAccessTokenExpiry),
+			RefreshTokenExpiry: envDuration("REFRESH_TOKEN_EXPIRY", defaultRefreshTokenExpiry),
+		},
+	}
+}
+
+// imageStore opens the blob store named by `IMAGE_BACKEND`, exiting if it cannot: a directory (`fs`, the default) or an
+// S3 bucket (`s3`)
+func imageStore() BlobStore {
+	switch backend := os.Getenv("IMAGE_BACKEND"); backend {
+	case "", "fs":
+		dir := os.Getenv("IMAGE_DIR")
+		if len(dir) == 0 {
+			dir = "images"
+		}
+		images, err := NewFSBlobStore(dir)
+		if err != nil {
+			fmt.Println("Failed to open image directory `" + dir + "`.")
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return images
+	case "s3":
+		images, err := NewS3BlobStore(S3Config{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Region:          os.Getenv("S3_REGION"),
+			Bucket:          os.Getenv("S3_BUCKET"),
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		})
+		if err != nil {
+			fmt.Println("Invalid S3 configuration:", err)
+			os.Exit(1)
+		}
+		return images
+	default:
+		fmt.Println("Unknown `IMAGE_BACKEND`:", backend)
+		os.Exit(1)
+	}
+	return nil
+}
+
 // @title DB
 // @version 1.0
 // @description Debatabase
-// // @securityDefinitions.apikey Bearer
-// // @in header
-// // @name Authorization
+// @securityDefinitions.apikey Bearer
+// @in header
+// @name Authorization
 func main() {
 
 	if os.Getenv("APP_ENV") == "production" {
@@ -111,20 +235,128 @@ func main() {
 
 	CheckEnvVars()
 
-	uname := os.Getenv("MYSQL_USER")
-	passwd := os.Getenv("MYSQL_PASSWORD")
-	dbname := os.Getenv("MYSQL_DBNAME")
-	hostname := os.Getenv("MYSQL_HOSTNAME")
-	var err error
-	fmt.Println("Connecting to database...")
-	db, err = DBConnect(uname, passwd, hostname, dbname)
+	var store Store
+	switch backend := os.Getenv("DB_BACKEND"); backend {
+	case "memory":
+		fmt.Println("Using in-memory store.  Data will not persist")
+		store = NewMemStore()
+	case "sqlite":
+		path := os.Getenv("SQLITE_PATH")
+		if len(path) == 0 {
+			path = "debatabase.db"
+		}
+		fmt.Println("Opening SQLite database `" + path + "`...")
+		db, err := SQLiteConnect(path, poolConfig())
+		if err != nil {
+			fmt.Println("Failed to open SQLite DB.")
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		db.queryTimeout = queryTimeout()
+		go db.Watch()
+		store = db
+	case "", "mysql", "postgres":
+		dialect, prefix, name := dialectMySQL, "MYSQL_", "MySQL"
+		if backend == "postgres" {
+			dialect, prefix, name = dialectPostgres, "POSTGRES_", "Postgres"
+		}
+		uname := os.Getenv(prefix + "USER")
+		passwd := os.Getenv(prefix + "PASSWORD")
+		dbname := os.Getenv(prefix + "DBNAME")
+		hostname := os.Getenv(prefix + "HOSTNAME")
+		fmt.Println("Connecting to database...")
+		db, err := DBConnect(dialect, uname, passwd, hostname, dbname, poolConfig())
+		if err != nil {
+			fmt.Println("Failed to connect to " + name + " DB.  Is DB running?")
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		db.queryTimeout = queryTimeout()
+		// comma separated DSNs of read replicas, e.g. `user:password@tcp(replica:3306)/debatabase?parseTime=true` on MySQL
+		if replicas := os.Getenv(prefix + "REPLICAS"); len(replicas) > 0 {
+			err = db.AddReplicas(strings.Split(replicas, ","), poolConfig())
+			if err != nil {
+				fmt.Println("Failed to open read replicas.")
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		go db.Watch()
+		store = db
+	default:
+		fmt.Println("Unknown `DB_BACKEND`:", backend)
+		os.Exit(1)
+	}
+
+	// `debatabase migrate [version]` migrates the schema up or down to `version` (default latest) and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		db, ok := store.(*DB)
+		if !ok {
+			fmt.Println("`migrate` requires a SQL backend")
+			os.Exit(1)
+		}
+		target := LatestSchemaVersion()
+		if len(os.Args) > 2 {
+			v, err := strconv.Atoi(os.Args[2])
+			if err != nil {
+				fmt.Println("Invalid schema version:", os.Args[2])
+				os.Exit(1)
+			}
+			target = v
+		}
+		err := db.Migrate(target)
+		if err != nil {
+			fmt.Println("Migration failed:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Schema is at version", target)
+		db.Close()
+		os.Exit(0)
+	}
+	store.Init()
+
+	// `debatabase admin <name>` makes registered user `name` an admin and exits
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		if len(os.Args) != 3 {
+			fmt.Println("Usage: debatabase admin <name>")
+			os.Exit(1)
+		} else if _, ok := store.(*MemStore); ok {
+			fmt.Println("`admin` requires a persistent backend, set `ADMIN_USER` and `ADMIN_PASSWORD` instead")
+			os.Exit(1)
+		}
+		err := makeAdmin(context.Background(), store, os.Args[2], "")
+		if err != nil {
+			fmt.Println("Failed to make admin:", err)
+			os.Exit(1)
+		}
+		fmt.Println(os.Args[2], "is an admin")
+		store.Close()
+		os.Exit(0)
+	}
+
+	// `ADMIN_USER` is made an admin on every start, registered with `ADMIN_PASSWORD` if missing, which is the only way to
+	// have an admin in memory
+	if name := os.Getenv("ADMIN_USER"); len(name) > 0 {
+		err := makeAdmin(context.Background(), store, name, os.Getenv("ADMIN_PASSWORD"))
+		if err != nil {
+			fmt.Println("Failed to make `ADMIN_USER` an admin:", err)
+			os.Exit(1)
+		}
+	}
+
+	images := imageStore()
+
+	// `TRASH_RETENTION=0` keeps deleted articles and tags forever, though unused images are still collected
+	go WatchTrash(store, images, envDuration("TRASH_RETENTION", defaultTrashRetention), trashPurgePeriod)
+
+	fmt.Println("Building search index...")
+	index := NewSearchIndex()
+	err := index.Rebuild(context.Background(), store)
 	if err != nil {
-		fmt.Println("Failed to connect to MySQL DB.  Is DB running?")
+		fmt.Println("Failed to build search index.")
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	db.Init()
-	go DBMaintainConnection(uname, passwd, hostname, dbname, 15)
 
 	serveLocation := os.Getenv("FILES_TO_SERVE")
 	if len(serveLocation) == 0 {
@@ -144,7 +376,15 @@ func main() {
 			os.Exit(1)
 		}
 	}
-	r := CreateRouter(serveLocation)
+	config := routerConfig()
+	config.Images = images
+	// `S3_URL_EXPIRY=0` serves S3 images through the API instead of redirecting to signed URLs
+	config.ImageURLExpiry = envDuration("S3_URL_EXPIRY", defaultImageURLExpiry)
+	if config.ImageURLExpiry > s3MaxExpiry {
+		fmt.Println("`S3_URL_EXPIRY` may be at most", s3MaxExpiry)
+		os.Exit(1)
+	}
+	r := CreateRouter(index.Wrap(store), config, serveLocation)
 
 	hostAddr = os.Getenv("HOST_ADDRESS")
 	hostPort = os.Getenv("HOST_PORT")
@@ -157,5 +397,5 @@ func main() {
 	sig := <-c
 
 	fmt.Println("Received", sig, "signal.  Shutting down...")
-	db.Close()
+	store.Close()
 }
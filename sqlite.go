@@ -0,0 +1,25 @@
+package main
+
+import (
+	"database/sql"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLiteConnect opens (creating if necessary) the SQLite database stored in the file at `path`, sizing its pool by `pool`.
+// Foreign keys are enforced on every connection, SQLite leaves them off by default.
+// Transactions take the write lock up front so two writers fail fast instead of deadlocking on upgrade
+func SQLiteConnect(path string, pool PoolConfig) (*DB, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000&_foreign_keys=1&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	conns := newConnManager(db, pool)
+	err = db.Ping()
+	conns.record(err)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &DB{DB: db, dialect: dialectSQLite, conns: conns}, nil
+}
@@ -0,0 +1,249 @@
+package main
+
+// stopWords are common English words left out of the search index, plus the letters left over from splitting "it's" or "don't"
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "but": true,
+	"by": true, "for": true, "if": true, "in": true, "into": true, "is": true, "it": true, "no": true,
+	"not": true, "of": true, "on": true, "or": true, "such": true, "that": true, "the": true, "their": true,
+	"then": true, "there": true, "these": true, "they": true, "this": true, "to": true, "was": true, "will": true,
+	"with": true, "s": true, "t": true,
+}
+
+// analyze splits `s` into the stemmed, lowercase terms stored in the search index, dropping stop words
+func analyze(s string) []string {
+	terms := []string{}
+	for _, w := range words(s) {
+		if !stopWords[w] {
+			terms = append(terms, stem(w))
+		}
+	}
+	return terms
+}
+
+// stem reduces a lowercase English word to its stem with the Porter algorithm.
+// Words that are short or not plain ASCII letters are returned unchanged
+func stem(w string) string {
+	if len(w) <= 2 {
+		return w
+	}
+	for ii := 0; ii < len(w); ii++ {
+		if w[ii] < 'a' || w[ii] > 'z' {
+			return w
+		}
+	}
+	p := &porter{b: []byte(w), k: len(w) - 1}
+	p.step1ab()
+	if p.k > 0 {
+		p.step1c()
+		p.step2()
+		p.step3()
+		p.step4()
+		p.step5()
+	}
+	return string(p.b[:p.k+1])
+}
+
+// porter holds a word being stemmed.  `b[:k+1]` is the current word and `j` marks the end of the stem before a matched suffix
+type porter struct {
+	b    []byte
+	k, j int
+}
+
+// cons reports whether b[i] is a consonant
+func (p *porter) cons(i int) bool {
+	switch p.b[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !p.cons(i-1)
+	}
+	return true
+}
+
+// m measures the number of vowel-consonant sequences in b[:j+1]
+func (p *porter) m() int {
+	n, i := 0, 0
+	for ; ; i++ {
+		if i > p.j {
+			return n
+		}
+		if !p.cons(i) {
+			break
+		}
+	}
+	i++
+	for {
+		for ; ; i++ {
+			if i > p.j {
+				return n
+			}
+			if p.cons(i) {
+				break
+			}
+		}
+		i++
+		n++
+		for ; ; i++ {
+			if i > p.j {
+				return n
+			}
+			if !p.cons(i) {
+				break
+			}
+		}
+		i++
+	}
+}
+
+// vowelInStem reports whether b[:j+1] contains a vowel
+func (p *porter) vowelInStem() bool {
+	for i := 0; i <= p.j; i++ {
+		if !p.cons(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// doubleC reports whether b[i-1:i+1] is a double consonant
+func (p *porter) doubleC(i int) bool {
+	return i >= 1 && p.b[i] == p.b[i-1] && p.cons(i)
+}
+
+// cvc reports whether b[i-2:i+1] is consonant-vowel-consonant and the last consonant is not w, x or y
+func (p *porter) cvc(i int) bool {
+	if i < 2 || !p.cons(i) || p.cons(i-1) || !p.cons(i-2) {
+		return false
+	}
+	switch p.b[i] {
+	case 'w', 'x', 'y':
+		return false
+	}
+	return true
+}
+
+// ends reports whether the word ends with `s`, setting `j` to the end of the stem before it
+func (p *porter) ends(s string) bool {
+	l := len(s)
+	if l > p.k+1 || string(p.b[p.k-l+1:p.k+1]) != s {
+		return false
+	}
+	p.j = p.k - l
+	return true
+}
+
+// setTo replaces the suffix after `j` with `s`
+func (p *porter) setTo(s string) {
+	p.b = append(p.b[:p.j+1], s...)
+	p.k = p.j + len(s)
+}
+
+// r replaces the suffix after `j` with `s` if the stem has a measure above zero
+func (p *porter) r(s string) {
+	if p.m() > 0 {
+		p.setTo(s)
+	}
+}
+
+// step1ab removes plurals and -ed or -ing
+func (p *porter) step1ab() {
+	if p.b[p.k] == 's' {
+		if p.ends("sses") {
+			p.k -= 2
+		} else if p.ends("ies") {
+			p.setTo("i")
+		} else if p.b[p.k-1] != 's' {
+			p.k--
+		}
+	}
+	if p.ends("eed") {
+		if p.m() > 0 {
+			p.k--
+		}
+	} else if (p.ends("ed") || p.ends("ing")) && p.vowelInStem() {
+		p.k = p.j
+		if p.ends("at") {
+			p.setTo("ate")
+		} else if p.ends("bl") {
+			p.setTo("ble")
+		} else if p.ends("iz") {
+			p.setTo("ize")
+		} else if p.doubleC(p.k) {
+			p.k--
+			switch p.b[p.k] {
+			case 'l', 's', 'z':
+				p.k++
+			}
+		} else if p.m() == 1 && p.cvc(p.k) {
+			p.setTo("e")
+		}
+	}
+}
+
+// step1c turns a terminal y into i when there is another vowel in the stem
+func (p *porter) step1c() {
+	if p.ends("y") && p.vowelInStem() {
+		p.b[p.k] = 'i'
+	}
+}
+
+// step2 maps double suffixes to single ones, e.g. -ization to -ize
+func (p *porter) step2() {
+	for _, s := range [][2]string{
+		{"ational", "ate"}, {"tional", "tion"}, {"enci", "ence"}, {"anci", "ance"}, {"izer", "ize"},
+		{"bli", "ble"}, {"alli", "al"}, {"entli", "ent"}, {"eli", "e"}, {"ousli", "ous"},
+		{"ization", "ize"}, {"ation", "ate"}, {"ator", "ate"}, {"alism", "al"}, {"iveness", "ive"},
+		{"fulness", "ful"}, {"ousness", "ous"}, {"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"},
+		{"logi", "log"},
+	} {
+		if p.ends(s[0]) {
+			p.r(s[1])
+			return
+		}
+	}
+}
+
+// step3 deals with -ic-, -full, -ness etc.
+func (p *porter) step3() {
+	for _, s := range [][2]string{
+		{"icate", "ic"}, {"ative", ""}, {"alize", "al"}, {"iciti", "ic"}, {"ical", "ic"}, {"ful", ""}, {"ness", ""},
+	} {
+		if p.ends(s[0]) {
+			p.r(s[1])
+			return
+		}
+	}
+}
+
+// step4 removes -ant, -ence etc. from stems with a measure above one
+func (p *porter) step4() {
+	for _, s := range []string{
+		"al", "ance", "ence", "er", "ic", "able", "ible", "ant", "ement", "ment", "ent",
+		"ion", "ou", "ism", "ate", "iti", "ous", "ive", "ize",
+	} {
+		if !p.ends(s) {
+			continue
+		}
+		if s == "ion" && (p.j < 0 || (p.b[p.j] != 's' && p.b[p.j] != 't')) {
+			return
+		}
+		if p.m() > 1 {
+			p.k = p.j
+		}
+		return
+	}
+}
+
+// step5 removes a final -e and reduces a final -ll to -l when the measure allows
+func (p *porter) step5() {
+	p.j = p.k
+	if p.b[p.k] == 'e' {
+		a := p.m()
+		if a > 1 || (a == 1 && !p.cvc(p.k-1)) {
+			p.k--
+		}
+	}
+	if p.b[p.k] == 'l' && p.doubleC(p.k) && p.m() > 1 {
+		p.k--
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Store is the storage layer used by request handlers.  `DB` implements it on top of MySQL, SQLite or Postgres, `MemStore` implements it in memory.
+// Methods taking a context give up once it ends, returning its error
+type Store interface {
+	// Init creates any missing tables
+	Init()
+	// Close releases the underlying connection, if any
+	Close() error
+	// WithTx runs `fn` against a Store whose changes are all kept if `fn` returns nil and all discarded otherwise
+	WithTx(ctx context.Context, fn func(Store) error) error
+	// ConnState reports the health of the underlying connection
+	ConnState() ConnState
+
+	TagNameExists(ctx context.Context, s string) (int64, bool)
+	TagNamesExist(ctx context.Context, s ...string) ([]int64, bool)
+	ArticleTags(ctx context.Context, id int64) ([]DBTag, error)
+
+	// Searches also return how many results match in all if `withTotal` is set, which costs the DB stores a second query.
+	// Otherwise the total may be 0
+	ArticlesWithTagsSearch(ctx context.Context, tags []string, tq tagQuery, lookslike, orderby string, reverse bool, after *searchCursor, limit, offset int, withTotal bool) ([]DBArticle, int, error)
+	ArticlesFullTextSearch(ctx context.Context, tags []string, tq tagQuery, query, lookslike, orderby string, reverse bool, after *searchCursor, limit, offset int, withTotal bool) ([]DBArticle, int, error)
+	TagSearch(ctx context.Context, tags []string, lookslike, orderby string, reverse bool, after *searchCursor, limit int, offset int, withTotal bool) ([]DBTag, int, error)
+	ArticleByID(ctx context.Context, id int64) (*DBArticle, error)
+	TagByID(ctx context.Context, id int64) (*DBTag, error)
+
+	InsertArticleTag(ctx context.Context, articleID int64, tagID int64) (int64, error)
+	InsertArticleTags(ctx context.Context, id int64, tagIDs []int64) error
+	InsertArticle(ctx context.Context, a UploadArticle) (int64, error)
+	InsertTag(ctx context.Context, t UploadTag) (int64, error)
+
+	RemoveArticleTags(ctx context.Context, articleID int64) error
+	RemoveTagsFromArticles(ctx context.Context, tagID int64) error
+	// RemoveArticle and RemoveTag move rows to the trash, hiding them from every read except TrashedArticles and TrashedTags
+	RemoveArticle(ctx context.Context, id int64) error
+	RemoveTag(ctx context.Context, id int64) error
+
+	TrashedArticles(ctx context.Context, limit, offset int) ([]DBArticle, error)
+	TrashedTags(ctx context.Context, limit, offset int) ([]DBTag, error)
+	RestoreArticle(ctx context.Context, id int64) (bool, error)
+	RestoreTag(ctx context.Context, id int64) (bool, error)
+	// PurgeTrash permanently removes rows moved to the trash before `before`, keeping their revisions
+	PurgeTrash(ctx context.Context, before time.Time) (int64, error)
+
+	// SaveArticleRevision and SaveTagRevision snapshot a row after user `userID`, or nobody known if it is 0, changed it
+	// with `action`
+	SaveArticleRevision(ctx context.Context, id int64, action string, userID int64) error
+	SaveTagRevision(ctx context.Context, id int64, action string, userID int64) error
+	ArticleRevisions(ctx context.Context, id int64, limit, offset int) ([]ArticleRevision, error)
+	TagRevisions(ctx context.Context, id int64, limit, offset int) ([]TagRevision, error)
+	ArticleRevision(ctx context.Context, id, rev int64) (*ArticleRevision, error)
+	TagRevision(ctx context.Context, id, rev int64) (*TagRevision, error)
+
+	UpdateArticle(ctx context.Context, id int64, article UploadArticle) error
+	UpdateTag(ctx context.Context, id int64, tag UploadTag) error
+
+	// RegisterImages records images before they are written to the blob store, so CollectImages does not remove them
+	// before the article using them is saved
+	RegisterImages(ctx context.Context, images []Image) error
+	// CollectImages unregisters images no article uses after `remove` deletes them from the blob store, keeping them
+	// from being registered again until it returns
+	CollectImages(ctx context.Context, remove func([]string), names ...string) ([]string, error)
+	ImageStats(ctx context.Context) (ImageStats, error)
+
+	// UserByName returns nil if no user has the name, ignoring case
+	UserByName(ctx context.Context, name string) (*User, error)
+	UserByID(ctx context.Context, id int64) (*User, error)
+	InsertUser(ctx context.Context, user User) (int64, error)
+	Users(ctx context.Context, limit, offset int) ([]User, error)
+	// SetUserRole refuses to demote the last admin with `errLastAdmin`
+	SetUserRole(ctx context.Context, id int64, role Role) (bool, error)
+
+	// InsertSession also removes sessions that expired before `s` was created
+	InsertSession(ctx context.Context, s Session) error
+	// SessionByID returns nil if no session has the ID
+	SessionByID(ctx context.Context, id string) (*Session, error)
+	// RotateSession swaps the refresh token hash of an active session from `oldHash` to `newHash`, reporting whether it did
+	RotateSession(ctx context.Context, id, oldHash, newHash string, expiresAt time.Time) (bool, error)
+	RevokeSession(ctx context.Context, id string) error
+}
+
+var _ Store = (*DB)(nil)
+var _ Store = (*MemStore)(nil)
+var _ Store = (*IndexedStore)(nil)
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Limits on a tag query, keeping the parser's recursion and the compiled SQL small
+const (
+	maxTagQueryTags  = 64
+	maxTagQueryDepth = 32
+)
+
+// tagQuery is a parsed boolean expression over tag names, e.g. `(economy OR immigration) AND NOT terrorism`
+type tagQuery interface {
+	// matches reports whether an article with tag names `tags` satisfies the query
+	matches(tags []string) bool
+	// sql compiles the query into a condition on articles aliased `a`, appending its parameters to `params`
+	sql(db *DB, params *[]interface{}) string
+	// String formats the query so it parses back to the same query, with only the quotes and parentheses it needs
+	String() string
+}
+
+// tagQueryName matches articles with a tag, ignoring case
+type tagQueryName string
+
+// tagQueryNot matches articles not matching `x`
+type tagQueryNot struct{ x tagQuery }
+
+// tagQueryAnd matches articles matching both `l` and `r`
+type tagQueryAnd struct{ l, r tagQuery }
+
+// tagQueryOr matches articles matching either `l` or `r`
+type tagQueryOr struct{ l, r tagQuery }
+
+func (q tagQueryName) matches(tags []string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, string(q)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q tagQueryNot) matches(tags []string) bool { return !q.x.matches(tags) }
+func (q tagQueryAnd) matches(tags []string) bool { return q.l.matches(tags) && q.r.matches(tags) }
+func (q tagQueryOr) matches(tags []string) bool  { return q.l.matches(tags) || q.r.matches(tags) }
+
+func (q tagQueryName) String() string {
+	s := string(q)
+	switch strings.ToUpper(s) {
+	case "AND", "OR", "NOT":
+		return `"` + s + `"`
+	}
+	if strings.ContainsAny(s, `()"`) || strings.IndexFunc(s, unicode.IsSpace) >= 0 {
+		return `"` + s + `"`
+	}
+	return s
+}
+
+// tagQueryOperand formats `q` as an operand of an operator binding tighter than OR, or than AND if `and`
+func tagQueryOperand(q tagQuery, and bool) string {
+	switch q.(type) {
+	case tagQueryOr:
+		return "(" + q.String() + ")"
+	case tagQueryAnd:
+		if and {
+			return "(" + q.String() + ")"
+		}
+	}
+	return q.String()
+}
+
+func (q tagQueryNot) String() string { return "NOT " + tagQueryOperand(q.x, true) }
+func (q tagQueryAnd) String() string {
+	return tagQueryOperand(q.l, false) + " AND " + tagQueryOperand(q.r, false)
+}
+func (q tagQueryOr) String() string { return q.l.String() + " OR " + q.r.String() }
+
+func (q tagQueryName) sql(db *DB, params *[]interface{}) string {
+	*params = append(*params, string(q))
+	return "EXISTS (SELECT 1 FROM article_to_tag tq INNER JOIN tags tqt ON tq.TagID = tqt.ID" +
+		" WHERE tq.ArticleID = a.ID AND tqt.DeletedAt IS NULL AND " + db.foldCase("tqt.Name") + " = " + db.foldCase("?") + ")"
+}
+
+func (q tagQueryNot) sql(db *DB, params *[]interface{}) string {
+	return "(NOT " + q.x.sql(db, params) + ")"
+}
+
+func (q tagQueryAnd) sql(db *DB, params *[]interface{}) string {
+	l := q.l.sql(db, params)
+	return "(" + l + " AND " + q.r.sql(db, params) + ")"
+}
+
+func (q tagQueryOr) sql(db *DB, params *[]interface{}) string {
+	l := q.l.sql(db, params)
+	return "(" + l + " OR " + q.r.sql(db, params) + ")"
+}
+
+// tagQueryError is a syntax error in a tag query, returned to clients as a 400
+type tagQueryError struct {
+	msg string
+}
+
+func (e *tagQueryError) Error() string {
+	return "tagquery: " + e.msg
+}
+
+type tagToken struct {
+	// one of "tag", "AND", "OR", "NOT", "(", ")" or "" at the end of the query
+	kind string
+	text string
+	// 1-based character position in the query
+	pos int
+}
+
+func (t tagToken) String() string {
+	if len(t.kind) == 0 {
+		return "end of query"
+	}
+	return fmt.Sprintf("'%s' at position %d", t.text, t.pos)
+}
+
+// lexTagQuery splits `s` into tokens.  Tag names are runs of anything but spaces, parentheses and quotes, or "quoted"
+func lexTagQuery(s string) ([]tagToken, error) {
+	rs := []rune(s)
+	toks := []tagToken{}
+	for ii := 0; ii < len(rs); {
+		c := rs[ii]
+		switch {
+		case unicode.IsSpace(c):
+			ii++
+		case c == '(' || c == ')':
+			toks = append(toks, tagToken{kind: string(c), text: string(c), pos: ii + 1})
+			ii++
+		case c == '"':
+			end := ii + 1
+			for end < len(rs) && rs[end] != '"' {
+				end++
+			}
+			if end == len(rs) {
+				return nil, &tagQueryError{fmt.Sprintf("unterminated quote at position %d", ii+1)}
+			}
+			toks = append(toks, tagToken{kind: "tag", text: string(rs[ii+1 : end]), pos: ii + 1})
+			ii = end + 1
+		default:
+			end := ii
+			for end < len(rs) && !unicode.IsSpace(rs[end]) && !strings.ContainsRune(`()"`, rs[end]) {
+				end++
+			}
+			text := string(rs[ii:end])
+			kind := strings.ToUpper(text)
+			if kind != "AND" && kind != "OR" && kind != "NOT" {
+				kind = "tag"
+			}
+			toks = append(toks, tagToken{kind: kind, text: text, pos: ii + 1})
+			ii = end
+		}
+	}
+	return append(toks, tagToken{pos: len(rs) + 1}), nil
+}
+
+// tagQueryParser is a recursive descent parser for
+//
+//	or   = and { OR and }
+//	and  = not { AND not }
+//	not  = NOT not | "(" or ")" | tag
+type tagQueryParser struct {
+	toks  []tagToken
+	next  int
+	tags  int
+	depth int
+}
+
+// parseTagQuery parses `s`, returning a *tagQueryError describing the first syntax error
+func parseTagQuery(s string) (tagQuery, error) {
+	toks, err := lexTagQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &tagQueryParser{toks: toks}
+	q, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); len(tok.kind) > 0 {
+		if tok.kind == ")" {
+			return nil, &tagQueryError{"unmatched " + tok.String()}
+		}
+		return nil, &tagQueryError{"expected AND or OR but found " + tok.String()}
+	}
+	return q, nil
+}
+
+func (p *tagQueryParser) peek() tagToken {
+	return p.toks[p.next]
+}
+
+func (p *tagQueryParser) take() tagToken {
+	tok := p.toks[p.next]
+	if len(tok.kind) > 0 {
+		p.next++
+	}
+	return tok
+}
+
+func (p *tagQueryParser) or() (tagQuery, error) {
+	q, err := p.and()
+	for err == nil && p.peek().kind == "OR" {
+		p.take()
+		var r tagQuery
+		r, err = p.and()
+		q = tagQueryOr{q, r}
+	}
+	return q, err
+}
+
+func (p *tagQueryParser) and() (tagQuery, error) {
+	q, err := p.not()
+	for err == nil && p.peek().kind == "AND" {
+		p.take()
+		var r tagQuery
+		r, err = p.not()
+		q = tagQueryAnd{q, r}
+	}
+	return q, err
+}
+
+func (p *tagQueryParser) not() (tagQuery, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxTagQueryDepth {
+		return nil, &tagQueryError{fmt.Sprintf("query nests deeper than %d levels", maxTagQueryDepth)}
+	}
+
+	tok := p.take()
+	switch tok.kind {
+	case "NOT":
+		x, err := p.not()
+		return tagQueryNot{x}, err
+	case "(":
+		q, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if end := p.take(); end.kind != ")" {
+			return nil, &tagQueryError{fmt.Sprintf("expected ')' to close '(' at position %d but found %s", tok.pos, end)}
+		}
+		return q, nil
+	case "tag":
+		p.tags++
+		if p.tags > maxTagQueryTags {
+			return nil, &tagQueryError{fmt.Sprintf("query has more than %d tags", maxTagQueryTags)}
+		}
+		if len(tok.text) == 0 {
+			return nil, &tagQueryError{fmt.Sprintf("empty tag name at position %d", tok.pos)}
+		}
+		return tagQueryName(tok.text), nil
+	default:
+		return nil, &tagQueryError{"expected a tag name, NOT or '(' but found " + tok.String()}
+	}
+}
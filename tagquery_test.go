@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseTagQuery(t *testing.T) {
+	for s, want := range map[string]string{
+		"economy": "economy",
+		"(economy OR immigration) AND NOT terrorism":  "(economy OR immigration) AND NOT terrorism",
+		"economy or immigration and terrorism":        "economy OR immigration AND terrorism",
+		"(economy or immigration) and (a or b)":       "(economy OR immigration) AND (a OR b)",
+		"NOT (economy AND immigration)":               "NOT (economy AND immigration)",
+		"not not economy":                             "NOT NOT economy",
+		`"and so" AND "or" AND "a(b)"`:                `"and so" AND "or" AND "a(b)"`,
+		"((((economy))))":                             "economy",
+		"  économie\tAND  immigration ":               "économie AND immigration",
+		"economy AND (immigration AND terrorism)":     "economy AND immigration AND terrorism",
+		"economy OR (immigration OR terrorism) OR xy": "economy OR immigration OR terrorism OR xy",
+	} {
+		q, err := parseTagQuery(s)
+		if err != nil {
+			t.Errorf("%q: %v", s, err)
+			continue
+		}
+		if q.String() != want {
+			t.Errorf("%q parsed as %q, want %q", s, q.String(), want)
+		}
+		// formatting a query parses back to the same query
+		again, err := parseTagQuery(q.String())
+		if err != nil || again.String() != q.String() {
+			t.Errorf("%q formatted as %q, which parses as %v, %v", s, q.String(), again, err)
+		}
+	}
+}
+
+func TestParseTagQueryErrors(t *testing.T) {
+	for s, want := range map[string]string{
+		"":                  "end of query",
+		" ":                 "end of query",
+		"(economy":          "expected ')' to close '(' at position 1",
+		"economy)":          "unmatched ')' at position 8",
+		"AND economy":       "'AND' at position 1",
+		"economy AND":       "end of query",
+		"economy immigrate": "expected AND or OR but found 'immigrate' at position 9",
+		`"econ`:             "position 1",
+		`""`:                "empty tag name at position 1",
+		"()":                "')' at position 2",
+		strings.Repeat("(", maxTagQueryDepth+1) + "economy" + strings.Repeat(")", maxTagQueryDepth+1): "deeper than",
+		strings.Repeat("economy OR ", maxTagQueryTags) + "economy":                                    "more than",
+	} {
+		_, err := parseTagQuery(s)
+		if _, ok := err.(*tagQueryError); !ok {
+			t.Errorf("%q: got %v, want a tagQueryError", s, err)
+		} else if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got %q, want it to mention %q", s, err, want)
+		}
+	}
+}
+
+func TestTagQuerySearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, store := range testStores(t, dir) {
+		t.Run(name, func(t *testing.T) {
+			defer store.Close()
+			ctx := context.Background()
+			for _, tag := range []string{"economy", "immigration", "terrorism", "and so"} {
+				if _, err := store.InsertTag(ctx, UploadTag{Name: tag}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, a := range []UploadArticle{
+				{Name: "a1", Tags: []string{"economy"}},
+				{Name: "a2", Tags: []string{"immigration", "terrorism"}},
+				{Name: "a3", Tags: []string{"economy", "immigration"}},
+				{Name: "a4", Tags: []string{"and so"}},
+				{Name: "a5"},
+			} {
+				if _, err := store.InsertArticle(ctx, a); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for query, want := range map[string][]string{
+				"(economy OR immigration) AND NOT terrorism": {"a1", "a3"},
+				"ECONOMY and immigration":                    {"a3"},
+				"not economy":                                {"a2", "a4", "a5"},
+				`"AND SO"`:                                   {"a4"},
+				"economy or immigration and terrorism":       {"a1", "a2", "a3"},
+				"nosuch":                                     {},
+				"not nosuch":                                 {"a1", "a2", "a3", "a4", "a5"},
+			} {
+				tq, err := parseTagQuery(query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				articles, _, err := store.ArticlesWithTagsSearch(ctx, nil, tq, "", "name", false, nil, 0, 0, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := []string{}
+				for _, a := range articles {
+					got = append(got, a.Name)
+				}
+				if !sameStrings(got, want) {
+					t.Errorf("%q found %v, want %v", query, got, want)
+				}
+			}
+		})
+	}
+}
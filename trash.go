@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// trashPurgePeriod is how often WatchTrash looks for expired rows
+const trashPurgePeriod = time.Hour
+
+// purgeTrash permanently removes whatever has been in `store`'s trash longer than `retention`, unless `retention` is 0,
+// then deletes images no article uses from `images`
+func purgeTrash(ctx context.Context, store Store, images BlobStore, retention time.Duration) {
+	if retention > 0 {
+		n, err := store.PurgeTrash(ctx, time.Now().Add(-retention))
+		if err != nil {
+			log.Println("Error purging trash:", err)
+			return
+		} else if n > 0 {
+			log.Println("Purged", n, "articles and tags from the trash")
+		}
+	}
+	collectImages(ctx, store, images)
+}
+
+// WatchTrash purges `store`'s trash of rows older than `retention` now and every `period` after, collecting unused
+// images each time.  Never returns
+func WatchTrash(store Store, images BlobStore, retention, period time.Duration) {
+	t := time.NewTicker(period)
+	defer t.Stop()
+	for {
+		purgeTrash(context.Background(), store, images, retention)
+		<-t.C
+	}
+}
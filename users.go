@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	errUsernameTaken      = "username taken"
+	errInvalidCredentials = "invalid credentials"
+	errInvalidUsername    = "username must be 3-30 letters, digits, '_', '-' or '.'"
+	errInvalidPassword    = "password must be 5-50 bytes"
+)
+
+// errUserExists is returned when inserting a user whose name is taken, regardless of case
+var errUserExists = errors.New(errUsernameTaken)
+
+// usernameRe limits names to characters that cannot be confused for one another or need escaping
+var usernameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// User is an account.  The password hash never leaves the server
+type User struct {
+	ID           int64     `json:"id" example:"1"`
+	Name         string    `json:"name" example:"alice"`
+	PasswordHash string    `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+	Role         Role      `json:"role" enums:"viewer,contributor,editor,admin" example:"contributor"`
+}
+
+// UserCredentials is a representation of a user sent from frontend to register or log in
+type UserCredentials struct {
+	Name     string `json:"name" minLength:"3" maxLength:"30" example:"alice"`
+	Password string `json:"password" minLength:"5" maxLength:"50" example:"correct horse"`
+}
+
+// validate checks the name and password lengths, returning a message for the client if either is invalid.  Passwords are
+// measured in bytes, which keeps them under bcrypt's 72 byte limit
+func (u UserCredentials) validate() (string, bool) {
+	if len(u.Name) < UNameMinLen || len(u.Name) > UNameMaxLen || !usernameRe.MatchString(u.Name) {
+		return errInvalidUsername, false
+	} else if len(u.Password) < UPasswdMinLen || len(u.Password) > UPasswdMaxLen {
+		return errInvalidPassword, false
+	}
+	return "", true
+}
+
+// hashPassword salts and hashes `password` with bcrypt
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// dummyPasswordHash is compared against when logging in as a user that does not exist, so the response takes as long as
+// for a wrong password and does not reveal which names are registered
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("debatabase"), bcrypt.DefaultCost)
+
+// checkPassword reports whether `password` is that of `user`, which may be nil
+func checkPassword(user *User, password string) bool {
+	if user == nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) == nil
+}
+
+// UserByName returns the user named `name`, ignoring case, or nil
+func (db *DB) UserByName(ctx context.Context, name string) (*User, error) {
+	s := "SELECT ID, Name, PasswordHash, CreatedAt, Role FROM users WHERE " + db.foldCase("Name") + "=" + db.foldCase("?") + ";"
+	var user *User
+	err := db.read(ctx, func(ctx context.Context, c *DB) error {
+		u := User{}
+		err := c.QueryRow(ctx, s, name).Scan(&u.ID, &u.Name, &u.PasswordHash, &u.CreatedAt, &u.Role)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		user = &u
+		return nil
+	})
+	return user, err
+}
+
+// UserByID returns user `id`, or nil
+func (db *DB) UserByID(ctx context.Context, id int64) (*User, error) {
+	var user *User
+	err := db.read(ctx, func(ctx context.Context, c *DB) error {
+		u := User{}
+		err := c.QueryRow(ctx, "SELECT ID, Name, PasswordHash, CreatedAt, Role FROM users WHERE ID=?;", id).Scan(&u.ID, &u.Name, &u.PasswordHash, &u.CreatedAt, &u.Role)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		user = &u
+		return nil
+	})
+	return user, err
+}
+
+// InsertUser registers `user`, returning its ID, or `errUserExists`
+func (db *DB) InsertUser(ctx context.Context, user User) (int64, error) {
+	var id int64
+	err := db.run(ctx, func(ctx context.Context, c *DB) error {
+		return c.withTx(ctx, func(tx *DB) error {
+			taken := 0
+			err := tx.QueryRow(ctx, "SELECT COUNT(*) FROM users WHERE "+tx.foldCase("Name")+"="+tx.foldCase("?")+";", user.Name).Scan(&taken)
+			if err != nil {
+				return err
+			} else if taken > 0 {
+				return errUserExists
+			}
+			id, err = tx.insertID(ctx, "INSERT INTO users (Name, PasswordHash, CreatedAt, Role) VALUES (?, ?, ?, ?);",
+				user.Name, user.PasswordHash, user.CreatedAt, user.Role)
+			return err
+		})
+	})
+	return id, err
+}
+
+// readCredentials reads and validates the credentials in the body of `r`, writing an error and returning false if they
+// are missing or invalid
+func readCredentials(w http.ResponseWriter, r *http.Request) (UserCredentials, bool) {
+	creds := UserCredentials{}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		internalError("reading body", w, err)
+		return creds, false
+	}
+	err = json.Unmarshal(body, &creds)
+	if err != nil {
+		writeError("malformed request", 400, w)
+		return creds, false
+	}
+	if msg, ok := creds.validate(); !ok {
+		writeError(msg, 400, w)
+		return creds, false
+	}
+	return creds, true
+}
+
+// @Summary Create User
+// @Description Names are 3-30 letters, digits, `_`, `-` or `.` and unique regardless of case.  Passwords are 5-50 bytes.
+// @Description New users are contributors
+// @Accept  json
+// @Produce json
+// @Param user body main.UserCredentials true "User data"
+// @Success 200 {object} main.User "Created user"
+// @Failure 400 {object} main.ErrJSON "Bad request"
+// @Failure 403 {object} main.ErrJSON "Username taken"
+// @Failure 500 {object} main.ErrJSON "Internal error"
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
+// @Router /api/user/create [POST]
+func (api *API) createUser(w http.ResponseWriter, r *http.Request) {
+	creds, ok := readCredentials(w, r)
+	if !ok {
+		return
+	}
+	hash, err := hashPassword(creds.Password)
+	if err != nil {
+		internalError("hashing password", w, err)
+		return
+	}
+	// DATETIME columns keep whole seconds
+	user := User{Name: creds.Name, PasswordHash: hash, CreatedAt: time.Now().UTC().Truncate(time.Second), Role: RoleContributor}
+	user.ID, err = api.store.InsertUser(r.Context(), user)
+	if err == errUserExists {
+		writeError(errUsernameTaken, 403, w)
+		return
+	} else if err != nil {
+		internalError("inserting user", w, err)
+		return
+	}
+	resp, err := json.Marshal(user)
+	if err != nil {
+		internalError("marshalling response", w, err)
+		return
+	}
+	w.Write(resp)
+}
+
+// @Summary Log in as User
+// @Description Starts a session, returning an access token to send as `Authorization: Bearer <access_token>` and a refresh
+// @Description token for /api/user/refresh
+// @Accept  json
+// @Produce json
+// @Param user body main.UserCredentials true "User data"
+// @Success 200 {object} main.Tokens "Tokens"
+// @Failure 400 {object} main.ErrJSON "Bad request"
+// @Failure 403 {object} main.ErrJSON "Invalid credentials"
+// @Failure 500 {object} main.ErrJSON "Internal error"
+// @Failure 503 {object} main.ErrJSON "Request cancelled, or too many concurrent requests (see Retry-After)"
+// @Failure 504 {object} main.ErrJSON "Database query timed out"
+// @Router /api/user/auth [POST]
+func (api *API) authUser(w http.ResponseWriter, r *http.Request) {
+	creds, ok := readCredentials(w, r)
+	if !ok {
+		return
+	}
+	user, err := api.store.UserByName(r.Context(), creds.Name)
+	if err != nil {
+		internalError("querying user", w, err)
+		return
+	}
+	if !checkPassword(user, creds.Password) {
+		writeError(errInvalidCredentials, 403, w)
+		return
+	}
+	api.login(w, r, *user)
+}
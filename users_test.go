@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateCredentials(t *testing.T) {
+	for _, c := range []struct {
+		name, password string
+		msg            string
+	}{
+		{"alice", "hunter22", ""},
+		{"a_l.i-c3", "hunter", ""},
+		{"ali", strings.Repeat("x", UPasswdMaxLen), ""},
+		{"al", "hunter22", errInvalidUsername},
+		{strings.Repeat("a", UNameMaxLen+1), "hunter22", errInvalidUsername},
+		{"al ice", "hunter22", errInvalidUsername},
+		{"alíce", "hunter22", errInvalidUsername},
+		{"alice", "1234", errInvalidPassword},
+		{"alice", strings.Repeat("x", UPasswdMaxLen+1), errInvalidPassword},
+		// measured in bytes, so bcrypt sees all of it
+		{"alice", strings.Repeat("é", 26), errInvalidPassword},
+	} {
+		msg, ok := UserCredentials{Name: c.name, Password: c.password}.validate()
+		if msg != c.msg || ok != (len(c.msg) == 0) {
+			t.Errorf("%q with %q: got %q, %v, want %q", c.name, c.password, msg, ok, c.msg)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := hashPassword("hunter22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// salted, so the same password hashes differently each time
+	again, err := hashPassword("hunter22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash == again || strings.Contains(hash, "hunter22") {
+		t.Errorf("hashed as %s then %s", hash, again)
+	}
+	user := &User{Name: "alice", PasswordHash: hash}
+	for password, want := range map[string]bool{"hunter22": true, "hunter23": false, "HUNTER22": false, "": false} {
+		if got := checkPassword(user, password); got != want {
+			t.Errorf("checkPassword(%q) = %v, want %v", password, got, want)
+		}
+	}
+	if checkPassword(nil, "debatabase") {
+		t.Error("a user that does not exist has a password")
+	}
+}
+
+func TestInsertUser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, store := range testStores(t, dir) {
+		t.Run(name, func(t *testing.T) {
+			defer store.Close()
+			ctx := context.Background()
+			alice := User{Name: "Alice", PasswordHash: "hash", CreatedAt: time.Now().UTC().Truncate(time.Second), Role: RoleContributor}
+			id, err := store.InsertUser(ctx, alice)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// names are unique regardless of case
+			if _, err := store.InsertUser(ctx, User{Name: "aLICE", PasswordHash: "hash", Role: RoleContributor}); err != errUserExists {
+				t.Errorf("inserting a taken name returned %v", err)
+			}
+
+			alice.ID = id
+			for _, lookup := range []string{"alice", "ALICE"} {
+				u, err := store.UserByName(ctx, lookup)
+				if err != nil || u == nil || *u != alice {
+					t.Errorf("user named %q is %+v, %v, want %+v", lookup, u, err, alice)
+				}
+			}
+			if u, err := store.UserByID(ctx, id); err != nil || u == nil || *u != alice {
+				t.Errorf("user %d is %+v, %v", id, u, err)
+			}
+			if u, err := store.UserByName(ctx, "bob"); err != nil || u != nil {
+				t.Errorf("user named bob is %+v, %v", u, err)
+			}
+			if u, err := store.UserByID(ctx, id+1); err != nil || u != nil {
+				t.Errorf("user %d is %+v, %v", id+1, u, err)
+			}
+		})
+	}
+}
+
+func TestRouterUsers(t *testing.T) {
+	rt := newRouterTest(t)
+	var user User
+	if err := json.Unmarshal(rt.expect("POST", "/api/user/create", "", `{"name":"alice","password":"hunter22"}`, 200).Body.Bytes(), &user); err != nil {
+		t.Fatal(err)
+	}
+	if user.ID == 0 || user.Name != "alice" || user.Role != RoleContributor || user.CreatedAt.IsZero() {
+		t.Errorf("created %+v", user)
+	}
+	for _, c := range []struct {
+		path, body string
+		code       int
+		msg        string
+	}{
+		{"/api/user/create", `{"name":"ALICE","password":"hunter22"}`, 403, errUsernameTaken},
+		{"/api/user/create", `{"name":"al","password":"hunter22"}`, 400, errInvalidUsername},
+		{"/api/user/create", `{"name":"bob","password":"1234"}`, 400, errInvalidPassword},
+		{"/api/user/create", `{`, 400, "malformed"},
+		{"/api/user/auth", `{"name":"Alice","password":"hunter22"}`, 200, `"access_token"`},
+		{"/api/user/auth", `{"name":"alice","password":"hunter23"}`, 403, errInvalidCredentials},
+		// the same answer whether or not the user exists
+		{"/api/user/auth", `{"name":"nobody","password":"hunter22"}`, 403, errInvalidCredentials},
+	} {
+		w := rt.do("POST", c.path, "", c.body)
+		body := w.Body.String()
+		if w.Code != c.code || !strings.Contains(body, c.msg) {
+			t.Errorf("%s %s: got %d %s, want %d mentioning %q", c.path, c.body, w.Code, body, c.code, c.msg)
+		}
+		if strings.Contains(body, "hunter22") || strings.Contains(body, "$2a$") {
+			t.Errorf("%s %s: response has the password: %s", c.path, c.body, body)
+		}
+	}
+}
@@ -9,3 +9,29 @@ func filterArr(arr []string, f func(string) bool) []string {
 	}
 	return r
 }
+
+// uniqueIDs returns `ids` with duplicates removed, preserving order
+func uniqueIDs(ids []int64) []int64 {
+	seen := make(map[int64]bool)
+	r := []int64{}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			r = append(r, id)
+		}
+	}
+	return r
+}
+
+// uniqueStrings returns `strs` with duplicates removed, preserving order
+func uniqueStrings(strs []string) []string {
+	seen := make(map[string]bool)
+	r := []string{}
+	for _, s := range strs {
+		if !seen[s] {
+			seen[s] = true
+			r = append(r, s)
+		}
+	}
+	return r
+}